@@ -0,0 +1,29 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command walctl manages the WAL and snapshot directories of a node that
+// is not running:
+//
+//	walctl verify [-snap-index n] <wal-dir>
+//	walctl repair [-dry-run] [-quarantine dir] <wal-dir>
+//	walctl snapshots [-snap-dir dir] <wal-dir>
+//	walctl stat <wal-dir>
+//	walctl purge -snap-dir dir | -snap-index n [-max-segments n] [-max-bytes n] [-max-age d] <wal-dir>
+//	walctl release -index n <snap-dir>
+//
+// It exits 0 on success, 1 if the command failed, 2 on a usage error, and
+// 3 if the WAL is corrupted or could not be repaired.
+package main
+
+import (
+	"os"
+
+	"github.com/BeDreamCoder/wal/ctl"
+)
+
+func main() {
+	os.Exit(ctl.Main(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,25 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command waldump prints the records of a WAL directory: the segment and
+// offset of each record, its type, crc, size, index and decoded payload,
+// as text or JSON Lines.
+//
+//	waldump [-format text|json] [-type entry,snapshot] [-start-index n] [-end-index n] [-decoder walpb|raw] <wal-dir>
+//
+// Entries of custom types are decoded by a binary of its own registering
+// their decoder with dump.RegisterDecoder before calling dump.Main.
+package main
+
+import (
+	"os"
+
+	"github.com/BeDreamCoder/wal/dump"
+)
+
+func main() {
+	os.Exit(dump.Main(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,359 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package ctl implements the walctl command, which manages the WAL and
+// snapshot directories of a node that is not running.
+package ctl
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BeDreamCoder/wal/log"
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/BeDreamCoder/wal/snap"
+	"github.com/BeDreamCoder/wal/snap/snappb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Exit codes of Main.
+const (
+	ExitOK      = 0
+	ExitError   = 1 // the command failed, such as on a missing or locked directory
+	ExitUsage   = 2
+	ExitCorrupt = 3 // the WAL is corrupted, or could not be repaired
+)
+
+type command struct {
+	usage string
+	run   func(c *ctx, args []string) int
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"verify":    {"verify [-snap-index n] <wal-dir>", runVerify},
+		"repair":    {"repair [-dry-run] [-quarantine dir] <wal-dir>", runRepair},
+		"snapshots": {"snapshots [-snap-dir dir] <wal-dir>", runSnapshots},
+		"stat":      {"stat <wal-dir>", runStat},
+		"purge":     {"purge -snap-dir dir | -snap-index n [-max-segments n] [-max-bytes n] [-max-age d] <wal-dir>", runPurge},
+		"release":   {"release -index n <snap-dir>", runRelease},
+	}
+}
+
+// ctx is the environment of a command.
+type ctx struct {
+	lg             *zap.Logger
+	opts           *log.Options
+	stdout, stderr io.Writer
+}
+
+func (c *ctx) fail(code int, err error) int {
+	fmt.Fprintf(c.stderr, "walctl: %v\n", err)
+	return code
+}
+
+// Main runs walctl with the arguments args, and returns its exit code.
+func Main(args []string, stdout, stderr io.Writer) int {
+	c := &ctx{
+		lg:     zap.NewNop(),
+		opts:   &log.Options{FS: log.OSFS, Registry: log.DefaultRegistry()},
+		stdout: stdout,
+		stderr: stderr,
+	}
+	if len(args) == 0 {
+		usage(stderr)
+		return ExitUsage
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(stderr)
+		return ExitUsage
+	}
+	return cmd.run(c, args[1:])
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: walctl <command> [flags] <dir>")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  walctl %s\n", commands[name].usage)
+	}
+}
+
+// parse parses the flags of the command fs is named after and its single
+// directory argument; ok is false on a usage error.
+func (c *ctx) parse(fs *flag.FlagSet, args []string) (dir string, ok bool) {
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "usage: walctl %s\n", commands[fs.Name()].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", false
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", false
+	}
+	return fs.Arg(0), true
+}
+
+// isCorruption reports whether err means that the records of a WAL do not
+// read back, rather than that the WAL could not be read at all. A snapshot
+// missing from the WAL is not corruption, the segments holding it may have
+// been purged.
+func isCorruption(err error) bool {
+	switch errors.Cause(err) {
+	case log.ErrCRCMismatch, walpb.ErrCRCMismatch, io.ErrUnexpectedEOF,
+		log.ErrMaxWALEntrySizeLimitExceeded, log.ErrInvalidRecord, log.ErrMetadataConflict,
+		log.ErrUnknownRecordType, log.ErrHeadCorrupted,
+		log.ErrInvalidCodec, log.ErrUnknownCodec, log.ErrDecrypt:
+		return true
+	}
+	return false
+}
+
+func (c *ctx) failWAL(err error) int {
+	if isCorruption(err) {
+		return c.fail(ExitCorrupt, err)
+	}
+	return c.fail(ExitError, err)
+}
+
+func runVerify(c *ctx, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	index := fs.Uint64("snap-index", 0, "index of the WAL snapshot to verify from")
+	dir, ok := c.parse(fs, args)
+	if !ok {
+		return ExitUsage
+	}
+	if err := log.Verify(c.lg, dir, &walpb.Snapshot{Index: *index}, c.opts); err != nil {
+		return c.failWAL(err)
+	}
+	fmt.Fprintln(c.stdout, "ok")
+	return ExitOK
+}
+
+func runRepair(c *ctx, args []string) int {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	var (
+		dryRun     = fs.Bool("dry-run", false, "print the repair plan as JSON without changing anything; exits 3 if the WAL needs repairing")
+		quarantine = fs.String("quarantine", "", "repair corruption anywhere in the WAL, moving the segments cut off to this directory")
+	)
+	dir, ok := c.parse(fs, args)
+	if !ok {
+		return ExitUsage
+	}
+
+	switch {
+	case *dryRun:
+		r, err := log.RepairPlan(c.lg, dir, c.opts)
+		if err != nil {
+			return c.failWAL(err)
+		}
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return c.fail(ExitError, err)
+		}
+		fmt.Fprintln(c.stdout, string(b))
+		if r.Corrupted() {
+			return ExitCorrupt
+		}
+
+	case *quarantine != "":
+		m, err := log.RepairCorruption(c.lg, dir, *quarantine, c.opts)
+		if err != nil {
+			return c.failWAL(err)
+		}
+		if len(m.Files) == 0 {
+			fmt.Fprintf(c.stdout, "no corruption, last index %d\n", m.LastGoodIndex)
+			break
+		}
+		fmt.Fprintf(c.stdout, "repaired %s at offset %d: %s\n", m.Segment, m.Offset, m.Reason)
+		fmt.Fprintf(c.stdout, "last good index %d, quarantined %s to %s\n", m.LastGoodIndex, strings.Join(m.Files, ", "), m.Path)
+
+	default:
+		n, err := log.RepairTail(c.lg, dir, c.opts)
+		if err != nil {
+			return c.failWAL(err)
+		}
+		fmt.Fprintf(c.stdout, "repaired, truncated %d bytes\n", n)
+	}
+	return ExitOK
+}
+
+func runSnapshots(c *ctx, args []string) int {
+	fs := flag.NewFlagSet("snapshots", flag.ContinueOnError)
+	snapDir := fs.String("snap-dir", "", "snapshot directory to match the WAL snapshots with")
+	dir, ok := c.parse(fs, args)
+	if !ok {
+		return ExitUsage
+	}
+
+	walSnaps, err := log.ValidSnapshotEntries(c.lg, dir, c.opts)
+	if err != nil {
+		return c.failWAL(err)
+	}
+	for _, s := range walSnaps {
+		fmt.Fprintf(c.stdout, "wal snapshot %d\n", s.GetIndex())
+	}
+	if *snapDir == "" {
+		return ExitOK
+	}
+
+	ss := snap.New(c.lg, *snapDir)
+	names, err := ss.SnapNames()
+	if err != nil && err != snap.ErrNoSnapshot {
+		return c.fail(ExitError, err)
+	}
+	for _, name := range names {
+		fmt.Fprintf(c.stdout, "snap file %s\n", name)
+	}
+	newest, err := ss.LoadNewestAvailable(walSnaps)
+	switch err {
+	case nil:
+		fmt.Fprintf(c.stdout, "newest available snapshot %d\n", newest.Index)
+	case snap.ErrNoSnapshot:
+		fmt.Fprintln(c.stdout, "no available snapshot")
+	default:
+		return c.fail(ExitError, err)
+	}
+	return ExitOK
+}
+
+// segmentStat is the summary of a segment printed by stat.
+type segmentStat struct {
+	name        string
+	size        int64
+	records     int
+	entries     int
+	first, last uint64 // first and last entry index
+}
+
+func runStat(c *ctx, args []string) int {
+	fs := flag.NewFlagSet("stat", flag.ContinueOnError)
+	dir, ok := c.parse(fs, args)
+	if !ok {
+		return ExitUsage
+	}
+
+	var (
+		stats []*segmentStat
+		cur   *segmentStat
+	)
+	err := log.ScanRecords(c.lg, dir, c.opts, func(rec log.SegmentRecord) error {
+		if cur == nil || cur.name != rec.Segment {
+			fi, err := c.opts.FS.Stat(filepath.Join(dir, rec.Segment))
+			if err != nil {
+				return err
+			}
+			cur = &segmentStat{name: rec.Segment, size: fi.Size()}
+			stats = append(stats, cur)
+		}
+		cur.records++
+		if rec.Type == log.EntryType {
+			e := c.opts.Registry.NewEntry()
+			if err := e.Unmarshal(rec.Data); err != nil {
+				return errors.Wrapf(log.ErrInvalidRecord, "%s at offset %d: %v", rec.Segment, rec.Offset, err)
+			}
+			if cur.entries == 0 {
+				cur.first = e.GetIndex()
+			}
+			cur.entries++
+			cur.last = e.GetIndex()
+		}
+		return nil
+	})
+	if err != nil {
+		return c.failWAL(err)
+	}
+
+	var size int64
+	fmt.Fprintln(c.stdout, "segment\tsize\trecords\tentries\tfirst-index\tlast-index")
+	for _, s := range stats {
+		size += s.size
+		if s.entries == 0 {
+			fmt.Fprintf(c.stdout, "%s\t%d\t%d\t0\t-\t-\n", s.name, s.size, s.records)
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%s\t%d\t%d\t%d\t%d\t%d\n", s.name, s.size, s.records, s.entries, s.first, s.last)
+	}
+	fmt.Fprintf(c.stdout, "%d segments, %d bytes\n", len(stats), size)
+	return ExitOK
+}
+
+func runPurge(c *ctx, args []string) int {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	var policy log.PurgePolicy
+	fs.IntVar(&policy.MaxSegments, "max-segments", 0, "number of segments to keep")
+	fs.Int64Var(&policy.MaxBytes, "max-bytes", 0, "total size of the segments to keep")
+	fs.DurationVar(&policy.MaxAge, "max-age", 0, "age of the oldest segment to keep")
+	snapDir := fs.String("snap-dir", "", "snapshot directory whose newest available snapshot bounds the purge")
+	snapIndex := fs.Uint64("snap-index", 0, "index of the latest snapshot; the segment holding it and the later ones are kept")
+	dir, ok := c.parse(fs, args)
+	if !ok {
+		return ExitUsage
+	}
+	if (*snapDir == "") == (*snapIndex == 0) {
+		fmt.Fprintln(c.stderr, "walctl: purge needs one of -snap-dir and -snap-index")
+		return ExitUsage
+	}
+
+	index := *snapIndex
+	if *snapDir != "" {
+		walSnaps, err := log.ValidSnapshotEntries(c.lg, dir, c.opts)
+		if err != nil {
+			return c.failWAL(err)
+		}
+		newest, err := snap.New(c.lg, *snapDir).LoadNewestAvailable(walSnaps)
+		if err != nil {
+			return c.fail(ExitError, err)
+		}
+		index = newest.Index
+	}
+
+	purged, err := log.PurgeSegments(c.lg, dir, index, policy, c.opts)
+	for _, name := range purged {
+		fmt.Fprintf(c.stdout, "purged %s\n", name)
+	}
+	if err != nil {
+		if errors.Cause(err) == log.ErrInvalidOptions {
+			return c.fail(ExitUsage, err)
+		}
+		return c.fail(ExitError, err)
+	}
+	return ExitOK
+}
+
+func runRelease(c *ctx, args []string) int {
+	fs := flag.NewFlagSet("release", flag.ContinueOnError)
+	index := fs.Uint64("index", 0, "index of the snapshot; the snapshot db files older than it are removed")
+	dir, ok := c.parse(fs, args)
+	if !ok {
+		return ExitUsage
+	}
+	if *index == 0 {
+		fmt.Fprintln(c.stderr, "walctl: release needs -index")
+		return ExitUsage
+	}
+	if err := snap.New(c.lg, dir).ReleaseSnapDBs(snappb.ShotData{Index: *index}); err != nil {
+		return c.fail(ExitError, err)
+	}
+	fmt.Fprintf(c.stdout, "released snapshot db files before %d\n", *index)
+	return ExitOK
+}
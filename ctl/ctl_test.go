@@ -0,0 +1,111 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log"
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/BeDreamCoder/wal/snap"
+	"github.com/BeDreamCoder/wal/snap/snappb"
+	"github.com/stretchr/testify/assert"
+)
+
+func run(args ...string) (code int, stdout string) {
+	var out, errOut bytes.Buffer
+	code = Main(args, &out, &errOut)
+	return code, out.String()
+}
+
+func TestWalctl(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(p)
+	dir, snapDir := filepath.Join(p, "wal"), filepath.Join(p, "snap")
+
+	w, err := log.Create(dir, nil, &log.Options{SegmentSizeBytes: 2048})
+	assert.NoError(t, err)
+	for i := uint64(1); i <= 100; i++ {
+		assert.NoError(t, w.SaveEntry([]log.LogEntry{&walpb.Entry{Index: i, Data: make([]byte, 32)}}))
+	}
+	assert.NoError(t, w.SaveSnapshot(&walpb.Snapshot{Index: 50}))
+	assert.NoError(t, w.SaveState(&walpb.HardState{Committed: 100}))
+	assert.NoError(t, w.Close())
+
+	assert.NoError(t, os.Mkdir(snapDir, 0700))
+	assert.NoError(t, snap.New(nil, snapDir).SaveSnapData(snappb.ShotData{Index: 50}))
+
+	code, _ := run()
+	assert.Equal(t, ExitUsage, code)
+	code, _ = run("verify")
+	assert.Equal(t, ExitUsage, code)
+	code, _ = run("verify", filepath.Join(p, "missing"))
+	assert.Equal(t, ExitError, code)
+
+	code, out := run("verify", dir)
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "ok\n", out)
+
+	code, out = run("stat", dir)
+	assert.Equal(t, ExitOK, code)
+	names, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	assert.NoError(t, err)
+	assert.Contains(t, out, "\t100\n")
+	assert.Contains(t, out, fmt.Sprintf("%d segments", len(names)))
+
+	code, out = run("snapshots", "-snap-dir", snapDir, dir)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, out, "wal snapshot 50\n")
+	assert.Contains(t, out, "newest available snapshot 50\n")
+
+	// corrupt the data of a record in the middle of the log
+	seg := names[len(names)/2]
+	b, err := ioutil.ReadFile(seg)
+	assert.NoError(t, err)
+	b[len(b)/2] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(seg, b, 0600))
+
+	code, _ = run("verify", dir)
+	assert.Equal(t, ExitCorrupt, code)
+	code, out = run("repair", "-dry-run", dir)
+	assert.Equal(t, ExitCorrupt, code)
+	assert.Contains(t, out, `"last_good_index"`)
+	code, out = run("repair", "-quarantine", filepath.Join(p, "quarantine"), dir)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, out, "last good index")
+	code, _ = run("verify", dir)
+	assert.Equal(t, ExitOK, code)
+
+	// purging needs a snapshot to bound it
+	code, _ = run("purge", "-max-segments", "1", dir)
+	assert.Equal(t, ExitUsage, code)
+	// the repair dropped the WAL snapshot 50
+	code, out = run("purge", "-snap-dir", snapDir, "-max-segments", "1", dir)
+	assert.Equal(t, ExitError, code)
+	assert.NotContains(t, out, "purged ")
+	code, out = run("purge", "-snap-index", "100", "-max-segments", "1", dir)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, out, "purged ")
+	code, _ = run("purge", "-snap-index", "100", "-max-segments", "-1", dir)
+	assert.Equal(t, ExitUsage, code)
+	// the purged segments held the snapshot to verify from
+	var errOut bytes.Buffer
+	code = Main([]string{"verify", "-snap-index", "100", dir}, ioutil.Discard, &errOut)
+	assert.Equal(t, ExitError, code)
+	assert.Contains(t, errOut.String(), log.ErrSnapshotNotFound.Error())
+
+	code, _ = run("release", snapDir)
+	assert.Equal(t, ExitUsage, code)
+	code, _ = run("release", "-index", "50", snapDir)
+	assert.Equal(t, ExitOK, code)
+}
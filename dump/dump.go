@@ -0,0 +1,304 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package dump prints the records of a WAL directory. It implements the
+// waldump command; a binary of its own can plug in the Decoder of its
+// custom record types with RegisterDecoder and call Main.
+package dump
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BeDreamCoder/wal/log"
+	"github.com/pkg/errors"
+)
+
+// Decoder decodes the data of the records of a WAL for printing.
+type Decoder interface {
+	// Decode returns the printable payload of the data of a record of
+	// type rt, and the index of the record if ok.
+	Decode(rt log.RecordType, data []byte) (payload interface{}, index uint64, ok bool, err error)
+}
+
+var decoders sync.Map // map[string]Decoder
+
+func init() {
+	RegisterDecoder("walpb", RegistryDecoder(log.DefaultRegistry()))
+	RegisterDecoder("raw", rawDecoder{})
+}
+
+// RegisterDecoder makes d selectable by name with the -decoder flag of Main.
+func RegisterDecoder(name string, d Decoder) {
+	decoders.Store(name, d)
+}
+
+func lookupDecoder(name string) (Decoder, bool) {
+	d, ok := decoders.Load(name)
+	if !ok {
+		return nil, false
+	}
+	return d.(Decoder), true
+}
+
+// RegistryDecoder returns a Decoder of entries, states and snapshots into
+// the values of reg. The other records are decoded as by the raw decoder.
+func RegistryDecoder(reg *log.Registry) Decoder {
+	return registryDecoder{reg: reg}
+}
+
+type registryDecoder struct {
+	reg *log.Registry
+}
+
+func (d registryDecoder) Decode(rt log.RecordType, data []byte) (interface{}, uint64, bool, error) {
+	switch rt {
+	case log.EntryType:
+		e := d.reg.NewEntry()
+		if err := e.Unmarshal(data); err != nil {
+			return nil, 0, false, err
+		}
+		return e, e.GetIndex(), true, nil
+	case log.StateType:
+		s := d.reg.NewState()
+		if err := s.Unmarshal(data); err != nil {
+			return nil, 0, false, err
+		}
+		return s, 0, false, nil
+	case log.SnapshotType:
+		s := d.reg.NewSnapshot()
+		if err := s.Unmarshal(data); err != nil {
+			return nil, 0, false, err
+		}
+		return s, s.GetIndex(), true, nil
+	}
+	return rawDecoder{}.Decode(rt, data)
+}
+
+// rawDecoder prints the data of the records as is.
+type rawDecoder struct{}
+
+func (rawDecoder) Decode(rt log.RecordType, data []byte) (interface{}, uint64, bool, error) {
+	switch rt {
+	case log.CrcType:
+		return nil, 0, false, nil
+	case log.TruncateType:
+		if len(data) != 8 {
+			return nil, 0, false, errors.Errorf("truncate record of %d bytes", len(data))
+		}
+		return nil, binary.LittleEndian.Uint64(data), true, nil
+	case log.MetadataType:
+		return string(data), 0, false, nil
+	}
+	return hex.EncodeToString(data), 0, false, nil
+}
+
+// Record is a record as Dump prints it.
+type Record struct {
+	Segment string      `json:"segment"`
+	Offset  int64       `json:"offset"`
+	Type    string      `json:"type"`
+	Crc     uint32      `json:"crc"`
+	Size    int64       `json:"size"`
+	Index   *uint64     `json:"index,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+	Error   string      `json:"error,omitempty"` // why the payload did not decode
+}
+
+var typeNames = map[log.RecordType]string{
+	log.MetadataType: "metadata",
+	log.EntryType:    "entry",
+	log.StateType:    "state",
+	log.CrcType:      "crc",
+	log.SnapshotType: "snapshot",
+	log.TruncateType: "truncate",
+}
+
+// TypeName returns the name of rt, or its number for a user-defined kind.
+func TypeName(rt log.RecordType) string {
+	if name, ok := typeNames[rt]; ok {
+		return name
+	}
+	return strconv.FormatInt(int64(rt), 10)
+}
+
+// ParseType parses the name or number of a record type.
+func ParseType(s string) (log.RecordType, error) {
+	for rt, name := range typeNames {
+		if name == s {
+			return rt, nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("unknown record type %q", s)
+	}
+	return log.RecordType(n), nil
+}
+
+// Config selects the records Dump prints and how.
+type Config struct {
+	Dir     string
+	JSON    bool // print JSON Lines instead of text
+	Decoder Decoder
+	// Types are the types of the records printed; all if empty.
+	Types []log.RecordType
+	// StartIndex and EndIndex bound the indexes of the records printed
+	// that have one, inclusively; 0 leaves a bound open. The records
+	// without an index are not filtered.
+	StartIndex uint64
+	EndIndex   uint64
+	// Options configures how the records are read, such as the
+	// KeyProvider of an encrypted WAL.
+	Options *log.Options
+}
+
+func (c *Config) match(rt log.RecordType) bool {
+	if len(c.Types) == 0 {
+		return true
+	}
+	for _, t := range c.Types {
+		if t == rt {
+			return true
+		}
+	}
+	return false
+}
+
+// Dump prints the records of the WAL in cfg.Dir to w, one per line. It
+// stops at the first record that does not read back.
+func Dump(w io.Writer, cfg Config) error {
+	d := cfg.Decoder
+	if d == nil {
+		d = RegistryDecoder(log.DefaultRegistry())
+	}
+	if !cfg.JSON {
+		fmt.Fprintln(w, "segment\toffset\ttype\tcrc\tsize\tindex\tpayload")
+	}
+	enc := json.NewEncoder(w)
+	return log.ScanRecords(nil, cfg.Dir, cfg.Options, func(sr log.SegmentRecord) error {
+		if !cfg.match(sr.Type) {
+			return nil
+		}
+		r := Record{
+			Segment: sr.Segment,
+			Offset:  sr.Offset,
+			Type:    TypeName(sr.Type),
+			Crc:     sr.Crc,
+			Size:    sr.Size,
+		}
+		payload, index, ok, err := d.Decode(sr.Type, sr.Data)
+		if err != nil {
+			r.Payload, r.Error = hex.EncodeToString(sr.Data), err.Error()
+		} else {
+			r.Payload = payload
+		}
+		if ok {
+			if (cfg.StartIndex != 0 && index < cfg.StartIndex) || (cfg.EndIndex != 0 && index > cfg.EndIndex) {
+				return nil
+			}
+			r.Index = &index
+		}
+
+		if cfg.JSON {
+			return enc.Encode(r)
+		}
+		idx, text := "-", ""
+		if r.Index != nil {
+			idx = strconv.FormatUint(*r.Index, 10)
+		}
+		if r.Payload != nil {
+			text = fmt.Sprint(r.Payload)
+		}
+		if r.Error != "" {
+			text += " (" + r.Error + ")"
+		}
+		_, err = fmt.Fprintf(w, "%s\t%d\t%s\t%08x\t%d\t%s\t%s\n", r.Segment, r.Offset, r.Type, r.Crc, r.Size, idx, text)
+		return err
+	})
+}
+
+// Exit codes of Main.
+const (
+	ExitOK    = 0
+	ExitError = 1 // the WAL could not be read through
+	ExitUsage = 2
+)
+
+// Main runs the waldump command with the arguments args, and returns its
+// exit code.
+func Main(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("waldump", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		format  = fs.String("format", "text", "output format: text or json (JSON Lines)")
+		types   = fs.String("type", "", "comma separated record types to print: metadata, entry, state, crc, snapshot, truncate or a number")
+		start   = fs.Uint64("start-index", 0, "print the records with an index from start-index")
+		end     = fs.Uint64("end-index", 0, "print the records with an index up to end-index")
+		decoder = fs.String("decoder", "walpb", "decoder of the record data: "+strings.Join(decoderNames(), ", "))
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: waldump [flags] <wal-dir>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return ExitUsage
+	}
+
+	cfg := Config{Dir: fs.Arg(0), StartIndex: *start, EndIndex: *end}
+	switch *format {
+	case "text":
+	case "json":
+		cfg.JSON = true
+	default:
+		fmt.Fprintf(stderr, "waldump: unknown format %q\n", *format)
+		return ExitUsage
+	}
+	if *types != "" {
+		for _, s := range strings.Split(*types, ",") {
+			rt, err := ParseType(strings.TrimSpace(s))
+			if err != nil {
+				fmt.Fprintf(stderr, "waldump: %v\n", err)
+				return ExitUsage
+			}
+			cfg.Types = append(cfg.Types, rt)
+		}
+	}
+	d, ok := lookupDecoder(*decoder)
+	if !ok {
+		fmt.Fprintf(stderr, "waldump: unknown decoder %q\n", *decoder)
+		return ExitUsage
+	}
+	cfg.Decoder = d
+
+	if err := Dump(stdout, cfg); err != nil {
+		fmt.Fprintf(stderr, "waldump: %v\n", err)
+		return ExitError
+	}
+	return ExitOK
+}
+
+func decoderNames() []string {
+	var names []string
+	decoders.Range(func(k, _ interface{}) bool {
+		names = append(names, k.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,103 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log"
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/stretchr/testify/assert"
+)
+
+type jsonEntry struct {
+	Index uint64
+	Value string
+}
+
+func (e *jsonEntry) Marshal() ([]byte, error) { return json.Marshal(e) }
+
+func (e *jsonEntry) Unmarshal(data []byte) error { return json.Unmarshal(data, e) }
+
+func (e *jsonEntry) GetIndex() uint64 { return e.Index }
+
+func (e *jsonEntry) Size() int { return len(e.Value) }
+
+func createWAL(t *testing.T, ents []log.LogEntry, opts *log.Options) string {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.NoError(t, err)
+	w, err := log.Create(p, []byte("metadata"), opts)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Save(&walpb.HardState{Committed: 2}, ents))
+	assert.NoError(t, w.SaveSnapshot(&walpb.Snapshot{Index: 2}))
+	assert.NoError(t, w.TruncateAfter(2))
+	assert.NoError(t, w.Close())
+	return p
+}
+
+func readRecords(t *testing.T, b []byte) []Record {
+	var recs []Record
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		var r Record
+		assert.NoError(t, json.Unmarshal(s.Bytes(), &r))
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+func TestDump(t *testing.T) {
+	p := createWAL(t, []log.LogEntry{&walpb.Entry{Index: 1}, &walpb.Entry{Index: 2}, &walpb.Entry{Index: 3}}, nil)
+	defer os.RemoveAll(p)
+
+	var out bytes.Buffer
+	assert.NoError(t, Dump(&out, Config{Dir: p, JSON: true}))
+	var types []string
+	for _, r := range readRecords(t, out.Bytes()) {
+		types = append(types, r.Type)
+		assert.True(t, r.Size > 0)
+	}
+	assert.Equal(t, []string{"crc", "metadata", "snapshot", "entry", "entry", "entry", "state", "snapshot", "truncate"}, types)
+
+	out.Reset()
+	assert.NoError(t, Dump(&out, Config{Dir: p, JSON: true, Types: []log.RecordType{log.EntryType}, StartIndex: 2, EndIndex: 2}))
+	recs := readRecords(t, out.Bytes())
+	if assert.Len(t, recs, 1) {
+		assert.Equal(t, uint64(2), *recs[0].Index)
+	}
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, ExitOK, Main([]string{"-type", "truncate", p}, &stdout, &stderr))
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasPrefix(lines[0], "segment\t"))
+		assert.Contains(t, lines[1], "\ttruncate\t")
+	}
+	assert.Equal(t, ExitUsage, Main([]string{"-type", "bogus", p}, &stdout, &stderr))
+	assert.Equal(t, ExitError, Main([]string{p + ".missing"}, &stdout, &stderr))
+}
+
+func TestDumpCustomDecoder(t *testing.T) {
+	reg := log.NewRegistry()
+	reg.RegisterEntryFactory(func() log.LogEntry { return &jsonEntry{} })
+	p := createWAL(t, []log.LogEntry{&jsonEntry{1, "a"}, &jsonEntry{2, "b"}}, &log.Options{Registry: reg})
+	defer os.RemoveAll(p)
+
+	RegisterDecoder("json", RegistryDecoder(reg))
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, ExitOK, Main([]string{"-format", "json", "-type", "entry", "-decoder", "json", p}, &stdout, &stderr))
+	recs := readRecords(t, stdout.Bytes())
+	if assert.Len(t, recs, 2) {
+		assert.Equal(t, map[string]interface{}{"Index": float64(2), "Value": "b"}, recs[1].Payload)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DeflateCodecID identifies records compressed by DeflateCodec.
+	DeflateCodecID uint8 = 1
+
+	// maxCodecID is the largest codec id the frame of a record can carry.
+	maxCodecID = 0xf
+	// codecShift is the position of the codec id in the frame length field,
+	// between the padding size and the padding flag.
+	codecShift = 59
+)
+
+var (
+	ErrUnknownCodec = errors.New("wal: unknown record codec")
+	ErrInvalidCodec = errors.New("wal: invalid record codec")
+)
+
+// Codec compresses the payload of WAL records. The id of the codec is
+// stored in the frame of each record it compressed, so that records of any
+// codec, or none, can be read back from the same segment.
+type Codec interface {
+	// ID identifies the codec; it must be in [1, 15].
+	ID() uint8
+	// Compress returns the compressed form of src.
+	Compress(src []byte) ([]byte, error)
+	// Decompress returns the payload src was compressed from. The result
+	// must not be larger than maxBytes.
+	Decompress(src []byte, maxBytes int64) ([]byte, error)
+}
+
+var codecs sync.Map // map[uint8]Codec
+
+// RegisterCodec makes c available to the decoders of all WALs, so that
+// records it compressed can be read back.
+func RegisterCodec(c Codec) {
+	if id := c.ID(); id == 0 || id > maxCodecID {
+		panic("invalid codec id")
+	}
+	codecs.Store(c.ID(), c)
+}
+
+func lookupCodec(id uint8) (Codec, error) {
+	c, ok := codecs.Load(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownCodec, "codec id %d", id)
+	}
+	return c.(Codec), nil
+}
+
+// DeflateCodec compresses records with DEFLATE from the standard library.
+type DeflateCodec struct {
+	// Level is the flate compression level; 0 selects flate.DefaultCompression.
+	Level int
+}
+
+func (DeflateCodec) ID() uint8 { return DeflateCodecID }
+
+func (c DeflateCodec) Compress(src []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fw.Write(src); err != nil {
+		return nil, err
+	}
+	if err = fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (DeflateCodec) Decompress(src []byte, maxBytes int64) ([]byte, error) {
+	fr := flate.NewReader(bytes.NewReader(src))
+	defer fr.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(fr, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, ErrMaxWALEntrySizeLimitExceeded
+	}
+	return data, nil
+}
+
+func init() {
+	RegisterCodec(DeflateCodec{})
+}
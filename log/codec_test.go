@@ -0,0 +1,186 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+func TestEncodeDecodeCompressed(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"Index":1,"Value":"value"}`), 20)
+	buf := &bytes.Buffer{}
+	e := newEncoder(buf, 0, 0)
+	e.codec = DeflateCodec{}
+	recs := []*walpb.Record{
+		{Type: int64(EntryType), Data: data},
+		{Type: int64(EntryType), Data: []byte("x")}, // not shrunk by the codec
+		{Type: int64(CrcType)},
+	}
+	for _, rec := range recs {
+		if err := e.encode(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(data) {
+		t.Errorf("encoded size = %d, want less than %d", buf.Len(), len(data))
+	}
+
+	d := newDecoder(bytes.NewReader(buf.Bytes()))
+	for i, want := range recs {
+		rec := &walpb.Record{}
+		if err := d.decode(rec); err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if rec.Type != want.Type || rec.Crc != want.Crc || !bytes.Equal(rec.Data, want.Data) {
+			t.Errorf("#%d: rec = %+v, want %+v", i, rec, want)
+		}
+	}
+	if err := d.decode(&walpb.Record{}); err != io.EOF {
+		t.Errorf("err = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestDecodeUnknownCodec(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e := newEncoder(buf, 0, 0)
+	e.codec = DeflateCodec{}
+	if err := e.encode(&walpb.Record{Type: int64(EntryType), Data: make([]byte, 100)}); err != nil {
+		t.Fatal(err)
+	}
+	e.flush()
+
+	// rewrite the codec id of the frame
+	b := buf.Bytes()
+	b[7] = b[7]&^(maxCodecID<<(codecShift-56)) | 0x7<<(codecShift-56)
+	err := newDecoder(bytes.NewReader(b)).decode(&walpb.Record{})
+	if errors.Cause(err) != ErrUnknownCodec {
+		t.Errorf("err = %v, want %v", err, ErrUnknownCodec)
+	}
+}
+
+func TestDeflateCodecMaxBytes(t *testing.T) {
+	c := DeflateCodec{}
+	b, err := c.Compress(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Decompress(b, 999); err != ErrMaxWALEntrySizeLimitExceeded {
+		t.Errorf("err = %v, want %v", err, ErrMaxWALEntrySizeLimitExceeded)
+	}
+	if _, err = c.Decompress(b, 1000); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+// TestCompressedWAL ensures segments mixing compressed and uncompressed
+// records are read back, verified and repaired transparently.
+func TestCompressedWAL(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	data := bytes.Repeat([]byte("compressible"), 50)
+	w, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err = w.Save(&walpb.HardState{Committed: uint64(i)}, []LogEntry{&walpb.Entry{Index: uint64(i), Data: data}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.SaveSnapshot(&walpb.Snapshot{Index: 3}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	opts := &Options{Logger: zap.NewExample(), Codec: DeflateCodec{}}
+	if w, err = Open(p, NewEmptySnapshot(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	off, _ := w.encoder.position()
+	for i := 6; i <= 10; i++ {
+		if err = w.Save(&walpb.HardState{Committed: uint64(i)}, []LogEntry{&walpb.Entry{Index: uint64(i), Data: data}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if noff, _ := w.encoder.position(); noff-off >= int64(5*len(data)) {
+		t.Errorf("appended %d bytes, want less than %d", noff-off, 5*len(data))
+	}
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 11, Data: data}}); err != nil {
+		t.Fatal(err)
+	}
+	end, _ := w.encoder.position()
+	w.Close()
+
+	if err = Verify(zap.NewExample(), p, &walpb.Snapshot{Index: 3}, nil); err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := ValidSnapshotEntries(zap.NewExample(), p, nil)
+	if err != nil || len(snaps) != 2 {
+		t.Fatalf("ValidSnapshotEntries = (%v, %v), want two snapshots", snaps, err)
+	}
+
+	// tear the last compressed record
+	f, err := openLast(zap.NewExample(), OSFS, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(end - 4); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if !Repair(zap.NewExample(), p, nil) {
+		t.Fatal("expected repair to succeed")
+	}
+
+	if w, err = Open(p, &walpb.Snapshot{Index: 3}, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, st, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 7 || ents[6].GetIndex() != 10 {
+		t.Fatalf("len(ents) = %d, want entries 4..10", len(ents))
+	}
+	for _, e := range ents {
+		if !bytes.Equal(e.(*walpb.Entry).Data, data) {
+			t.Errorf("entry %d data mismatch", e.GetIndex())
+		}
+	}
+	if st.GetCommitted() != 10 {
+		t.Errorf("committed = %d, want %d", st.GetCommitted(), 10)
+	}
+}
+
+func TestOptionsUnregisteredCodec(t *testing.T) {
+	if _, err := (&Options{Codec: badCodec{}}).withDefaults(); errors.Cause(err) != ErrInvalidOptions {
+		t.Errorf("err = %v, want %v", err, ErrInvalidOptions)
+	}
+}
+
+type badCodec struct{ DeflateCodec }
+
+func (badCodec) ID() uint8 { return 0xf }
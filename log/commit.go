@@ -0,0 +1,326 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// commitRequest asks the syncer to make the appends numbered up to seq
+// durable, or only to write them out as the durability policy allows.
+type commitRequest struct {
+	seq     uint64
+	force   bool // sync whatever the durability policy
+	durable bool // resolve only once seq is synced, whatever the policy
+	f       *SyncFuture
+}
+
+// commitQueue group commits appends so that concurrent callers share a
+// single fdatasync. Appends are encoded in call order under WAL.mu and
+// numbered, and their callers queue a commitRequest. A single syncer
+// goroutine takes every request queued so far, syncs the tail once and
+// resolves each request with the result; requests queued while it syncs
+// form the next batch. Once a sync fails the state of the tail on stable
+// storage is unknown, so the error is kept and fails every pending and
+// later request. Durable requests the policy does not sync yet are parked
+// until a later sync covers them: the next one due by the policy, Sync, a
+// cut or Close.
+type commitQueue struct {
+	mu      sync.Mutex       // serializes syncs, held across the fdatasync
+	synced  uint64           // sequence number of the last durable append
+	written uint64           // sequence number of the last append written to the tail
+	parked  []*commitRequest // durable requests waiting for a sync, guarded by mu
+
+	reqMu   sync.Mutex
+	reqCond *sync.Cond
+	reqs    []*commitRequest
+	err     error         // the first sync error, sticky
+	closing bool          // stops the syncer once reqs are drained
+	donec   chan struct{} // closed when the syncer exits, nil if not started
+}
+
+// SyncFuture resolves once an asynchronous append is on stable storage.
+type SyncFuture struct {
+	donec chan struct{}
+	err   error
+}
+
+func newSyncFuture() *SyncFuture {
+	return &SyncFuture{donec: make(chan struct{})}
+}
+
+func (f *SyncFuture) resolve(err error) {
+	f.err = err
+	close(f.donec)
+}
+
+// Done returns a channel that is closed once the append is durable or
+// its sync failed.
+func (f *SyncFuture) Done() <-chan struct{} {
+	return f.donec
+}
+
+// Wait blocks until the append is durable and returns the sync error, if any.
+func (f *SyncFuture) Wait() error {
+	<-f.donec
+	return f.err
+}
+
+// AppendAsync encodes st and ents and returns without waiting for them to
+// be synced. The returned SyncFuture resolves once they are on stable
+// storage, or with the error of the sync, whatever the durability policy:
+// under a relaxed policy it waits for the next sync. An error is returned directly if
+// encoding fails, in which case nothing is synced on behalf of the caller.
+// Appends issued after AppendAsync returns are ordered after st and ents.
+func (w *WAL) AppendAsync(st HardState, ents []LogEntry) (*SyncFuture, error) {
+	if len(ents) == 0 && (st == nil || st.GetCommitted() == 0) {
+		f := newSyncFuture()
+		f.resolve(nil)
+		return f, nil
+	}
+
+	seq, err := w.appendRecords(st, ents)
+	if err != nil {
+		return nil, err
+	}
+	return w.queueSync(seq, false, true), nil
+}
+
+// commit appends st and ents and blocks until they are on stable storage,
+// or written as the durability policy allows.
+func (w *WAL) commit(st HardState, ents []LogEntry) error {
+	seq, err := w.appendRecords(st, ents)
+	if err != nil {
+		return err
+	}
+	return w.syncTo(seq, false)
+}
+
+// appendRecords encodes ents and st, which may be nil, and returns the
+// sequence number of the append.
+func (w *WAL) appendRecords(st HardState, ents []LogEntry) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	off, _ := w.encoder.position()
+	records := int64(len(ents))
+	// TODO(xiangli): no more reference operator
+	for i := range ents {
+		if err := w.saveEntry(ents[i]); err != nil {
+			return 0, err
+		}
+	}
+	if st != nil {
+		if err := w.saveState(st); err != nil {
+			return 0, err
+		}
+		records++
+	}
+	return w.appended(off, records), nil
+}
+
+// syncTo blocks until the append numbered seq is on stable storage. Unless
+// force is set, it only writes the append out if the durability policy
+// does not ask for a sync yet.
+func (w *WAL) syncTo(seq uint64, force bool) error {
+	return w.queueSync(seq, force, false).Wait()
+}
+
+// queueSync queues a commitRequest for the append numbered seq, starting
+// the syncer if it is not running, and returns the future of the request.
+func (w *WAL) queueSync(seq uint64, force, durable bool) *SyncFuture {
+	q := &w.cq
+	f := newSyncFuture()
+	q.reqMu.Lock()
+	defer q.reqMu.Unlock()
+	if q.err != nil {
+		f.resolve(q.err)
+		return f
+	}
+	if q.closing {
+		f.resolve(os.ErrClosed)
+		return f
+	}
+	if q.donec == nil {
+		q.reqCond = sync.NewCond(&q.reqMu)
+		q.donec = make(chan struct{})
+		go w.runSyncer(q.donec)
+	}
+	q.reqs = append(q.reqs, &commitRequest{seq: seq, force: force, durable: durable, f: f})
+	q.reqCond.Signal()
+	return f
+}
+
+// runSyncer syncs the batches of queued requests until the queue is
+// stopped and drained.
+func (w *WAL) runSyncer(donec chan<- struct{}) {
+	defer close(donec)
+	q := &w.cq
+	for {
+		q.reqMu.Lock()
+		for len(q.reqs) == 0 && !q.closing {
+			q.reqCond.Wait()
+		}
+		batch := q.reqs
+		q.reqs = nil
+		q.reqMu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		w.syncBatch(batch)
+	}
+}
+
+// stopSyncer stops the syncer once the requests queued are synced, and
+// fails the requests queued afterwards with os.ErrClosed.
+func (w *WAL) stopSyncer() {
+	q := &w.cq
+	q.reqMu.Lock()
+	q.closing = true
+	donec := q.donec
+	if donec != nil {
+		q.reqCond.Signal()
+	}
+	q.reqMu.Unlock()
+	if donec != nil {
+		<-donec
+	}
+}
+
+// syncBatch makes the appends of batch durable, or writes them out as the
+// durability policy allows, and resolves each request with the result but
+// the durable ones left unsynced, which are parked.
+func (w *WAL) syncBatch(batch []*commitRequest) {
+	var (
+		seq   uint64
+		force bool
+	)
+	for _, r := range batch {
+		if r.seq > seq {
+			seq = r.seq
+		}
+		force = force || r.force
+	}
+
+	q := &w.cq
+	q.mu.Lock()
+	err := q.failed()
+	if err == nil {
+		if err = w.syncAppends(seq, force); err != nil {
+			q.fail(err)
+		}
+	}
+	q.parked = append(q.parked, batch...)
+	done := q.unpark(err)
+	q.mu.Unlock()
+	for _, r := range done {
+		r.f.resolve(err)
+	}
+}
+
+// unpark removes the parked requests which are done once the last sync
+// returned err, and returns them. q.mu must be held.
+func (q *commitQueue) unpark(err error) []*commitRequest {
+	var done []*commitRequest
+	parked := q.parked[:0]
+	for _, r := range q.parked {
+		if err != nil || q.synced >= r.seq || !r.durable {
+			done = append(done, r)
+		} else {
+			parked = append(parked, r)
+		}
+	}
+	for i := len(parked); i < len(q.parked); i++ {
+		q.parked[i] = nil
+	}
+	q.parked = parked
+	return done
+}
+
+// failed returns the sticky sync error, if any.
+func (q *commitQueue) failed() error {
+	q.reqMu.Lock()
+	defer q.reqMu.Unlock()
+	return q.err
+}
+
+// fail records err as the sticky sync error and fails the requests queued
+// so far with it.
+func (q *commitQueue) fail(err error) {
+	q.reqMu.Lock()
+	defer q.reqMu.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+	for _, r := range q.reqs {
+		r.f.resolve(q.err)
+	}
+	q.reqs = nil
+}
+
+// syncAppends makes the appends up to seq durable, or only writes them out if
+// force is not set and the durability policy does not ask for a sync yet.
+// w.cq.mu must be held.
+func (w *WAL) syncAppends(seq uint64, force bool) error {
+	q := &w.cq
+	if q.synced >= seq || (!force && q.written >= seq) {
+		return nil
+	}
+
+	w.mu.Lock()
+	target := w.appendSeq
+	bytes, records := w.bytesAppended, w.recordsAppended
+	sync := force || w.durability.syncDue(bytes-w.bytesSynced, records-w.recordsSynced)
+	f, durable, err := w.prepareSync(sync)
+	w.mu.Unlock()
+
+	// appends may be encoded while the tail is fdatasynced; they will
+	// be made durable by the next sync.
+	if err == nil && f != nil {
+		err = w.fdatasync(f)
+	}
+	if err != nil {
+		return err
+	}
+	q.written = target
+	if !durable {
+		return nil
+	}
+	w.metrics.commitBatchSize.Observe(float64(target - q.synced))
+	q.synced = target
+
+	w.mu.Lock()
+	w.bytesSynced, w.recordsSynced = bytes, records
+	w.observeUnsynced()
+	w.mu.Unlock()
+	return nil
+}
+
+// prepareSync cuts a new segment if the tail has grown past the segment
+// size, which leaves every append durable, or flushes the encoder and
+// returns the tail file that still needs an fdatasync if sync is set.
+// durable reports whether every append will be durable once it is synced.
+// w.mu must be held.
+func (w *WAL) prepareSync(sync bool) (f File, durable bool, err error) {
+	curOff, err := w.tail().Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false, err
+	}
+	if curOff >= w.opts.SegmentSizeBytes {
+		return nil, true, w.cut()
+	}
+
+	if err = w.encoder.flush(); err != nil {
+		return nil, false, err
+	}
+	if !sync || w.unsafeNoSync {
+		return nil, sync, nil
+	}
+	return w.tail(), true, nil
+}
@@ -0,0 +1,221 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// syncFaultFS fails every fdatasync once fail is set.
+type syncFaultFS struct {
+	FS
+	mu   sync.Mutex
+	fail error
+}
+
+func (fs *syncFaultFS) inject(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.fail = err
+}
+
+func (fs *syncFaultFS) Fdatasync(f File) error {
+	fs.mu.Lock()
+	err := fs.fail
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fs.FS.Fdatasync(f)
+}
+
+// TestGroupCommit ensures that every concurrent append is durable and
+// appears exactly once in the WAL.
+func TestGroupCommit(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample(), SegmentSizeBytes: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, perWriter = 16, 20
+	var wg sync.WaitGroup
+	errc := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				es := []LogEntry{&walpb.Entry{Index: uint64(i*perWriter + j + 1), Data: []byte{byte(i)}}}
+				if err := w.SaveEntry(es); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenForRead(p, NewEmptySnapshot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	seen := make(map[uint64]bool)
+	rec := &walpb.Record{}
+	for err = r.decoder.decode(rec); err == nil; err = r.decoder.decode(rec) {
+		switch rec.Type {
+		case int64(EntryType):
+			e := &walpb.Entry{}
+			if err = e.Unmarshal(rec.Data); err != nil {
+				t.Fatal(err)
+			}
+			if seen[e.Index] {
+				t.Fatalf("entry %d committed twice", e.Index)
+			}
+			seen[e.Index] = true
+		case int64(CrcType):
+			r.decoder.updateCRC(rec.Crc)
+		}
+	}
+	if err != io.EOF {
+		t.Fatalf("err = %v, want %v", err, io.EOF)
+	}
+	if len(seen) != writers*perWriter {
+		t.Errorf("entries = %d, want %d", len(seen), writers*perWriter)
+	}
+}
+
+func TestAppendAsync(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var futures []*SyncFuture
+	for i := 1; i <= 10; i++ {
+		es := []LogEntry{&walpb.Entry{Index: uint64(i), Data: []byte{byte(i)}}}
+		f, err := w.AppendAsync(&walpb.HardState{Committed: uint64(i)}, es)
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, f)
+	}
+	for i, f := range futures {
+		<-f.Done()
+		if err = f.Wait(); err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+		}
+	}
+	if w.cq.synced != w.appendSeq {
+		t.Errorf("synced = %d, want %d", w.cq.synced, w.appendSeq)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = Open(p, NewEmptySnapshot(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, state, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 10 {
+		t.Errorf("len(ents) = %d, want %d", len(ents), 10)
+	}
+	if state.GetCommitted() != 10 {
+		t.Errorf("committed = %d, want %d", state.GetCommitted(), 10)
+	}
+}
+
+func TestAppendAsyncEmpty(t *testing.T) {
+	w := &WAL{}
+	f, err := w.AppendAsync(&walpb.HardState{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-f.Done():
+	default:
+		t.Fatal("expected an empty append to resolve immediately")
+	}
+	if err = f.Wait(); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+// TestSyncErrorSticky ensures that a failed sync fails every pending and
+// later commit, even once the fault is gone.
+func TestSyncErrorSticky(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	fs := &syncFaultFS{FS: OSFS}
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample(), FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	errInjected := errors.New("injected sync fault")
+	fs.inject(errInjected)
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 2}}); err != errInjected {
+		t.Fatalf("err = %v, want %v", err, errInjected)
+	}
+	fs.inject(nil)
+
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 3}}); err != errInjected {
+		t.Errorf("save: err = %v, want %v", err, errInjected)
+	}
+	f, err := w.AppendAsync(nil, []LogEntry{&walpb.Entry{Index: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Wait(); err != errInjected {
+		t.Errorf("append async: err = %v, want %v", err, errInjected)
+	}
+	if err = w.Sync(); err != errInjected {
+		t.Errorf("sync: err = %v, want %v", err, errInjected)
+	}
+	if err = w.Close(); err != errInjected {
+		t.Errorf("close: err = %v, want %v", err, errInjected)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// encryptedFlag marks the frame of a record whose data is encrypted. It is
+// the highest bit of the record size, which never gets that large.
+const encryptedFlag = uint64(1) << 55
+
+var (
+	ErrKeyNotFound = errors.New("wal: encryption key not found")
+	ErrDecrypt     = errors.New("wal: failed to decrypt record")
+)
+
+// KeyProvider supplies the AES keys WAL records are encrypted with. Each
+// encrypted record stores the id of its key, so the current key can be
+// rotated while records of older keys remain readable as long as the
+// provider still returns them.
+type KeyProvider interface {
+	// CurrentKey returns the id and the key new records are encrypted
+	// with. The key must be 16, 24 or 32 bytes long and the id at most
+	// 255 bytes long.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id, or ErrKeyNotFound.
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding its keys in memory.
+type KeyRing struct {
+	// Current is the id of the key new records are encrypted with.
+	Current string
+	// Keys maps key ids to keys.
+	Keys map[string][]byte
+}
+
+func (r *KeyRing) CurrentKey() (string, []byte, error) {
+	key, err := r.Key(r.Current)
+	return r.Current, key, err
+}
+
+func (r *KeyRing) Key(id string) ([]byte, error) {
+	key, ok := r.Keys[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrKeyNotFound, "key id %q", id)
+	}
+	return key, nil
+}
+
+// sealer encrypts and decrypts record data with AES-GCM. The sealed form
+// of the data is the length of the key id, the key id, a random nonce and
+// the ciphertext; the record type is authenticated along with it.
+type sealer struct {
+	keys  KeyProvider
+	aeads map[string]cipher.AEAD // by key id
+}
+
+func newSealer(keys KeyProvider) *sealer {
+	return &sealer{keys: keys, aeads: make(map[string]cipher.AEAD)}
+}
+
+func (s *sealer) aead(id string, key []byte) (cipher.AEAD, error) {
+	if aead, ok := s.aeads[id]; ok {
+		return aead, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s.aeads[id] = aead
+	return aead, nil
+}
+
+func (s *sealer) seal(typ int64, data []byte) ([]byte, error) {
+	id, key, err := s.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 0xff {
+		return nil, errors.Errorf("wal: key id %q is too long", id)
+	}
+	aead, err := s.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 1 + len(id) + aead.NonceSize()
+	out := make([]byte, n, n+len(data)+aead.Overhead())
+	out[0] = byte(len(id))
+	copy(out[1:], id)
+	nonce := out[1+len(id):]
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, data, sealAD(typ)), nil
+}
+
+func (s *sealer) open(typ int64, data []byte) ([]byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, ErrDecrypt
+	}
+	id := string(data[1 : 1+data[0]])
+	data = data[1+len(id):]
+
+	aead, ok := s.aeads[id]
+	if !ok {
+		key, err := s.keys.Key(id)
+		if err != nil {
+			return nil, err
+		}
+		if aead, err = s.aead(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], sealAD(typ))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+func sealAD(typ int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(typ))
+	return b
+}
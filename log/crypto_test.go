@@ -0,0 +1,229 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/pkg/crc"
+	"go.uber.org/zap"
+)
+
+func newTestKeyRing() *KeyRing {
+	return &KeyRing{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 16),
+		},
+	}
+}
+
+func TestEncodeDecodeEncrypted(t *testing.T) {
+	keys := newTestKeyRing()
+	secret := bytes.Repeat([]byte("secret"), 20)
+
+	buf := &bytes.Buffer{}
+	e := newEncoder(buf, 0, 0)
+	e.codec = DeflateCodec{}
+	e.sealer = newSealer(keys)
+	recs := []*walpb.Record{
+		{Type: int64(EntryType), Data: secret},
+		{Type: int64(MetadataType), Data: []byte("metadata")},
+		{Type: int64(CrcType)},
+	}
+	for _, rec := range recs {
+		if err := e.encode(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.flush()
+	if bytes.Contains(buf.Bytes(), []byte("secret")) || bytes.Contains(buf.Bytes(), []byte("metadata")) {
+		t.Fatal("plaintext found in the encoded records")
+	}
+
+	d := newDecoderOpts(&Options{MaxRecordBytes: maxWALEntrySizeLimit, KeyProvider: keys}, bytes.NewReader(buf.Bytes()))
+	for i, want := range recs {
+		rec := &walpb.Record{}
+		if err := d.decode(rec); err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if rec.Type != want.Type || rec.Crc != want.Crc || !bytes.Equal(rec.Data, want.Data) {
+			t.Errorf("#%d: rec = %+v, want %+v", i, rec, want)
+		}
+	}
+	if err := d.decode(&walpb.Record{}); err != io.EOF {
+		t.Errorf("err = %v, want %v", err, io.EOF)
+	}
+
+	// without a key provider
+	err := newDecoder(bytes.NewReader(buf.Bytes())).decode(&walpb.Record{})
+	if errors.Cause(err) != ErrDecrypt {
+		t.Errorf("err = %v, want %v", err, ErrDecrypt)
+	}
+
+	// a flipped ciphertext bit fails the crc check before decrypting
+	b := append([]byte(nil), buf.Bytes()...)
+	b[frameSizeBytes+20] ^= 0x1
+	err = newDecoderOpts(&Options{MaxRecordBytes: maxWALEntrySizeLimit, KeyProvider: keys}, bytes.NewReader(b)).decode(&walpb.Record{})
+	if err != walpb.ErrCRCMismatch {
+		t.Errorf("err = %v, want %v", err, walpb.ErrCRCMismatch)
+	}
+}
+
+// TestEncryptedCRC ensures that the crc of a sealed record covers its
+// ciphertext rather than the plaintext.
+func TestEncryptedCRC(t *testing.T) {
+	secret := bytes.Repeat([]byte("secret"), 20)
+	buf := &bytes.Buffer{}
+	e := newEncoder(buf, 0, 0)
+	e.sealer = newSealer(newTestKeyRing())
+	if err := e.encode(&walpb.Record{Type: int64(EntryType), Data: secret}); err != nil {
+		t.Fatal(err)
+	}
+	e.flush()
+
+	// the record as stored, before decrypting
+	b := buf.Bytes()
+	recBytes, _ := decodeFrameSize(int64(binary.LittleEndian.Uint64(b)))
+	stored := &walpb.Record{}
+	if err := stored.Unmarshal(b[frameSizeBytes : frameSizeBytes+recBytes]); err != nil {
+		t.Fatal(err)
+	}
+	plain := crc.New(0, crcTable)
+	plain.Write(secret)
+	if stored.Crc == plain.Sum32() {
+		t.Fatalf("crc = %#x, the crc of the plaintext", stored.Crc)
+	}
+	sealed := crc.New(0, crcTable)
+	sealed.Write(stored.Data)
+	if stored.Crc != sealed.Sum32() {
+		t.Errorf("crc = %#x, want %#x of the ciphertext", stored.Crc, sealed.Sum32())
+	}
+}
+
+// TestEncryptedWALKeyRotation ensures records of a rotated out key are
+// still read back, verified and repaired.
+func TestEncryptedWALKeyRotation(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	keys := newTestKeyRing()
+	opts := &Options{Logger: zap.NewExample(), KeyProvider: keys}
+	w, err := Create(p, []byte("metadata"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err = w.Save(&walpb.HardState{Committed: uint64(i)}, []LogEntry{&walpb.Entry{Index: uint64(i), Data: []byte("secret")}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	keys.Current = "k2"
+	if w, err = Open(p, NewEmptySnapshot(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 6; i <= 10; i++ {
+		if err = w.Save(&walpb.HardState{Committed: uint64(i)}, []LogEntry{&walpb.Entry{Index: uint64(i), Data: []byte("secret")}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 11, Data: []byte("secret")}}); err != nil {
+		t.Fatal(err)
+	}
+	end, _ := w.encoder.position()
+	w.Close()
+
+	b, err := ioutil.ReadFile(filepath.Join(p, walName(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("secret")) {
+		t.Fatal("plaintext found in the segment")
+	}
+
+	if err = Verify(zap.NewExample(), p, NewEmptySnapshot(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(zap.NewExample(), p, NewEmptySnapshot(), nil); errors.Cause(err) != ErrDecrypt {
+		t.Errorf("err = %v, want %v", err, ErrDecrypt)
+	}
+	if _, err = ValidSnapshotEntries(zap.NewExample(), p, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// tear the last record
+	f, err := openLast(zap.NewExample(), OSFS, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(end - 4); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if !Repair(zap.NewExample(), p, opts) {
+		t.Fatal("expected repair to succeed")
+	}
+
+	if w, err = Open(p, NewEmptySnapshot(), opts); err != nil {
+		t.Fatal(err)
+	}
+	_, st, ents, err := w.ReadAll()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 10 || st.GetCommitted() != 10 {
+		t.Errorf("len(ents), committed = %d, %d, want %d, %d", len(ents), st.GetCommitted(), 10, 10)
+	}
+
+	delete(keys.Keys, "k1")
+	if w, err = OpenForRead(p, NewEmptySnapshot(), opts); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, _, err = w.ReadAll(); errors.Cause(err) != ErrKeyNotFound {
+		t.Errorf("err = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+// TestDecodeEncryptedTornEntry ensures a torn write of an encrypted record
+// is told apart from corruption.
+func TestDecodeEncryptedTornEntry(t *testing.T) {
+	keys := newTestKeyRing()
+	buf := &bytes.Buffer{}
+	e := newEncoder(buf, 0, 0)
+	e.sealer = newSealer(keys)
+	if err := e.encode(&walpb.Record{Type: int64(EntryType), Data: bytes.Repeat([]byte{0xa}, 4*minSectorSize)}); err != nil {
+		t.Fatal(err)
+	}
+	e.flush()
+
+	// a sector of the record never made it to disk
+	b := buf.Bytes()
+	copy(b[2*minSectorSize:3*minSectorSize], make([]byte, minSectorSize))
+	d := newDecoderOpts(&Options{MaxRecordBytes: maxWALEntrySizeLimit, KeyProvider: keys}, bytes.NewReader(b))
+	if err := d.decode(&walpb.Record{}); err != io.ErrUnexpectedEOF {
+		t.Errorf("err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"sync"
 
 	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
 	"go.etcd.io/etcd/pkg/crc"
 )
 
@@ -37,17 +38,39 @@ type decoder struct {
 	// lastValidOff file offset following the last valid decoded record
 	lastValidOff int64
 	crc          hash.Hash32
+
+	// recOff and recCrc are the file offset of the last decoded record
+	// and the crc its data was chained to
+	recOff int64
+	recCrc uint32
+
+	// maxRecordBytes is the size limit of a single record
+	maxRecordBytes int64
+
+	// sealer decrypts encrypted records, if set
+	sealer *sealer
 }
 
 func newDecoder(r ...io.Reader) *decoder {
+	return newDecoderOpts(&Options{MaxRecordBytes: maxWALEntrySizeLimit}, r...)
+}
+
+// newDecoderOpts creates a decoder rejecting records of opts.MaxRecordBytes
+// or more, and decrypting records with the keys of opts.KeyProvider.
+func newDecoderOpts(opts *Options, r ...io.Reader) *decoder {
 	readers := make([]*bufio.Reader, len(r))
 	for i := range r {
 		readers[i] = bufio.NewReader(r[i])
 	}
-	return &decoder{
-		brs: readers,
-		crc: crc.New(0, crcTable),
+	d := &decoder{
+		brs:            readers,
+		crc:            crc.New(0, crcTable),
+		maxRecordBytes: opts.MaxRecordBytes,
+	}
+	if opts.KeyProvider != nil {
+		d.sealer = newSealer(opts.KeyProvider)
 	}
+	return d
 }
 
 func (d *decoder) decode(rec *walpb.Record) error {
@@ -81,8 +104,24 @@ func (d *decoder) decodeRecord(rec *walpb.Record) error {
 		return err
 	}
 
+	if d.lastValidOff == 0 && uint64(l) == segmentMagic {
+		// header of a versioned segment
+		version, err := readInt64(d.brs[0])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err = checkSegmentVersion(uint64(version)); err != nil {
+			return err
+		}
+		d.lastValidOff = segmentHeaderBytes
+		return d.decodeRecord(rec)
+	}
+
 	recBytes, padBytes := decodeFrameSize(l)
-	if recBytes >= maxWALEntrySizeLimit-padBytes {
+	if recBytes >= d.maxRecordBytes-padBytes {
 		return ErrMaxWALEntrySizeLimitExceeded
 	}
 
@@ -102,24 +141,61 @@ func (d *decoder) decodeRecord(rec *walpb.Record) error {
 		return err
 	}
 
-	// skip crc checking if the record type is CrcType
-	if rec.Type != int64(CrcType) {
-		d.crc.Write(rec.Data)
-		if err := rec.Validate(d.crc.Sum32()); err != nil {
+	d.recOff, d.recCrc = d.lastValidOff, d.crc.Sum32()
+
+	// the crc of a sealed record covers its ciphertext, and is checked
+	// before decrypting it
+	encrypted := uint64(l)&encryptedFlag != 0
+	if encrypted {
+		if err := d.validate(rec, data); err != nil {
+			return err
+		}
+		if err := d.decrypt(rec); err != nil {
 			if d.isTornEntry(data) {
 				return io.ErrUnexpectedEOF
 			}
 			return err
 		}
 	}
+	if id := decodeFrameCodec(l); id != 0 {
+		if err := d.decompress(rec, id); err != nil {
+			if d.isTornEntry(data) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	if !encrypted {
+		if err := d.validate(rec, data); err != nil {
+			return err
+		}
+	}
 	// record decoded as valid; point last valid offset to end of record
 	d.lastValidOff += frameSizeBytes + recBytes + padBytes
 	return nil
 }
 
+// validate chains the data of rec to the crc of the records decoded so
+// far and checks it against the crc of rec, but for a crc record. data is
+// the frame rec was decoded from.
+func (d *decoder) validate(rec *walpb.Record, data []byte) error {
+	// skip crc checking if the record type is CrcType
+	if rec.Type == int64(CrcType) {
+		return nil
+	}
+	d.crc.Write(rec.Data)
+	if err := rec.Validate(d.crc.Sum32()); err != nil {
+		if d.isTornEntry(data) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
 func decodeFrameSize(lenField int64) (recBytes int64, padBytes int64) {
-	// the record size is stored in the lower 56 bits of the 64-bit length
-	recBytes = int64(uint64(lenField) & ^(uint64(0xff) << 56))
+	// the record size is stored in the lower 55 bits of the 64-bit length
+	recBytes = int64(uint64(lenField) & (encryptedFlag - 1))
 	// non-zero padding is indicated by set MSb / a negative length
 	if lenField < 0 {
 		// padding is stored in lower 3 bits of length MSB
@@ -128,6 +204,42 @@ func decodeFrameSize(lenField int64) (recBytes int64, padBytes int64) {
 	return recBytes, padBytes
 }
 
+// decodeFrameCodec returns the id of the codec the record data was
+// compressed with, or 0 if it is not compressed.
+func decodeFrameCodec(lenField int64) uint8 {
+	return uint8(uint64(lenField)>>codecShift) & maxCodecID
+}
+
+// decrypt replaces the data of rec with the plaintext it was encrypted from.
+func (d *decoder) decrypt(rec *walpb.Record) error {
+	if d.sealer == nil {
+		return errors.Wrap(ErrDecrypt, "no key provider")
+	}
+	data, err := d.sealer.open(rec.Type, rec.Data)
+	if err != nil {
+		return err
+	}
+	rec.Data = data
+	return nil
+}
+
+// decompress replaces the data of rec with the payload it was compressed from.
+func (d *decoder) decompress(rec *walpb.Record, id uint8) error {
+	c, err := lookupCodec(id)
+	if err != nil {
+		return err
+	}
+	data, err := c.Decompress(rec.Data, d.maxRecordBytes)
+	if err != nil {
+		if err == ErrMaxWALEntrySizeLimitExceeded {
+			return err
+		}
+		return errors.Wrapf(ErrInvalidCodec, "codec id %d: %v", id, err)
+	}
+	rec.Data = data
+	return nil
+}
+
 // isTornEntry determines whether the last entry of the WAL was partially written
 // and corrupted because of a torn write.
 func (d *decoder) isTornEntry(data []byte) bool {
@@ -165,6 +277,19 @@ func (d *decoder) isTornEntry(data []byte) bool {
 	return false
 }
 
+// chainCRC checks that the crc record rec continues the crc chain of the
+// records decoded so far, and restarts the chain from its crc.
+func (d *decoder) chainCRC(rec *walpb.Record) error {
+	crc := d.crc.Sum32()
+	// current crc of decoder must match the crc of the record.
+	// do no need to match 0 crc, since the decoder is a new one at this case.
+	if crc != 0 && rec.Validate(crc) != nil {
+		return ErrCRCMismatch
+	}
+	d.updateCRC(rec.Crc)
+	return nil
+}
+
 func (d *decoder) updateCRC(prevCrc uint32) {
 	d.crc = crc.New(prevCrc, crcTable)
 }
@@ -0,0 +1,148 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// DurabilityMode selects when the appends of a WAL are synced to stable
+// storage.
+type DurabilityMode int
+
+const (
+	// SyncEveryWrite syncs every append before it returns. It is the default.
+	SyncEveryWrite DurabilityMode = iota
+	// SyncEveryBytes syncs once DurabilityPolicy.Bytes are unsynced.
+	SyncEveryBytes
+	// SyncEveryRecords syncs once DurabilityPolicy.Records are unsynced.
+	SyncEveryRecords
+	// SyncInterval syncs every DurabilityPolicy.Interval from a background
+	// goroutine.
+	SyncInterval
+	// SyncNever leaves syncing to the explicit calls of Sync, and to the
+	// cutting and closing of segments.
+	SyncNever
+)
+
+// DurabilityPolicy trades the durability of appends for their latency.
+// Under every mode but SyncEveryWrite, Save and the other appends return
+// once the records are written to the segment; the unsynced ones are lost
+// on power failure. The futures of AppendAsync still resolve only once
+// their records are synced, by the next sync the mode makes, Sync, a cut
+// or Close. Sync makes every append durable regardless of the mode.
+type DurabilityPolicy struct {
+	Mode     DurabilityMode
+	Bytes    int64
+	Records  int64
+	Interval time.Duration
+}
+
+func (p DurabilityPolicy) validate() error {
+	switch p.Mode {
+	case SyncEveryWrite, SyncNever:
+	case SyncEveryBytes:
+		if p.Bytes <= 0 {
+			return errors.Wrapf(ErrInvalidOptions, "sync every %d bytes", p.Bytes)
+		}
+	case SyncEveryRecords:
+		if p.Records <= 0 {
+			return errors.Wrapf(ErrInvalidOptions, "sync every %d records", p.Records)
+		}
+	case SyncInterval:
+		if p.Interval <= 0 {
+			return errors.Wrapf(ErrInvalidOptions, "sync interval %v", p.Interval)
+		}
+	default:
+		return errors.Wrapf(ErrInvalidOptions, "unknown durability mode %d", p.Mode)
+	}
+	return nil
+}
+
+// syncDue reports whether the policy asks for the given unsynced bytes and
+// records to be synced on append.
+func (p DurabilityPolicy) syncDue(bytes, records int64) bool {
+	switch p.Mode {
+	case SyncEveryWrite:
+		return true
+	case SyncEveryBytes:
+		return bytes >= p.Bytes
+	case SyncEveryRecords:
+		return records >= p.Records
+	}
+	return false
+}
+
+// SetDurability replaces the durability policy of the WAL, syncing the
+// appends left unsynced by the previous one on their next append or Sync.
+func (w *WAL) SetDurability(p DurabilityPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	w.durMu.Lock()
+	defer w.durMu.Unlock()
+
+	w.stopSyncLoop()
+	w.mu.Lock()
+	w.durability = p
+	w.mu.Unlock()
+	if p.Mode == SyncInterval {
+		w.stopSync, w.syncDone = make(chan struct{}), make(chan struct{})
+		go w.syncLoop(p.Interval, w.stopSync, w.syncDone)
+	}
+	return nil
+}
+
+// stopSyncLoop stops the background sync of SyncInterval, if running.
+// w.durMu must be held.
+func (w *WAL) stopSyncLoop() {
+	if w.stopSync == nil {
+		return
+	}
+	close(w.stopSync)
+	<-w.syncDone
+	w.stopSync, w.syncDone = nil, nil
+}
+
+func (w *WAL) syncLoop(interval time.Duration, stopc <-chan struct{}, donec chan<- struct{}) {
+	defer close(donec)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := w.Sync(); err != nil {
+				w.lg.Warn("failed to sync WAL", zap.Error(err))
+			}
+		case <-stopc:
+			return
+		}
+	}
+}
+
+// appended accounts for an append of records encoded from the tail offset
+// from, and returns its sequence number. w.mu must be held.
+func (w *WAL) appended(from int64, records int64) uint64 {
+	if to, _ := w.encoder.position(); to > from {
+		w.bytesAppended += to - from
+	}
+	w.recordsAppended += records
+	w.appendSeq++
+	w.metrics.lastIndex.Set(float64(w.enti))
+	w.observeUnsynced()
+	return w.appendSeq
+}
+
+// observeUnsynced updates the metrics of the window of unsynced appends.
+// w.mu must be held.
+func (w *WAL) observeUnsynced() {
+	w.metrics.unsyncedBytes.Set(float64(w.bytesAppended - w.bytesSynced))
+	w.metrics.unsyncedRecords.Set(float64(w.recordsAppended - w.recordsSynced))
+}
@@ -0,0 +1,163 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+)
+
+// unsynced returns the bytes and records of w that are not synced yet.
+func unsynced(w *WAL) (int64, int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.bytesAppended - w.bytesSynced, w.recordsAppended - w.recordsSynced
+}
+
+func TestDurabilityPolicyInvalid(t *testing.T) {
+	tests := []DurabilityPolicy{
+		{Mode: SyncEveryBytes},
+		{Mode: SyncEveryRecords, Records: -1},
+		{Mode: SyncInterval},
+		{Mode: SyncNever + 1},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(p)
+		if _, err = Create(p, nil, &Options{Durability: tt}); errors.Cause(err) != ErrInvalidOptions {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrInvalidOptions)
+		}
+	}
+}
+
+func TestDurabilityEveryRecords(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil, &Options{Durability: DurabilityPolicy{Mode: SyncEveryRecords, Records: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for i := 1; i <= 3; i++ {
+		if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: uint64(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		_, records := unsynced(w)
+		if want := int64(i % 3); records != want {
+			t.Fatalf("after %d entries: unsynced records = %d, want %d", i, records, want)
+		}
+	}
+
+	if err = w.SetDurability(DurabilityPolicy{Mode: SyncEveryBytes, Bytes: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 4, Data: make([]byte, 100)}}); err != nil {
+		t.Fatal(err)
+	}
+	if bytes, _ := unsynced(w); bytes < 100 {
+		t.Fatalf("unsynced bytes = %d, want at least 100", bytes)
+	}
+	if err = w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes, records := unsynced(w); bytes != 0 || records != 0 {
+		t.Fatalf("unsynced after Sync = %d bytes, %d records, want none", bytes, records)
+	}
+}
+
+func TestDurabilityInterval(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil, &Options{Durability: DurabilityPolicy{Mode: SyncInterval, Interval: 10 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, records := unsynced(w); records == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("entry not synced by the background sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDurabilityNever ensures that the appends left unsynced are written
+// out, and read back after the WAL is closed, and that the future of an
+// async append waits for the sync of Close.
+func TestDurabilityNever(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, nil, &Options{Durability: DurabilityPolicy{Mode: SyncNever}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		if err = w.Save(&walpb.HardState{Committed: uint64(i)}, []LogEntry{&walpb.Entry{Index: uint64(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := w.AppendAsync(nil, []LogEntry{&walpb.Entry{Index: 11}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, records := unsynced(w); records != 21 {
+		t.Fatalf("unsynced records = %d, want 21", records)
+	}
+	select {
+	case <-f.Done():
+		t.Fatal("future resolved before its entry is synced")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(p, NewEmptySnapshot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, st, ents, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 11 || st.GetCommitted() != 10 {
+		t.Fatalf("read %d entries, committed %d, want 11 entries, committed 10", len(ents), st.GetCommitted())
+	}
+}
@@ -18,7 +18,6 @@ import (
 	"encoding/binary"
 	"hash"
 	"io"
-	"os"
 	"sync"
 
 	"github.com/BeDreamCoder/wal/log/walpb"
@@ -38,39 +37,93 @@ type encoder struct {
 	crc       hash.Hash32
 	buf       []byte
 	uint64buf []byte
+
+	// off is the file offset following the last encoded record
+	off int64
+
+	// codec compresses record data, if set
+	codec Codec
+	// sealer encrypts record data after compression, if set
+	sealer *sealer
+
+	metrics *metrics
 }
 
 func newEncoder(w io.Writer, prevCrc uint32, pageOffset int) *encoder {
+	return newEncoderSize(w, prevCrc, pageOffset, walPageBytes, DefaultEncoderBufferBytes)
+}
+
+// newEncoderSize creates a new encoder flushing on pageBytes boundaries and
+// marshaling records into a buffer of bufBytes.
+func newEncoderSize(w io.Writer, prevCrc uint32, pageOffset, pageBytes, bufBytes int) *encoder {
 	return &encoder{
-		bw:  ioutil.NewPageWriter(w, walPageBytes, pageOffset),
-		crc: crc.New(prevCrc, crcTable),
-		// 1MB buffer
-		buf:       make([]byte, 1024*1024),
+		bw:        ioutil.NewPageWriter(w, pageBytes, pageOffset),
+		crc:       crc.New(prevCrc, crcTable),
+		buf:       make([]byte, bufBytes),
 		uint64buf: make([]byte, 8),
+		off:       int64(pageOffset),
+		metrics:   discardMetrics,
 	}
 }
 
-// newFileEncoder creates a new encoder with current file offset for the page writer.
-func newFileEncoder(f *os.File, prevCrc uint32) (*encoder, error) {
+// newFileEncoder creates a new encoder with current file offset for the page writer,
+// accounting for the records it encodes in m.
+func newFileEncoder(f File, prevCrc uint32, opts *Options, m *metrics) (*encoder, error) {
 	offset, err := f.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return nil, err
 	}
-	return newEncoder(f, prevCrc, int(offset)), nil
+	e := newEncoderSize(f, prevCrc, int(offset), opts.PageBytes, opts.EncoderBufferBytes)
+	e.codec = opts.Codec
+	e.metrics = m
+	if opts.KeyProvider != nil {
+		e.sealer = newSealer(opts.KeyProvider)
+	}
+	return e, nil
 }
 
 func (e *encoder) encode(rec *walpb.Record) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	e.crc.Write(rec.Data)
-	rec.Crc = e.crc.Sum32()
 	var (
-		data []byte
-		err  error
-		n    int
+		data      []byte
+		err       error
+		n         int
+		codecID   uint8
+		encrypted bool
 	)
 
+	orig := rec
+	if e.codec != nil && len(rec.Data) > 0 {
+		var cdata []byte
+		if cdata, err = e.codec.Compress(rec.Data); err != nil {
+			return err
+		}
+		if len(cdata) < len(rec.Data) {
+			rec = &walpb.Record{Type: rec.Type, Data: cdata}
+			codecID = e.codec.ID()
+		}
+	}
+	if e.sealer != nil && len(rec.Data) > 0 {
+		var sdata []byte
+		if sdata, err = e.sealer.seal(rec.Type, rec.Data); err != nil {
+			return err
+		}
+		rec = &walpb.Record{Type: rec.Type, Data: sdata}
+		encrypted = true
+	}
+
+	// the crc covers the ciphertext of a sealed record, so that it is
+	// checked before decrypting, and the data before compression otherwise
+	if encrypted {
+		e.crc.Write(rec.Data)
+	} else {
+		e.crc.Write(orig.Data)
+	}
+	orig.Crc = e.crc.Sum32()
+	rec.Crc = orig.Crc
+
 	if rec.Size() > len(e.buf) {
 		data, err = rec.Marshal()
 		if err != nil {
@@ -85,7 +138,11 @@ func (e *encoder) encode(rec *walpb.Record) error {
 	}
 
 	lenField, padBytes := encodeFrameSize(len(data))
-	if err = writeUint64(e.bw, lenField, e.uint64buf); err != nil {
+	lenField |= uint64(codecID) << codecShift
+	if encrypted {
+		lenField |= encryptedFlag
+	}
+	if err = e.writeUint64(lenField); err != nil {
 		return err
 	}
 
@@ -93,7 +150,11 @@ func (e *encoder) encode(rec *walpb.Record) error {
 		data = append(data, make([]byte, padBytes)...)
 	}
 	n, err = e.bw.Write(data)
-	walWriteBytes.Add(float64(n))
+	e.metrics.writeBytes.Add(float64(n))
+	if err == nil {
+		e.off += frameSizeBytes + int64(len(data))
+		e.metrics.appended(rec.Type, frameSizeBytes+len(data))
+	}
 	return err
 }
 
@@ -107,18 +168,26 @@ func encodeFrameSize(dataBytes int) (lenField uint64, padBytes int) {
 	return lenField, padBytes
 }
 
+// position returns the file offset the next record will be encoded at,
+// and the crc the record data will be chained to.
+func (e *encoder) position() (off int64, crc uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.off, e.crc.Sum32()
+}
+
 func (e *encoder) flush() error {
 	e.mu.Lock()
 	n, err := e.bw.FlushN()
 	e.mu.Unlock()
-	walWriteBytes.Add(float64(n))
+	e.metrics.writeBytes.Add(float64(n))
 	return err
 }
 
-func writeUint64(w io.Writer, n uint64, buf []byte) error {
+func (e *encoder) writeUint64(n uint64) error {
 	// http://golang.org/src/encoding/binary/binary.go
-	binary.LittleEndian.PutUint64(buf, n)
-	nv, err := w.Write(buf)
-	walWriteBytes.Add(float64(nv))
+	binary.LittleEndian.PutUint64(e.uint64buf, n)
+	nv, err := e.bw.Write(e.uint64buf)
+	e.metrics.writeBytes.Add(float64(nv))
 	return err
 }
@@ -0,0 +1,705 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package faultfs is an in-memory log.FS injecting the faults of a disk:
+// lost and torn writes on power failure, and failing syncs, preallocations,
+// renames and the other calls, for testing the WAL and the snapshotter
+// through crashes.
+//
+// As on a disk, the data of a file survives a crash once the file is
+// synced, and an entry created, renamed or removed in a directory once the
+// directory is synced, with OpenDir and Fsync; a crash rolls back the rest.
+// Preallocated space is on stable storage as soon as the call returns.
+package faultfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BeDreamCoder/wal/log"
+	"go.etcd.io/etcd/pkg/fileutil"
+)
+
+// SectorSize is the unit writes tear at on a crash.
+const SectorSize = 512
+
+// ErrInjected is the default error of a Fault.
+var ErrInjected = errors.New("faultfs: injected fault")
+
+// ErrNoSpace is the error of a full disk, for faults on OpPreallocate and
+// OpWrite.
+var ErrNoSpace error = syscall.ENOSPC
+
+// Op is a kind of call of the FS a Fault is injected in.
+type Op string
+
+const (
+	OpOpen        Op = "open" // OpenFile, LockFile, TryLockFile and OpenDir
+	OpWrite       Op = "write"
+	OpTruncate    Op = "truncate"
+	OpSync        Op = "sync" // Fsync, Fdatasync and File.Sync
+	OpPreallocate Op = "preallocate"
+	OpRename      Op = "rename"
+	OpRemove      Op = "remove" // Remove and RemoveAll
+	OpMkdir       Op = "mkdir"
+)
+
+// Fault makes the calls of an Op on some paths fail.
+type Fault struct {
+	Op Op
+	// Match selects the paths of the calls by the filepath.Match pattern
+	// of their base name, either one for a rename. Empty matches all.
+	Match string
+	// After is the number of matching calls let through first.
+	After int
+	// Times is the number of matching calls failing after those, 0 for
+	// every one.
+	Times int
+	// Err is the error of the failing calls. Defaults to ErrInjected.
+	Err error
+	// DropDirty makes a failing OpSync of a file discard the data written
+	// to it since it was last synced, as Linux does when writeback fails:
+	// the file reads back as last synced, and the next sync has nothing to
+	// flush and succeeds.
+	DropDirty bool
+
+	seen int
+}
+
+func (f *Fault) match(op Op, paths []string) bool {
+	if f.Op != op {
+		return false
+	}
+	if f.Match == "" {
+		return true
+	}
+	for _, p := range paths {
+		if ok, _ := filepath.Match(f.Match, filepath.Base(p)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type inode struct {
+	dir     bool
+	data    []byte
+	synced  []byte            // data on stable storage
+	entries map[string]*inode // entries of a directory on stable storage
+	dirty   int64             // lowest offset changed since the last sync, or -1
+	locked  bool
+	modTime time.Time
+}
+
+func newInode(dir bool) *inode {
+	n := &inode{dir: dir, dirty: -1, modTime: time.Now()}
+	if dir {
+		n.entries = make(map[string]*inode)
+	}
+	return n
+}
+
+func (n *inode) changed(off int64) {
+	if n.dirty < 0 || off < n.dirty {
+		n.dirty = off
+	}
+	n.modTime = time.Now()
+}
+
+func (n *inode) sync() {
+	n.synced = append(n.synced[:0], n.data...)
+	n.dirty = -1
+}
+
+// drop discards the data written since the last sync.
+func (n *inode) drop() {
+	n.data = append(n.data[:0], n.synced...)
+	n.dirty = -1
+}
+
+// FS is an in-memory log.FS with injectable faults. The zero value is not
+// usable; create one with New.
+type FS struct {
+	mu     sync.Mutex
+	unlock *sync.Cond // signaled when a lock is released
+	nodes  map[string]*inode
+	faults []*Fault
+	calls  map[Op]int
+	gen    int // incremented by a crash, which closes every file
+}
+
+var _ log.FS = &FS{}
+
+// New returns an empty FS holding only the root directory.
+func New() *FS {
+	fs := &FS{
+		nodes: map[string]*inode{string(filepath.Separator): newInode(true)},
+		calls: make(map[Op]int),
+	}
+	fs.unlock = sync.NewCond(&fs.mu)
+	return fs
+}
+
+// Inject adds f to the faults of fs.
+func (fs *FS) Inject(f Fault) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults = append(fs.faults, &f)
+}
+
+// Reset removes every fault of fs.
+func (fs *FS) Reset() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults = nil
+}
+
+// Calls returns the number of calls of op made so far, failed or not, for
+// choosing the After of a Fault.
+func (fs *FS) Calls(op Op) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls[op]
+}
+
+// fault counts a call of op on paths and returns the error of the first
+// fault it fires. fs.mu must be held.
+func (fs *FS) fault(op Op, paths ...string) error {
+	if f := fs.fire(op, paths...); f != nil {
+		return f.err()
+	}
+	return nil
+}
+
+// fire counts a call of op on paths and returns the first fault it fires,
+// or nil. fs.mu must be held.
+func (fs *FS) fire(op Op, paths ...string) *Fault {
+	fs.calls[op]++
+	var fired *Fault
+	for _, f := range fs.faults {
+		if !f.match(op, paths) {
+			continue
+		}
+		f.seen++
+		if fired == nil && f.seen > f.After && (f.Times == 0 || f.seen-f.After <= f.Times) {
+			fired = f
+		}
+	}
+	return fired
+}
+
+func (f *Fault) err() error {
+	if f.Err == nil {
+		return ErrInjected
+	}
+	return f.Err
+}
+
+// Crash simulates a power failure: the data and the directory entries not
+// synced are lost, every lock is released and the open files fail with
+// os.ErrClosed.
+func (fs *FS) Crash() {
+	fs.CrashTorn(0)
+}
+
+// CrashTorn is Crash keeping the first sectors of the data written to
+// each file since it was last synced, from its lowest change on, as a write
+// torn at a sector boundary.
+func (fs *FS) CrashTorn(sectors int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	root := string(filepath.Separator)
+	nodes := map[string]*inode{root: fs.nodes[root]}
+	restore(nodes, root, fs.nodes[root])
+	fs.nodes = nodes
+	for _, n := range fs.nodes {
+		n.locked = false
+		if n.dir {
+			continue
+		}
+		data := append([]byte(nil), n.synced...)
+		if n.dirty >= 0 && sectors > 0 {
+			start := n.dirty / SectorSize * SectorSize
+			end := start + int64(sectors)*SectorSize
+			if end > int64(len(n.data)) {
+				end = int64(len(n.data))
+			}
+			if start < end {
+				if end > int64(len(data)) {
+					data = append(data, make([]byte, end-int64(len(data)))...)
+				}
+				copy(data[start:end], n.data[start:end])
+			}
+		}
+		n.data = data
+		n.sync()
+	}
+	fs.gen++
+	fs.unlock.Broadcast()
+}
+
+// restore adds to nodes the entries of the directory dir at path on stable
+// storage, and theirs.
+func restore(nodes map[string]*inode, path string, dir *inode) {
+	for name, n := range dir.entries {
+		p := filepath.Join(path, name)
+		if _, ok := nodes[p]; ok {
+			continue
+		}
+		nodes[p] = n
+		if n.dir {
+			restore(nodes, p, n)
+		}
+	}
+}
+
+func clean(name string) string {
+	return filepath.Clean(name)
+}
+
+// lookup returns the inode at name. fs.mu must be held.
+func (fs *FS) lookup(op, name string) (*inode, error) {
+	n, ok := fs.nodes[clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return n, nil
+}
+
+// parent checks that the parent directory of name exists. fs.mu must be
+// held.
+func (fs *FS) parent(op, name string) error {
+	n, ok := fs.nodes[filepath.Dir(clean(name))]
+	if !ok || !n.dir {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (fs *FS) OpenFile(name string, flag int, perm os.FileMode) (log.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.open(name, flag, false, false)
+}
+
+func (fs *FS) LockFile(name string, flag int, perm os.FileMode) (log.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.open(name, flag, true, true)
+}
+
+func (fs *FS) TryLockFile(name string, flag int, perm os.FileMode) (log.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.open(name, flag, true, false)
+}
+
+func (fs *FS) OpenDir(path string) (log.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.open(path, os.O_RDONLY, false, false)
+}
+
+// open opens name, locking it if lock is set, waiting for the lock if wait
+// is. fs.mu must be held.
+func (fs *FS) open(name string, flag int, lock, wait bool) (*file, error) {
+	if err := fs.fault(OpOpen, name); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	n, ok := fs.nodes[clean(name)]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if err := fs.parent("open", name); err != nil {
+			return nil, err
+		}
+		n = newInode(false)
+		fs.nodes[clean(name)] = n
+	}
+
+	if lock {
+		for n.locked {
+			if !wait {
+				return nil, fileutil.ErrLocked
+			}
+			fs.unlock.Wait()
+		}
+		n.locked = true
+	}
+	if flag&os.O_TRUNC != 0 && !n.dir {
+		n.data = n.data[:0]
+		n.changed(0)
+	}
+	return &file{fs: fs, node: n, name: name, flag: flag, locked: lock, gen: fs.gen}, nil
+}
+
+func (fs *FS) Preallocate(f log.File, size int64, extend bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	mf, err := fs.file(f)
+	if err != nil {
+		return err
+	}
+	if err = fs.fault(OpPreallocate, mf.name); err != nil {
+		return err
+	}
+	if extend && int64(len(mf.node.data)) < size {
+		mf.node.data = append(mf.node.data, make([]byte, size-int64(len(mf.node.data)))...)
+		if int64(len(mf.node.synced)) < size {
+			mf.node.synced = append(mf.node.synced, make([]byte, size-int64(len(mf.node.synced)))...)
+		}
+	}
+	return nil
+}
+
+func (fs *FS) Fsync(f log.File) error {
+	return f.Sync()
+}
+
+func (fs *FS) Fdatasync(f log.File) error {
+	return f.Sync()
+}
+
+func (fs *FS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fault(OpRename, oldpath, newpath); err != nil {
+		return err
+	}
+	oldpath, newpath = clean(oldpath), clean(newpath)
+	n, ok := fs.nodes[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if err := fs.parent("rename", newpath); err != nil {
+		return err
+	}
+	if !n.dir {
+		fs.nodes[newpath] = n
+		delete(fs.nodes, oldpath)
+		return nil
+	}
+	if fs.children(newpath) != 0 {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTEMPTY}
+	}
+	prefix := oldpath + string(filepath.Separator)
+	for p, c := range fs.nodes {
+		if strings.HasPrefix(p, prefix) {
+			fs.nodes[newpath+p[len(oldpath):]] = c
+			delete(fs.nodes, p)
+		}
+	}
+	fs.nodes[newpath] = n
+	delete(fs.nodes, oldpath)
+	return nil
+}
+
+// children returns the number of entries in the directory dir. fs.mu must
+// be held.
+func (fs *FS) children(dir string) int {
+	prefix := dir + string(filepath.Separator)
+	var c int
+	for p := range fs.nodes {
+		if strings.HasPrefix(p, prefix) {
+			c++
+		}
+	}
+	return c
+}
+
+func (fs *FS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fault(OpRemove, name); err != nil {
+		return err
+	}
+	n, err := fs.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if n.dir && fs.children(clean(name)) != 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fs.nodes, clean(name))
+	return nil
+}
+
+func (fs *FS) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fault(OpRemove, path); err != nil {
+		return err
+	}
+	path = clean(path)
+	prefix := path + string(filepath.Separator)
+	for p := range fs.nodes {
+		if strings.HasPrefix(p, prefix) {
+			delete(fs.nodes, p)
+		}
+	}
+	delete(fs.nodes, path)
+	return nil
+}
+
+func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fault(OpMkdir, path); err != nil {
+		return err
+	}
+	path = clean(path)
+	for p := path; ; p = filepath.Dir(p) {
+		if n, ok := fs.nodes[p]; ok {
+			if !n.dir {
+				return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		fs.nodes[p] = newInode(true)
+	}
+	return nil
+}
+
+func (fs *FS) ReadDir(path string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fs.lookup("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, &os.PathError{Op: "readdirent", Path: path, Err: syscall.ENOTDIR}
+	}
+	path = clean(path)
+	var names []string
+	for p := range fs.nodes {
+		if p != path && filepath.Dir(p) == path {
+			names = append(names, filepath.Base(p))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{name: filepath.Base(name), size: int64(len(n.data)), dir: n.dir, modTime: n.modTime}, nil
+}
+
+// file returns f as a file of fs that is still open. fs.mu must be held.
+func (fs *FS) file(f log.File) (*file, error) {
+	mf, ok := f.(*file)
+	if !ok || mf.fs != fs {
+		return nil, &os.PathError{Op: "sync", Path: f.Name(), Err: syscall.EINVAL}
+	}
+	if mf.closed || mf.gen != fs.gen {
+		return nil, os.ErrClosed
+	}
+	return mf, nil
+}
+
+// file is a log.File of an FS.
+type file struct {
+	fs     *FS
+	node   *inode
+	name   string
+	flag   int
+	off    int64
+	locked bool
+	closed bool
+	gen    int
+}
+
+func (f *file) Name() string { return f.name }
+
+// check returns the error of an operation on f. f.fs.mu must be held.
+func (f *file) check(op string, write bool) error {
+	if f.closed || f.gen != f.fs.gen {
+		return os.ErrClosed
+	}
+	if f.node.dir {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 || !write && f.flag&os.O_WRONLY != 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *file) readAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if err := f.fs.fault(OpWrite, f.name); err != nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: err}
+	}
+	n := f.node
+	if end := f.off + int64(len(p)); end > int64(len(n.data)) {
+		n.data = append(n.data, make([]byte, end-int64(len(n.data)))...)
+	}
+	copy(n.data[f.off:], p)
+	n.changed(f.off)
+	f.off += int64(len(p))
+	return len(p), nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed || f.gen != f.fs.gen {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed || f.gen != f.fs.gen {
+		return nil, os.ErrClosed
+	}
+	return fileInfo{name: filepath.Base(f.name), size: int64(len(f.node.data)), dir: f.node.dir, modTime: f.node.modTime}, nil
+}
+
+func (f *file) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if err := f.fs.fault(OpTruncate, f.name); err != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+	}
+	n := f.node
+	if size < int64(len(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+	}
+	n.changed(size)
+	return nil
+}
+
+func (f *file) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed || f.gen != f.fs.gen {
+		return os.ErrClosed
+	}
+	if ft := f.fs.fire(OpSync, f.name); ft != nil {
+		if ft.DropDirty && !f.node.dir {
+			f.node.drop()
+		}
+		return &os.PathError{Op: "sync", Path: f.name, Err: ft.err()}
+	}
+	if !f.node.dir {
+		f.node.sync()
+		return nil
+	}
+	// the entries of the directory now in the tree of f.name
+	dir := clean(f.name)
+	entries := make(map[string]*inode)
+	for p, n := range f.fs.nodes {
+		if p != dir && filepath.Dir(p) == dir {
+			entries[filepath.Base(p)] = n
+		}
+	}
+	f.node.entries = entries
+	return nil
+}
+
+func (f *file) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if f.gen != f.fs.gen {
+		// released by the crash
+		return nil
+	}
+	if f.locked {
+		f.node.locked = false
+		f.fs.unlock.Broadcast()
+	}
+	return nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string { return fi.name }
+func (fi fileInfo) Size() int64  { return fi.size }
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() interface{}   { return nil }
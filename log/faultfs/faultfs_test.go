@@ -0,0 +1,208 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package faultfs
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/pkg/fileutil"
+)
+
+func writeFile(t *testing.T, fs *FS, name string, data []byte) log.File {
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// syncDir syncs the entries of the directory dir of fs.
+func syncDir(t *testing.T, fs *FS, dir string) {
+	d, err := fs.OpenDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err = fs.Fsync(d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrash(t *testing.T) {
+	fs := New()
+	if err := fs.MkdirAll("/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	syncDir(t, fs, "/")
+	f := writeFile(t, fs, "/d/f", []byte("synced"))
+	if err := fs.Fdatasync(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" lost")); err != nil {
+		t.Fatal(err)
+	}
+	l, err := fs.TryLockFile("/d/l", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.TryLockFile("/d/l", os.O_RDWR, 0600); err != fileutil.ErrLocked {
+		t.Fatalf("err = %v, want %v", err, fileutil.ErrLocked)
+	}
+	syncDir(t, fs, "/d")
+
+	fs.Crash()
+	if _, err = f.Write([]byte("x")); errors.Cause(err) != os.ErrClosed {
+		t.Fatalf("write after crash: err = %v, want %v", err, os.ErrClosed)
+	}
+	l.Close()
+	if b, _ := log.ReadFile(fs, "/d/f"); string(b) != "synced" {
+		t.Errorf("data = %q, want %q", b, "synced")
+	}
+	if l, err = fs.TryLockFile("/d/l", os.O_RDWR, 0600); err != nil {
+		t.Fatalf("lock after crash: %v", err)
+	}
+	l.Close()
+	if names, _ := fs.ReadDir("/d"); !reflect.DeepEqual(names, []string{"f", "l"}) {
+		t.Errorf("names = %v, want [f l]", names)
+	}
+}
+
+func TestCrashTorn(t *testing.T) {
+	fs := New()
+	f := writeFile(t, fs, "/f", bytes.Repeat([]byte{1}, SectorSize))
+	if err := fs.Fsync(f); err != nil {
+		t.Fatal(err)
+	}
+	syncDir(t, fs, "/")
+	if _, err := f.Write(bytes.Repeat([]byte{2}, 3*SectorSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.CrashTorn(2)
+	b, err := log.ReadFile(fs, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Repeat([]byte{1}, SectorSize), bytes.Repeat([]byte{2}, 2*SectorSize)...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("kept %d bytes, want the synced sector and 2 torn ones", len(b))
+	}
+}
+
+func TestCrashEntries(t *testing.T) {
+	fs := New()
+	if err := fs.MkdirAll("/d/e", 0700); err != nil {
+		t.Fatal(err)
+	}
+	syncDir(t, fs, "/")
+	syncDir(t, fs, "/d")
+	for _, name := range []string{"/d/a", "/d/b"} {
+		f := writeFile(t, fs, name, []byte(name))
+		if err := fs.Fsync(f); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	syncDir(t, fs, "/d")
+
+	// unsynced entries
+	writeFile(t, fs, "/d/c", nil).Close()
+	if err := fs.Rename("/d/a", "/d/e/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/d/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MkdirAll("/g", 0700); err != nil {
+		t.Fatal(err)
+	}
+	syncDir(t, fs, "/d/e")
+
+	fs.Crash()
+	// the rename is half synced, as on a disk: a is in both directories
+	for dir, want := range map[string][]string{"/": {"d"}, "/d": {"a", "b", "e"}, "/d/e": {"a"}} {
+		if names, _ := fs.ReadDir(dir); !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: names = %v, want %v", dir, names, want)
+		}
+	}
+	if b, _ := log.ReadFile(fs, "/d/b"); string(b) != "/d/b" {
+		t.Errorf("data = %q, want %q", b, "/d/b")
+	}
+}
+
+func TestSyncDropDirty(t *testing.T) {
+	fs := New()
+	f := writeFile(t, fs, "/f", []byte("synced"))
+	if err := fs.Fsync(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" dropped")); err != nil {
+		t.Fatal(err)
+	}
+	fs.Inject(Fault{Op: OpSync, Times: 1, DropDirty: true})
+	if err := fs.Fsync(f); cause(err) != ErrInjected {
+		t.Fatalf("err = %v, want %v", err, ErrInjected)
+	}
+	if b, _ := log.ReadFile(fs, "/f"); string(b) != "synced" {
+		t.Errorf("data = %q, want %q", b, "synced")
+	}
+	// nothing is left to flush
+	if err := fs.Fsync(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInject(t *testing.T) {
+	fs := New()
+	fs.Inject(Fault{Op: OpRename, Match: "*.wal", After: 1, Times: 1})
+	fs.Inject(Fault{Op: OpPreallocate, Err: ErrNoSpace})
+
+	for _, name := range []string{"/a", "/b", "/c"} {
+		writeFile(t, fs, name, nil).Close()
+	}
+	tests := []struct {
+		from, to string
+		err      error
+	}{
+		{"/a", "/a.wal", nil},
+		{"/b", "/b.wal", ErrInjected},
+		{"/c", "/c.wal", nil},
+		{"/missing", "/d", os.ErrNotExist},
+	}
+	for i, tt := range tests {
+		err := fs.Rename(tt.from, tt.to)
+		if le, ok := err.(*os.LinkError); ok {
+			err = le.Err
+		}
+		if err != tt.err {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.err)
+		}
+	}
+	if n := fs.Calls(OpRename); n != 4 {
+		t.Errorf("renames = %d, want 4", n)
+	}
+
+	f := writeFile(t, fs, "/e", nil)
+	if err := fs.Preallocate(f, 1024, true); err != ErrNoSpace {
+		t.Errorf("err = %v, want %v", err, ErrNoSpace)
+	}
+	fs.Reset()
+	if err := fs.Preallocate(f, 1024, true); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := f.Stat(); fi.Size() != 1024 {
+		t.Errorf("size = %d, want 1024", fi.Size())
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package faultfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/BeDreamCoder/wal/log"
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/BeDreamCoder/wal/snap"
+	pkgerrors "github.com/pkg/errors"
+	"go.etcd.io/etcd/pkg/fileutil"
+	"go.uber.org/zap"
+)
+
+// maxCutEntries bounds the entries SaveUntilCut saves waiting for a cut.
+const maxCutEntries = 1 << 16
+
+// NewEntry returns the walpb.Entry of index saved by SaveUntilCut. Its 64
+// bytes of data are not zero, so that a torn write of it is detected.
+func NewEntry(index uint64) *walpb.Entry {
+	return &walpb.Entry{Index: index, Data: bytes.Repeat([]byte{0xff}, 64)}
+}
+
+// Segments returns the number of WAL segments in dir.
+func (fs *FS) Segments(dir string) (int, error) {
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, name := range names {
+		if strings.HasSuffix(name, ".wal") {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// SaveUntilCut saves the entries of NewEntry to the WAL w in dir on fs,
+// from index next on, until w cuts a new segment or a save fails, and returns
+// the index of the entry to save next with the error. The entries are
+// walpb.Entry; w must decode them with its Registry.
+func SaveUntilCut(fs *FS, w *log.WAL, dir string, next uint64) (uint64, error) {
+	segments, err := fs.Segments(dir)
+	if err != nil {
+		return next, err
+	}
+	for i := 0; i < maxCutEntries; i++ {
+		if err = w.SaveEntry([]log.LogEntry{NewEntry(next)}); err != nil {
+			return next, err
+		}
+		next++
+		n, err := fs.Segments(dir)
+		if err != nil {
+			return next, err
+		}
+		if n > segments {
+			return next, nil
+		}
+	}
+	return next, errors.New("faultfs: no segment cut")
+}
+
+// Restart opens the WAL in dir on fs at an empty snapshot and reads it out,
+// as a node restarting after a crash does. A torn write at the end of the
+// WAL is repaired with log.RepairTail first. The WAL is ready for appending
+// unless an error is returned.
+func Restart(fs *FS, dir string, opts *log.Options) (*log.WAL, []log.LogEntry, error) {
+	o := log.Options{}
+	if opts != nil {
+		o = *opts
+	}
+	o.FS = fs
+
+	for repaired := false; ; repaired = true {
+		w, err := log.Open(dir, log.NewEmptySnapshot(), &o)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, _, ents, err := w.ReadAll()
+		if err == nil {
+			return w, ents, nil
+		}
+		w.Close()
+		if repaired || pkgerrors.Cause(err) != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		if _, err = log.RepairTail(o.Logger, dir, &o); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// MkdirAllSync creates the directory dir with its parents on fs, and
+// syncs the directories holding them, so that they survive a crash as the
+// data directory of a node does.
+func (fs *FS) MkdirAllSync(dir string) error {
+	if err := fs.MkdirAll(dir, fileutil.PrivateDirMode); err != nil {
+		return err
+	}
+	for p := filepath.Clean(dir); p != filepath.Dir(p); p = filepath.Dir(p) {
+		d, err := fs.OpenDir(filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		err = fs.Fsync(d)
+		d.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSnapshotter creates the directory dir on fs, and returns the
+// snap.Snapshotter of dir on fs.
+func NewSnapshotter(fs *FS, lg *zap.Logger, dir string) (*snap.Snapshotter, error) {
+	if err := fs.MkdirAllSync(dir); err != nil {
+		return nil, err
+	}
+	return snap.NewWithOptions(lg, dir, &snap.Options{FS: fs})
+}
@@ -0,0 +1,378 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package faultfs
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log"
+	"github.com/BeDreamCoder/wal/snap"
+	"github.com/BeDreamCoder/wal/snap/snappb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	walDir      = "/data/wal"
+	segmentSize = 8 * 1024
+)
+
+func walOptions(fs *FS) *log.Options {
+	return &log.Options{FS: fs, SegmentSizeBytes: segmentSize}
+}
+
+// checkRecovered ensures the WAL recovered after a crash holds at least the
+// entries up to acked, in order.
+func checkRecovered(t *testing.T, ents []log.LogEntry, acked uint64) {
+	t.Helper()
+	if uint64(len(ents)) < acked {
+		t.Fatalf("recovered %d entries, want at least the %d acknowledged", len(ents), acked)
+	}
+	for i, e := range ents {
+		if e.GetIndex() != uint64(i+1) {
+			t.Fatalf("entry %d has index %d", i+1, e.GetIndex())
+		}
+	}
+}
+
+func TestCreateFaults(t *testing.T) {
+	tests := []Fault{
+		{Op: OpPreallocate, Err: ErrNoSpace},
+		{Op: OpSync},
+		{Op: OpRename, Match: "wal.tmp"},
+		{Op: OpMkdir},
+	}
+	for i, f := range tests {
+		fs := New()
+		fs.Inject(f)
+		if _, err := log.Create(walDir, nil, walOptions(fs)); err == nil {
+			t.Errorf("#%d: %s fault: Create succeeded", i, f.Op)
+		}
+		if n, _ := fs.Segments(walDir); n != 0 {
+			t.Errorf("#%d: %s fault: %d segments left in the WAL directory", i, f.Op, n)
+		}
+		if log.ExistWithOptions(walDir, walOptions(fs)) {
+			t.Errorf("#%d: %s fault: WAL directory left", i, f.Op)
+		}
+	}
+}
+
+func TestCutFaults(t *testing.T) {
+	tests := []struct {
+		Fault
+		beforeCreate bool
+	}{
+		// the segment preallocated by the pipeline after that of Create
+		{Fault{Op: OpPreallocate, After: 1, Err: ErrNoSpace}, true},
+		{Fault{Op: OpRename, Match: "*.tmp"}, false},
+		{Fault{Op: OpSync, Match: "*.tmp"}, false},
+		{Fault{Op: OpSync, Match: "wal"}, false},
+	}
+	for i, f := range tests {
+		fs := New()
+		if f.beforeCreate {
+			fs.Inject(f.Fault)
+		}
+		w, err := log.Create(walDir, nil, walOptions(fs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.beforeCreate {
+			fs.Inject(f.Fault)
+		}
+		next, err := SaveUntilCut(fs, w, walDir, 1)
+		if err == nil {
+			t.Fatalf("#%d: %s fault: cut succeeded", i, f.Op)
+		}
+
+		fs.Crash()
+		fs.Reset()
+		// the crashed WAL is closed, stopping its file pipeline
+		w.Close()
+		w, ents, err := Restart(fs, walDir, walOptions(fs))
+		if err != nil {
+			t.Fatalf("#%d: %s fault: restart: %v", i, f.Op, err)
+		}
+		checkRecovered(t, ents, next-1)
+		// the WAL cuts once the fault is gone
+		if _, err = SaveUntilCut(fs, w, walDir, uint64(len(ents))+1); err != nil {
+			t.Fatalf("#%d: %s fault: cut after restart: %v", i, f.Op, err)
+		}
+		w.Close()
+	}
+}
+
+// TestTornWriteRecovery crashes the WAL in the middle of an unsynced append
+// with the tail torn at each sector, and ensures that every acknowledged
+// entry is recovered.
+func TestTornWriteRecovery(t *testing.T) {
+	for sectors := 0; sectors < 4; sectors++ {
+		fs := New()
+		w, err := log.Create(walDir, nil, walOptions(fs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := SaveUntilCut(fs, w, walDir, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acked := next - 1
+		// the append is written but its sync fails
+		fs.Inject(Fault{Op: OpSync, Match: "*.wal"})
+		ents := make([]log.LogEntry, 20)
+		for i := range ents {
+			ents[i] = NewEntry(next + uint64(i))
+		}
+		if err = w.SaveEntry(ents); err == nil {
+			t.Fatal("save succeeded with a failing sync")
+		}
+
+		fs.CrashTorn(sectors)
+		fs.Reset()
+		// the crashed WAL is closed, stopping its file pipeline
+		w.Close()
+		w, recovered, err := Restart(fs, walDir, walOptions(fs))
+		if err != nil {
+			t.Fatalf("torn at %d sectors: restart: %v", sectors, err)
+		}
+		checkRecovered(t, recovered, acked)
+		w.Close()
+	}
+}
+
+// TestSyncDropRecovery fails a sync of the WAL once, dropping the data it
+// was to flush, and ensures that the WAL acknowledges nothing after it,
+// though a later sync would succeed.
+func TestSyncDropRecovery(t *testing.T) {
+	fs := New()
+	w, err := log.Create(walDir, nil, walOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const acked = 10
+	for i := uint64(1); i <= acked; i++ {
+		if err = w.SaveEntry([]log.LogEntry{NewEntry(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Inject(Fault{Op: OpSync, Match: "*.wal", Times: 1, DropDirty: true})
+	if err = w.SaveEntry([]log.LogEntry{NewEntry(acked + 1)}); cause(err) != ErrInjected {
+		t.Fatalf("err = %v, want %v", err, ErrInjected)
+	}
+	if err = w.SaveEntry([]log.LogEntry{NewEntry(acked + 2)}); err == nil {
+		t.Fatal("save succeeded after a sync dropped the data")
+	}
+
+	fs.Crash()
+	fs.Reset()
+	// the crashed WAL is closed, stopping its file pipeline
+	w.Close()
+	w, recovered, err := Restart(fs, walDir, walOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	checkRecovered(t, recovered, acked)
+}
+
+func TestRepairFaults(t *testing.T) {
+	fs := New()
+	w, err := log.Create(walDir, nil, walOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const acked = 10
+	for i := uint64(1); i <= acked; i++ {
+		if err = w.SaveEntry([]log.LogEntry{NewEntry(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// tear an unsynced append spanning several sectors
+	fs.Inject(Fault{Op: OpSync, Match: "*.wal"})
+	ents := make([]log.LogEntry, 20)
+	for i := range ents {
+		ents[i] = NewEntry(acked + 1 + uint64(i))
+	}
+	if err = w.SaveEntry(ents); err == nil {
+		t.Fatal("save succeeded with a failing sync")
+	}
+	fs.CrashTorn(2)
+	fs.Reset()
+	// the crashed WAL is closed, stopping its file pipeline
+	w.Close()
+
+	// the repair fails to sync the truncated segment, after the WAL found
+	// torn is closed, and is retried
+	fs.Inject(Fault{Op: OpSync, Match: "*.wal", After: 1, Times: 1})
+	if _, _, err = Restart(fs, walDir, walOptions(fs)); cause(err) != ErrInjected {
+		t.Fatalf("restart: err = %v, want %v", err, ErrInjected)
+	}
+	fs.Crash()
+	fs.Reset()
+	w, recovered, err := Restart(fs, walDir, walOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	checkRecovered(t, recovered, acked)
+}
+
+// TestRepairCorruptionFaults fails a repair of corruption in the middle of
+// the WAL on moving the segments, and ensures that it leaves the WAL whole
+// behind a pending manifest and succeeds when retried.
+func TestRepairCorruptionFaults(t *testing.T) {
+	fs := New()
+	w, err := log.Create(walDir, nil, walOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := SaveUntilCut(fs, w, walDir, 1)
+	if err == nil {
+		next, err = SaveUntilCut(fs, w, walDir, next)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// zero a few bytes in the middle of the second segment
+	names, err := fs.ReadDir(walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segments []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".wal") {
+			segments = append(segments, name)
+		}
+	}
+	f, err := fs.OpenFile(walDir+"/"+segments[1], os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Seek(segmentSize/2, io.SeekStart); err == nil {
+		_, err = f.Write(make([]byte, 8))
+	}
+	if err == nil {
+		err = fs.Fsync(f)
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const q = "/data/quarantine"
+	fs.Inject(Fault{Op: OpRename, Match: "*.wal"})
+	if _, err = log.RepairCorruption(zap.NewExample(), walDir, q, walOptions(fs)); cause(err) != ErrInjected {
+		t.Fatalf("err = %v, want %v", err, ErrInjected)
+	}
+	fs.Crash()
+	fs.Reset()
+	if n, _ := fs.Segments(walDir); n != len(segments) {
+		t.Fatalf("%d segments left, want %d", n, len(segments))
+	}
+	dirs, err := fs.ReadDir(q)
+	if err != nil || len(dirs) != 1 {
+		t.Fatalf("quarantine directories = %v (%v), want one", dirs, err)
+	}
+	b, err := log.ReadFile(fs, q+"/"+dirs[0]+"/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending log.QuarantineManifest
+	if err = json.Unmarshal(b, &pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending.Status != log.QuarantinePending {
+		t.Fatalf("status = %q, want %q", pending.Status, log.QuarantinePending)
+	}
+
+	m, err := log.RepairCorruption(zap.NewExample(), walDir, q, walOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Status != log.QuarantineComplete || m.LastGoodIndex == 0 || m.LastGoodIndex >= next-1 {
+		t.Fatalf("manifest = %+v, want complete with last good index within (0, %d)", m, next-1)
+	}
+	fs.Crash()
+	w, ents, err := Restart(fs, walDir, walOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if uint64(len(ents)) != m.LastGoodIndex {
+		t.Fatalf("recovered %d entries, want %d", len(ents), m.LastGoodIndex)
+	}
+}
+
+func TestSnapshotterFaults(t *testing.T) {
+	fs := New()
+	ss, err := NewSnapshotter(fs, zap.NewExample(), "/data/snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ss.SaveSnapData(snappb.ShotData{Index: 1, Data: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := snap.ReadWithOptions(zap.NewExample(), "/data/snap/0000000000000001.snap", &snap.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Index != 1 {
+		t.Fatalf("read snapshot %d, want 1", snapshot.Index)
+	}
+
+	// a snapshot failing to sync is removed
+	fs.Inject(Fault{Op: OpSync, Match: "*.snap"})
+	if err = ss.SaveSnapData(snappb.ShotData{Index: 2, Data: []byte("second")}); cause(err) != ErrInjected {
+		t.Fatalf("err = %v, want %v", err, ErrInjected)
+	}
+	fs.Reset()
+	names, err := ss.SnapNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("snapshots = %v, want the first one only", names)
+	}
+
+	// a snapshot torn by a crash is renamed broken on load
+	fs.Inject(Fault{Op: OpSync, Match: "*.snap", Err: ErrInjected})
+	fs.Inject(Fault{Op: OpRemove, Match: "*.snap"})
+	ss.SaveSnapData(snappb.ShotData{Index: 3, Data: make([]byte, 4*SectorSize)})
+	// the entry of the snapshot reaches the disk before its data
+	syncDir(t, fs, "/data/snap")
+	fs.CrashTorn(1)
+	fs.Reset()
+	snapshot, err = ss.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Index != 1 {
+		t.Fatalf("loaded snapshot %d, want 1", snapshot.Index)
+	}
+	if _, err = fs.Stat("/data/snap/0000000000000003.snap.broken"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cause returns the underlying error of err, unwrapping the errors of the
+// os package.
+func cause(err error) error {
+	switch e := errors.Cause(err).(type) {
+	case *os.PathError:
+		return e.Err
+	case *os.LinkError:
+		return e.Err
+	default:
+		return e
+	}
+}
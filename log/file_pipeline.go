@@ -26,6 +26,7 @@ import (
 // filePipeline pipelines allocating disk space
 type filePipeline struct {
 	lg *zap.Logger
+	fs FS
 
 	// dir to put files
 	dir string
@@ -34,20 +35,21 @@ type filePipeline struct {
 	// count number of files generated
 	count int
 
-	filec chan *fileutil.LockedFile
+	filec chan File
 	errc  chan error
 	donec chan struct{}
 }
 
-func newFilePipeline(lg *zap.Logger, dir string, fileSize int64) *filePipeline {
+func newFilePipeline(lg *zap.Logger, fs FS, dir string, fileSize int64) *filePipeline {
 	if lg == nil {
 		lg = zap.NewNop()
 	}
 	fp := &filePipeline{
 		lg:    lg,
+		fs:    fs,
 		dir:   dir,
 		size:  fileSize,
-		filec: make(chan *fileutil.LockedFile),
+		filec: make(chan File),
 		errc:  make(chan error, 1),
 		donec: make(chan struct{}),
 	}
@@ -57,7 +59,7 @@ func newFilePipeline(lg *zap.Logger, dir string, fileSize int64) *filePipeline {
 
 // Open returns a fresh file for writing. Rename the file before calling
 // Open again or there will be file collisions.
-func (fp *filePipeline) Open() (f *fileutil.LockedFile, err error) {
+func (fp *filePipeline) Open() (f File, err error) {
 	select {
 	case f = <-fp.filec:
 	case err = <-fp.errc:
@@ -70,13 +72,13 @@ func (fp *filePipeline) Close() error {
 	return <-fp.errc
 }
 
-func (fp *filePipeline) alloc() (f *fileutil.LockedFile, err error) {
+func (fp *filePipeline) alloc() (f File, err error) {
 	// count % 2 so this file isn't the same as the one last published
 	fpath := filepath.Join(fp.dir, fmt.Sprintf("%d.tmp", fp.count%2))
-	if f, err = fileutil.LockFile(fpath, os.O_CREATE|os.O_WRONLY, fileutil.PrivateFileMode); err != nil {
+	if f, err = fp.fs.LockFile(fpath, os.O_CREATE|os.O_WRONLY, fileutil.PrivateFileMode); err != nil {
 		return nil, err
 	}
-	if err = fileutil.Preallocate(f.File, fp.size, true); err != nil {
+	if err = fp.fs.Preallocate(f, fp.size, true); err != nil {
 		fp.lg.Error("failed to preallocate space when creating a new WAL", zap.Int64("size", fp.size), zap.Error(err))
 		f.Close()
 		return nil, err
@@ -96,7 +98,7 @@ func (fp *filePipeline) run() {
 		select {
 		case fp.filec <- f:
 		case <-fp.donec:
-			os.Remove(f.Name())
+			fp.fs.Remove(f.Name())
 			f.Close()
 			return
 		}
@@ -30,7 +30,7 @@ func TestFilePipeline(t *testing.T) {
 	}
 	defer os.RemoveAll(tdir)
 
-	fp := newFilePipeline(zap.NewExample(), tdir, SegmentSizeBytes)
+	fp := newFilePipeline(zap.NewExample(), OSFS, tdir, DefaultSegmentSizeBytes)
 	defer fp.Close()
 
 	f, ferr := fp.Open()
@@ -47,7 +47,7 @@ func TestFilePipelineFailPreallocate(t *testing.T) {
 	}
 	defer os.RemoveAll(tdir)
 
-	fp := newFilePipeline(zap.NewExample(), tdir, math.MaxInt64)
+	fp := newFilePipeline(zap.NewExample(), OSFS, tdir, math.MaxInt64)
 	defer fp.Close()
 
 	f, ferr := fp.Open()
@@ -63,7 +63,7 @@ func TestFilePipelineFailLockFile(t *testing.T) {
 	}
 	os.RemoveAll(tdir)
 
-	fp := newFilePipeline(zap.NewExample(), tdir, math.MaxInt64)
+	fp := newFilePipeline(zap.NewExample(), OSFS, tdir, math.MaxInt64)
 	defer fp.Close()
 
 	f, ferr := fp.Open()
@@ -0,0 +1,233 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"go.etcd.io/etcd/pkg/fileutil"
+	"go.uber.org/zap"
+)
+
+// followPollInterval is how long a Follower waits before looking for newly
+// appended records once it has caught up with the writer.
+const followPollInterval = 50 * time.Millisecond
+
+// Follower streams the records of a live WAL as the writer, possibly in
+// another process, appends them. It reads the segment files without locking
+// them and moves to the next segment once the writer has cut it.
+type Follower struct {
+	lg   *zap.Logger
+	dir  string
+	opts *Options
+	from uint64 // entries with a smaller index are skipped
+
+	name     string // name of the segment being read
+	next     string // name of the following segment, once it has been cut
+	f        File
+	decoder  *decoder
+	off      int64  // file offset following the last valid record
+	crc      uint32 // crc the next record is chained to
+	metadata []byte
+}
+
+// Follow opens a Follower on the WAL in dirpath, starting at the segment
+// holding the entry fromIndex. Records are streamed by Next; entries before
+// fromIndex are skipped, as well as crc records and repeated metadata.
+func Follow(dirpath string, fromIndex uint64, opts *Options) (*Follower, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	lg := opts.Logger
+
+	names, err := readWALNames(lg, opts.FS, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := searchIndex(lg, names, fromIndex)
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+
+	fl := &Follower{
+		lg:   lg,
+		dir:  dirpath,
+		opts: opts,
+		from: fromIndex,
+		name: names[i],
+	}
+	if err = fl.open(); err != nil {
+		return nil, err
+	}
+	return fl, nil
+}
+
+func (fl *Follower) open() error {
+	f, err := fl.opts.FS.OpenFile(filepath.Join(fl.dir, fl.name), os.O_RDONLY, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	fl.f = f
+	return fl.reset()
+}
+
+// reset restarts decoding right after the last valid record, dropping
+// whatever was buffered or partially decoded past it.
+func (fl *Follower) reset() error {
+	if _, err := fl.f.Seek(fl.off, io.SeekStart); err != nil {
+		return err
+	}
+	fl.decoder = newDecoderOpts(fl.opts, fl.f)
+	fl.decoder.lastValidOff = fl.off
+	fl.decoder.updateCRC(fl.crc)
+	return nil
+}
+
+// Next returns the next record of the WAL. If the writer has not appended
+// it yet, Next blocks until it does or ctx is done.
+func (fl *Follower) Next(ctx context.Context) (RecordView, error) {
+	for {
+		view, ok, err := fl.tryNext()
+		if err != nil || ok {
+			return view, err
+		}
+		select {
+		case <-ctx.Done():
+			return RecordView{}, ctx.Err()
+		case <-time.After(followPollInterval):
+		}
+	}
+}
+
+// tryNext decodes the next record to hand out. ok is false if the follower
+// has caught up with the writer.
+func (fl *Follower) tryNext() (view RecordView, ok bool, err error) {
+	rec := &walpb.Record{}
+	for {
+		if err = fl.decoder.decode(rec); err == nil {
+			if view, ok, err = fl.view(rec); err != nil || ok {
+				return view, ok, err
+			}
+			continue
+		}
+
+		if fl.next == "" {
+			// a record that fails to decode at the end of the live
+			// segment may still be being written
+			if fl.next, err = fl.nextSegment(); err != nil {
+				return RecordView{}, false, err
+			}
+			if err = fl.reset(); err != nil || fl.next == "" {
+				return RecordView{}, false, err
+			}
+			// the segment is complete now; read what was appended before
+			// the writer moved on
+			continue
+		}
+
+		if err != io.EOF {
+			return RecordView{}, false, err
+		}
+		fl.f.Close()
+		fl.name, fl.next, fl.off = fl.next, "", 0
+		if err = fl.open(); err != nil {
+			return RecordView{}, false, err
+		}
+	}
+}
+
+// view checks the decoded record and converts it for the caller. ok is
+// false if the record is not handed out.
+func (fl *Follower) view(rec *walpb.Record) (view RecordView, ok bool, err error) {
+	if rec.Type == int64(CrcType) {
+		if err = fl.decoder.chainCRC(rec); err != nil {
+			return RecordView{}, false, err
+		}
+	}
+	fl.off, fl.crc = fl.decoder.lastOffset(), fl.decoder.lastCRC()
+
+	switch rec.Type {
+	case int64(EntryType):
+		e := fl.opts.Registry.NewEntry()
+		if err = unmarshalRecord(e, rec); err != nil {
+			return RecordView{}, false, err
+		}
+		return RecordView{Type: EntryType, Entry: e}, e.GetIndex() >= fl.from, nil
+
+	case int64(StateType):
+		s := fl.opts.Registry.NewState()
+		if err = unmarshalRecord(s, rec); err != nil {
+			return RecordView{}, false, err
+		}
+		return RecordView{Type: StateType, State: s}, true, nil
+
+	case int64(SnapshotType):
+		snap := fl.opts.Registry.NewSnapshot()
+		if err = unmarshalRecord(snap, rec); err != nil {
+			return RecordView{}, false, err
+		}
+		return RecordView{Type: SnapshotType, Snapshot: snap}, true, nil
+
+	case int64(TruncateType):
+		index, err := decodeTruncate(rec.Data)
+		if err != nil {
+			return RecordView{}, false, err
+		}
+		return RecordView{Type: TruncateType, Index: index}, true, nil
+
+	case int64(MetadataType):
+		if fl.metadata != nil {
+			if !bytes.Equal(fl.metadata, rec.Data) {
+				return RecordView{}, false, ErrMetadataConflict
+			}
+			return RecordView{}, false, nil
+		}
+		fl.metadata = rec.Data
+		return RecordView{Type: MetadataType, Metadata: rec.Data}, true, nil
+
+	case int64(CrcType):
+		return RecordView{}, false, nil
+
+	default:
+		data, ok, err := fl.opts.Registry.readUserRecord(rec)
+		if err != nil || !ok {
+			return RecordView{}, false, err
+		}
+		return RecordView{Type: RecordType(rec.Type), Record: data}, true, nil
+	}
+}
+
+// nextSegment returns the name of the segment following the one being
+// read, or "" if the writer has not cut it yet.
+func (fl *Follower) nextSegment() (string, error) {
+	seq, _, err := parseWALName(fl.name)
+	if err != nil {
+		return "", err
+	}
+	names, err := readWALNames(fl.lg, fl.opts.FS, fl.dir)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if nseq, _, _ := parseWALName(name); nseq == seq+1 {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// Close closes the segment file being read.
+func (fl *Follower) Close() error {
+	return fl.f.Close()
+}
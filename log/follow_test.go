@@ -0,0 +1,137 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"go.uber.org/zap"
+)
+
+// TestFollow ensures a follower streams the entries of a live WAL in order,
+// across the segments cut while it is reading.
+func TestFollow(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample(), SegmentSizeBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fl, err := Follow(p, 1, &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+
+	const n = 100
+	errc := make(chan error, 1)
+	go func() {
+		for i := 1; i <= n; i++ {
+			es := []LogEntry{&walpb.Entry{Index: uint64(i), Data: make([]byte, 64)}}
+			if err := w.Save(&walpb.HardState{Committed: uint64(i)}, es); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var next uint64 = 1
+	for next <= n {
+		view, err := fl.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if view.Type != EntryType {
+			continue
+		}
+		if view.Entry.GetIndex() != next {
+			t.Fatalf("index = %d, want %d", view.Entry.GetIndex(), next)
+		}
+		next++
+	}
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if w.seq() == 0 {
+		t.Errorf("expected the writer to cut segments")
+	}
+
+	// the follower blocks once it has caught up with the writer
+	ctx, cancel = context.WithTimeout(context.Background(), 3*followPollInterval)
+	defer cancel()
+	for {
+		view, err := fl.Next(ctx)
+		if err == context.DeadlineExceeded {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if view.Type == EntryType {
+			t.Fatalf("unexpected entry %d", view.Entry.GetIndex())
+		}
+	}
+}
+
+func TestFollowFromIndex(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample(), SegmentSizeBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 40; i++ {
+		es := []LogEntry{&walpb.Entry{Index: uint64(i), Data: make([]byte, 64)}}
+		if err = w.Save(&walpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	fl, err := Follow(p, 30, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*followPollInterval)
+	defer cancel()
+	var ents []uint64
+	for {
+		view, err := fl.Next(ctx)
+		if err == context.DeadlineExceeded {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if view.Type == EntryType {
+			ents = append(ents, view.Entry.GetIndex())
+		}
+	}
+	if len(ents) != 11 || ents[0] != 30 || ents[10] != 40 {
+		t.Errorf("entries = %v, want 30..40", ents)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/etcd/pkg/fileutil"
+)
+
+// File is a file opened on an FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// FS is the filesystem the WAL and the snapshotter keep their files on.
+// Paths are those of the os package; an FS need not be backed by disk.
+type FS interface {
+	// OpenFile opens the named file as os.OpenFile does.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// LockFile opens the named file as OpenFile does and locks it
+	// exclusively until it is closed, waiting for the lock if held.
+	LockFile(name string, flag int, perm os.FileMode) (File, error)
+	// TryLockFile is LockFile failing with fileutil.ErrLocked instead of
+	// waiting if the lock is held.
+	TryLockFile(name string, flag int, perm os.FileMode) (File, error)
+	// OpenDir opens the directory at path for syncing its entries.
+	OpenDir(path string) (File, error)
+	// Preallocate allocates size bytes to f, growing it to size if extend
+	// is set.
+	Preallocate(f File, size int64, extend bool) error
+	// Fsync flushes f, its data and metadata, to stable storage.
+	Fsync(f File) error
+	// Fdatasync flushes the data of f to stable storage.
+	Fdatasync(f File) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir returns the names of the entries of the directory at path
+	// in sorted order.
+	ReadDir(path string) ([]string, error)
+	Stat(name string) (os.FileInfo, error)
+}
+
+// OSFS is the FS of the operating system, the default.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+// osFile returns the *os.File of a file opened by osFS.
+func osFile(f File) (*os.File, bool) {
+	switch f := f.(type) {
+	case *os.File:
+		return f, true
+	case *fileutil.LockedFile:
+		return f.File, true
+	}
+	return nil, false
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) LockFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fileutil.LockFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) TryLockFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fileutil.TryLockFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) OpenDir(path string) (File, error) {
+	f, err := fileutil.OpenDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Preallocate(f File, size int64, extend bool) error {
+	if of, ok := osFile(f); ok {
+		return fileutil.Preallocate(of, size, extend)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if extend && fi.Size() < size {
+		return f.Truncate(size)
+	}
+	return nil
+}
+
+func (osFS) Fsync(f File) error {
+	if of, ok := osFile(f); ok {
+		return fileutil.Fsync(of)
+	}
+	return f.Sync()
+}
+
+func (osFS) Fdatasync(f File) error {
+	if of, ok := osFile(f); ok {
+		return fileutil.Fdatasync(of)
+	}
+	return f.Sync()
+}
+
+func (osFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (osFS) Remove(name string) error { return os.Remove(name) }
+
+func (osFS) RemoveAll(path string) error { return os.RemoveAll(path) }
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFS) ReadDir(path string) ([]string, error) { return fileutil.ReadDir(path) }
+
+func (osFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+// ReadFile reads the named file of fs.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// WriteFile writes data to the named file of fs, creating or truncating it.
+// If sync is set, the file is fsynced before it is closed.
+func WriteFile(fs FS, name string, data []byte, perm os.FileMode, sync bool) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil && sync {
+		err = fs.Fsync(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// exist reports whether the directory at dir of fs has any entry.
+func exist(fs FS, dir string) bool {
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	return len(names) != 0
+}
+
+// zeroToEnd zeros f from its current offset to its end, like
+// fileutil.ZeroToEnd.
+func zeroToEnd(fs FS, f File) error {
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	lenf, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(off); err != nil {
+		return err
+	}
+	// make sure blocks remain allocated
+	if err = fs.Preallocate(f, lenf, true); err != nil {
+		return err
+	}
+	_, err = f.Seek(off, io.SeekStart)
+	return err
+}
+
+// mkdirAllSync creates the directory at dir with its parents, like
+// MkdirAll, and syncs the parent of each directory it creates so that they
+// survive a crash.
+func mkdirAllSync(fs FS, dir string) error {
+	var created []string
+	for p := filepath.Clean(dir); p != filepath.Dir(p); p = filepath.Dir(p) {
+		if _, err := fs.Stat(p); err == nil {
+			break
+		}
+		created = append(created, p)
+	}
+	if err := fs.MkdirAll(dir, fileutil.PrivateDirMode); err != nil {
+		return err
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := syncDir(fs, filepath.Dir(created[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDirAll creates the directory at dir with its parents, failing if
+// it already has entries, like fileutil.CreateDirAll.
+func createDirAll(fs FS, dir string) error {
+	if err := fs.MkdirAll(dir, fileutil.PrivateDirMode); err != nil {
+		return err
+	}
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) != 0 {
+		return fmt.Errorf("expected %q to be empty, got %q", dir, names)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+)
+
+// countingFS counts the calls made to an FS and the paths it is given.
+type countingFS struct {
+	FS
+	mu    sync.Mutex
+	calls map[string]int
+	paths []string
+}
+
+func newCountingFS() *countingFS {
+	return &countingFS{FS: OSFS, calls: make(map[string]int)}
+}
+
+func (fs *countingFS) called(op string, paths ...string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.calls[op]++
+	fs.paths = append(fs.paths, paths...)
+}
+
+func (fs *countingFS) count(op string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls[op]
+}
+
+func (fs *countingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.called("open", name)
+	return fs.FS.OpenFile(name, flag, perm)
+}
+
+func (fs *countingFS) LockFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.called("lock", name)
+	return fs.FS.LockFile(name, flag, perm)
+}
+
+func (fs *countingFS) TryLockFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.called("lock", name)
+	return fs.FS.TryLockFile(name, flag, perm)
+}
+
+func (fs *countingFS) Preallocate(f File, size int64, extend bool) error {
+	fs.called("preallocate", f.Name())
+	return fs.FS.Preallocate(f, size, extend)
+}
+
+func (fs *countingFS) Fdatasync(f File) error {
+	fs.called("fdatasync", f.Name())
+	return fs.FS.Fdatasync(f)
+}
+
+func (fs *countingFS) Rename(oldpath, newpath string) error {
+	fs.called("rename", oldpath, newpath)
+	return fs.FS.Rename(oldpath, newpath)
+}
+
+func (fs *countingFS) ReadDir(path string) ([]string, error) {
+	fs.called("readdir", path)
+	return fs.FS.ReadDir(path)
+}
+
+// TestFS ensures that creating, cutting, opening and repairing a WAL goes
+// through the FS of its Options.
+func TestFS(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	dir := filepath.Join(p, "wal")
+
+	fs := newCountingFS()
+	opts := &Options{SegmentSizeBytes: 1024, FS: fs}
+	w, err := Create(dir, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 20; i++ {
+		if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: uint64(i), Data: make([]byte, 100)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"lock", "preallocate", "fdatasync", "rename", "readdir"} {
+		if fs.count(op) == 0 {
+			t.Errorf("no %s went through the FS", op)
+		}
+	}
+
+	w, err = Open(dir, NewEmptySnapshot(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 20 {
+		t.Fatalf("len(ents) = %d, want 20", len(ents))
+	}
+	w.Close()
+
+	locks := fs.count("lock")
+	if _, err = RepairTail(nil, dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if fs.count("lock") != locks+1 {
+		t.Errorf("repair did not lock the last segment through the FS")
+	}
+
+	for _, path := range fs.paths {
+		if !strings.HasPrefix(path, p) {
+			t.Errorf("path %s outside of %s", path, p)
+		}
+	}
+}
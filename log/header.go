@@ -0,0 +1,238 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/pkg/fileutil"
+	"go.uber.org/zap"
+)
+
+const (
+	// SegmentVersion is the format version of the segments written by this
+	// package. Segments written before the format was versioned have no
+	// header and are version 0.
+	SegmentVersion uint64 = 1
+
+	// segmentMagic starts the header of a versioned segment. Read as the
+	// length field of a frame, it announces padding without setting the
+	// padding flag, which no encoder ever writes, so it cannot be mistaken
+	// for the first record of an unversioned segment.
+	segmentMagic uint64 = 0x0757414c5345474d
+
+	// segmentHeaderBytes is the size of the header: the magic followed by
+	// the version, keeping the records 8 byte aligned.
+	segmentHeaderBytes = 16
+)
+
+var (
+	ErrUnknownVersion  = errors.New("wal: unknown segment format version")
+	ErrMigrationNeeded = errors.New("wal: segment of an older format version, run Migrate")
+)
+
+func writeSegmentHeader(w io.Writer) error {
+	b := make([]byte, segmentHeaderBytes)
+	binary.LittleEndian.PutUint64(b[0:], segmentMagic)
+	binary.LittleEndian.PutUint64(b[8:], SegmentVersion)
+	_, err := w.Write(b)
+	return err
+}
+
+// readSegmentVersion returns the format version of the segment read by r.
+func readSegmentVersion(r io.ReaderAt) (uint64, error) {
+	b := make([]byte, segmentHeaderBytes)
+	n, err := r.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if n < 8 || binary.LittleEndian.Uint64(b) != segmentMagic {
+		return 0, nil
+	}
+	if n < segmentHeaderBytes {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return binary.LittleEndian.Uint64(b[8:]), checkSegmentVersion(binary.LittleEndian.Uint64(b[8:]))
+}
+
+// needsMigration reports whether the segment read by r holds records of an
+// older format version. An empty segment does not.
+func needsMigration(r io.ReaderAt) (bool, error) {
+	version, err := readSegmentVersion(r)
+	if err != nil || version == SegmentVersion {
+		return false, err
+	}
+	b := make([]byte, frameSizeBytes)
+	if _, err = r.ReadAt(b, 0); err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return false, err
+	}
+	// a preallocated segment holds zeros until the first record
+	return binary.LittleEndian.Uint64(b) != 0, nil
+}
+
+func checkSegmentVersion(version uint64) error {
+	if version > SegmentVersion {
+		return errors.Wrapf(ErrUnknownVersion, "version %d is newer than %d", version, SegmentVersion)
+	}
+	return nil
+}
+
+// Migrate upgrades every segment of the WAL in dirpath written in an older
+// format to SegmentVersion, rewriting it in place. The WAL must not be
+// open. Older segments stay readable by OpenForRead, Verify and the other
+// readers, but Open fails with ErrMigrationNeeded while any segment it
+// opens for appending is one of them, until Migrate has run. Migrate
+// returns the names of the upgraded segments. The torn tail of the last
+// segment is cut as Repair does, keeping a copy of the segment with the
+// .broken suffix; any other segment not decoding to its end fails the
+// migration.
+func Migrate(lg *zap.Logger, dirpath string, opts *Options) ([]string, error) {
+	if lg == nil {
+		lg = zap.NewNop()
+	}
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	m, err := opts.metrics()
+	if err != nil {
+		return nil, err
+	}
+	names, err := readWALNames(lg, opts.FS, dirpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []string
+	for i, name := range names {
+		ok, err := migrateSegment(lg, opts, m, dirpath, name, i == len(names)-1)
+		if err != nil {
+			return migrated, err
+		}
+		if ok {
+			migrated = append(migrated, name)
+		}
+	}
+	return migrated, nil
+}
+
+// migrateSegment upgrades the named segment to SegmentVersion, cutting its
+// torn tail if it is the last one. ok is false if it already is.
+func migrateSegment(lg *zap.Logger, opts *Options, m *metrics, dirpath, name string, last bool) (ok bool, err error) {
+	fs := opts.FS
+	fpath := filepath.Join(dirpath, name)
+	l, err := fs.TryLockFile(fpath, os.O_RDWR, fileutil.PrivateFileMode)
+	if err != nil {
+		return false, err
+	}
+	defer l.Close()
+
+	version, err := readSegmentVersion(l)
+	if err != nil || version == SegmentVersion {
+		return false, err
+	}
+
+	// the records must decode to the end of the segment, as their offsets
+	// move behind the header
+	end, err := segmentEnd(opts, l)
+	if err == io.ErrUnexpectedEOF && last {
+		if err = copyBroken(fs, l, fpath+".broken"); err != nil {
+			return false, err
+		}
+		lg.Warn("cut torn tail of WAL segment", zap.String("path", fpath), zap.Int64("offset", end))
+	} else if err != nil {
+		return false, errors.Wrapf(err, "cannot migrate %s", fpath)
+	}
+
+	tmp := fpath + ".tmp"
+	f, err := fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileutil.PrivateFileMode)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			fs.Remove(tmp)
+		}
+	}()
+
+	switch version {
+	case 0:
+		// prepend the header; the records are unchanged
+		if err = writeSegmentHeader(f); err != nil {
+			return false, err
+		}
+		if _, err = io.Copy(f, io.NewSectionReader(l, 0, end)); err != nil {
+			return false, err
+		}
+	}
+
+	start := time.Now()
+	if err = fs.Fsync(f); err != nil {
+		return false, err
+	}
+	m.fsyncSec.Observe(time.Since(start).Seconds())
+	if err = f.Close(); err != nil {
+		return false, err
+	}
+	if err = fs.Rename(tmp, fpath); err != nil {
+		return false, err
+	}
+	if err = syncDir(fs, dirpath); err != nil {
+		return false, err
+	}
+	// the record offsets moved
+	if rerr := fs.Remove(filepath.Join(dirpath, indexName(name))); rerr != nil && !os.IsNotExist(rerr) {
+		lg.Warn("failed to remove WAL segment index", zap.String("path", filepath.Join(dirpath, indexName(name))), zap.Error(rerr))
+	}
+
+	lg.Info("migrated WAL segment", zap.String("path", fpath), zap.Uint64("from-version", version), zap.Uint64("to-version", SegmentVersion))
+	return true, nil
+}
+
+// segmentEnd decodes the records of the segment f, returning the offset
+// following the last valid one. err is nil if they decode to the end of f,
+// and io.ErrUnexpectedEOF if its tail is torn.
+func segmentEnd(opts *Options, f File) (int64, error) {
+	rec := &walpb.Record{}
+	d := newDecoderOpts(opts, io.NewSectionReader(f, 0, math.MaxInt64))
+	for {
+		err := d.decode(rec)
+		if err == nil && rec.Type == int64(CrcType) {
+			err = d.chainCRC(rec)
+		}
+		if err == io.EOF {
+			return d.lastOffset(), nil
+		}
+		if err != nil {
+			return d.lastOffset(), err
+		}
+	}
+}
+
+// copyBroken copies the segment f to the file at path, synced.
+func copyBroken(fs FS, f File, path string) error {
+	bf, err := fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+	if _, err = io.Copy(bf, io.NewSectionReader(f, 0, math.MaxInt64)); err != nil {
+		return err
+	}
+	return fs.Fsync(bf)
+}
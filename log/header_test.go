@@ -0,0 +1,198 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+func segmentVersion(t *testing.T, fpath string) uint64 {
+	f, err := os.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	version, err := readSegmentVersion(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+// downgradeSegment strips the header of a segment, as written before the
+// format was versioned.
+func downgradeSegment(t *testing.T, fpath string) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(fpath, b[segmentHeaderBytes:], 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenUnknownVersion(t *testing.T) {
+	p, w := createRangeWAL(t, 1)
+	defer os.RemoveAll(p)
+	w.Close()
+
+	fpath := filepath.Join(p, walName(0, 0))
+	if v := segmentVersion(t, fpath); v != SegmentVersion {
+		t.Fatalf("version = %d, want %d", v, SegmentVersion)
+	}
+
+	f, err := os.OpenFile(fpath, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, SegmentVersion+1)
+	if _, err = f.WriteAt(b, 8); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err = Open(p, NewEmptySnapshot(), nil); errors.Cause(err) != ErrUnknownVersion {
+		t.Errorf("err = %v, want %v", err, ErrUnknownVersion)
+	}
+	if err = Verify(zap.NewExample(), p, NewEmptySnapshot(), nil); errors.Cause(err) != ErrUnknownVersion {
+		t.Errorf("err = %v, want %v", err, ErrUnknownVersion)
+	}
+}
+
+// TestMigrate ensures unversioned segments are read along with versioned
+// ones, refused by Open until they are upgraded in place by Migrate.
+func TestMigrate(t *testing.T) {
+	p, w := createRangeWAL(t, 10)
+	defer os.RemoveAll(p)
+	w.Close()
+
+	names, err := readWALNames(zap.NewExample(), OSFS, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		downgradeSegment(t, filepath.Join(p, name))
+	}
+
+	if err = Verify(zap.NewExample(), p, NewEmptySnapshot(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(p, NewEmptySnapshot(), nil); errors.Cause(err) != ErrMigrationNeeded {
+		t.Fatalf("err = %v, want %v", err, ErrMigrationNeeded)
+	}
+
+	migrated, err := Migrate(zap.NewExample(), p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated) != len(names) {
+		t.Errorf("migrated = %v, want %v", migrated, names)
+	}
+	for _, name := range names {
+		if v := segmentVersion(t, filepath.Join(p, name)); v != SegmentVersion {
+			t.Errorf("%s: version = %d, want %d", name, v, SegmentVersion)
+		}
+	}
+
+	if w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample(), SegmentSizeBytes: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err = Migrate(zap.NewExample(), p, nil); err == nil {
+		t.Errorf("expected Migrate to fail on an open WAL")
+	}
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 11; i <= 20; i++ {
+		es := []LogEntry{&walpb.Entry{Index: uint64(i), Data: make([]byte, 100)}}
+		if err = w.Save(&walpb.HardState{Committed: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRange(t, w, 1, 21, nil)
+}
+
+// TestMigrateTornTail ensures the torn tail of the last unversioned segment
+// is cut by Migrate, leaving a WAL that opens and repairs cleanly.
+func TestMigrateTornTail(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	w, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample(), SegmentSizeBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		es := []LogEntry{&walpb.Entry{Index: uint64(i), Data: make([]byte, 100)}}
+		if err = w.Save(&walpb.HardState{Committed: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	names, err := readWALNames(zap.NewExample(), OSFS, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		downgradeSegment(t, filepath.Join(p, name))
+	}
+	// tear the frame of the last entry
+	last := filepath.Join(p, names[len(names)-1])
+	offs := recordOffsets(t, last)
+	if len(offs) < 3 {
+		t.Fatalf("last segment holds %d records, want an entry and its state", len(offs))
+	}
+	if err = os.Truncate(last, offs[len(offs)-2]+4); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Migrate(zap.NewExample(), p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(last + ".broken"); err != nil {
+		t.Errorf("torn segment not kept: %v", err)
+	}
+	if v := segmentVersion(t, last); v != SegmentVersion {
+		t.Errorf("version = %d, want %d", v, SegmentVersion)
+	}
+	if fi, err := os.Stat(last); err != nil || fi.Size() != segmentHeaderBytes+offs[len(offs)-2] {
+		t.Errorf("migrated segment not cut at its last valid record: %v, %v", fi, err)
+	}
+	if !Repair(zap.NewExample(), p, nil) {
+		t.Fatal("failed to repair the migrated WAL")
+	}
+
+	if w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample(), SegmentSizeBytes: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 9 {
+		t.Fatalf("len(ents) = %d, want 9", len(ents))
+	}
+	es := []LogEntry{&walpb.Entry{Index: 10, Data: make([]byte, 100)}}
+	if err = w.Save(&walpb.HardState{Committed: 10}, es); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, w, 1, 11, nil)
+}
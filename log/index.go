@@ -0,0 +1,350 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/pkg/fileutil"
+	"go.uber.org/zap"
+)
+
+const (
+	// indexSuffix is appended to the base name of a segment for its sparse index file.
+	indexSuffix = ".idx"
+
+	// indexIntervalBytes is the minimum distance between two checkpoints of a segment index.
+	indexIntervalBytes = 64 * 1024
+
+	indexHeaderBytes     = 24
+	indexCheckpointBytes = 24
+)
+
+var (
+	ErrRangeUnavailable = errors.New("wal: requested entry range is unavailable")
+	errBadIndexFile     = errors.New("wal: bad segment index file")
+)
+
+// checkpoint is a position in a segment a decoder can start reading at.
+type checkpoint struct {
+	index uint64 // index of the entry at off
+	off   int64  // file offset of the entry record
+	crc   uint32 // crc the entry data is chained to
+}
+
+// segmentIndex is the sparse index of one wal segment. It holds a checkpoint
+// for the first entry of the segment and then at most one every
+// indexIntervalBytes, in file order.
+type segmentIndex struct {
+	size     int64  // size of the segment data covered by the index
+	minIndex uint64 // smallest index the segment writes or truncates from, 0 if none
+	cps      []checkpoint
+}
+
+// touch records that the segment overwrites or discards the entries from
+// index on.
+func (si *segmentIndex) touch(index uint64) {
+	if si.minIndex == 0 || index < si.minIndex {
+		si.minIndex = index
+	}
+}
+
+func (si *segmentIndex) add(index uint64, off int64, crc uint32) {
+	si.touch(index)
+	if len(si.cps) == 0 || off-si.cps[len(si.cps)-1].off >= indexIntervalBytes {
+		si.cps = append(si.cps, checkpoint{index: index, off: off, crc: crc})
+	}
+}
+
+func (si *segmentIndex) clone() segmentIndex {
+	c := *si
+	c.cps = append([]checkpoint(nil), si.cps...)
+	return c
+}
+
+// seek returns the last checkpoint, in file order, whose entry index is not
+// larger than index. Since writing an entry discards all entries of an equal
+// or larger index written before it, reading from that checkpoint yields
+// every surviving entry from index on.
+func (si *segmentIndex) seek(index uint64) (checkpoint, bool) {
+	for i := len(si.cps) - 1; i >= 0; i-- {
+		if si.cps[i].index <= index {
+			return si.cps[i], true
+		}
+	}
+	return checkpoint{}, false
+}
+
+func (si *segmentIndex) marshal() []byte {
+	b := make([]byte, indexHeaderBytes+len(si.cps)*indexCheckpointBytes+4)
+	binary.LittleEndian.PutUint64(b[0:], uint64(si.size))
+	binary.LittleEndian.PutUint64(b[8:], si.minIndex)
+	binary.LittleEndian.PutUint64(b[16:], uint64(len(si.cps)))
+	p := b[indexHeaderBytes:]
+	for _, cp := range si.cps {
+		binary.LittleEndian.PutUint64(p[0:], cp.index)
+		binary.LittleEndian.PutUint64(p[8:], uint64(cp.off))
+		binary.LittleEndian.PutUint32(p[16:], cp.crc)
+		p = p[indexCheckpointBytes:]
+	}
+	binary.LittleEndian.PutUint32(p, crc32.Checksum(b[:len(b)-4], crcTable))
+	return b
+}
+
+func (si *segmentIndex) unmarshal(b []byte) error {
+	if len(b) < indexHeaderBytes+4 {
+		return errBadIndexFile
+	}
+	if crc32.Checksum(b[:len(b)-4], crcTable) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return errBadIndexFile
+	}
+	n := binary.LittleEndian.Uint64(b[16:])
+	if uint64(len(b)-indexHeaderBytes-4) != n*indexCheckpointBytes {
+		return errBadIndexFile
+	}
+	si.size = int64(binary.LittleEndian.Uint64(b[0:]))
+	si.minIndex = binary.LittleEndian.Uint64(b[8:])
+	si.cps = make([]checkpoint, n)
+	p := b[indexHeaderBytes:]
+	for i := range si.cps {
+		si.cps[i] = checkpoint{
+			index: binary.LittleEndian.Uint64(p[0:]),
+			off:   int64(binary.LittleEndian.Uint64(p[8:])),
+			crc:   binary.LittleEndian.Uint32(p[16:]),
+		}
+		p = p[indexCheckpointBytes:]
+	}
+	return nil
+}
+
+func indexName(walName string) string {
+	return strings.TrimSuffix(walName, ".wal") + indexSuffix
+}
+
+// saveSegmentIndex writes the index of the named segment. The index is not
+// synced; a lost or torn index file is rebuilt on demand.
+func saveSegmentIndex(fs FS, dirpath, name string, si *segmentIndex) error {
+	return WriteFile(fs, filepath.Join(dirpath, indexName(name)), si.marshal(), fileutil.PrivateFileMode, false)
+}
+
+// loadSegmentIndex reads the index of the named closed segment, rebuilding
+// and saving it if it is missing, corrupted or stale.
+func loadSegmentIndex(lg *zap.Logger, dirpath, name string, opts *Options) (*segmentIndex, error) {
+	fi, err := opts.FS.Stat(filepath.Join(dirpath, name))
+	if err != nil {
+		return nil, err
+	}
+
+	si := &segmentIndex{}
+	b, err := ReadFile(opts.FS, filepath.Join(dirpath, indexName(name)))
+	if err == nil && si.unmarshal(b) == nil && si.size == fi.Size() {
+		return si, nil
+	}
+
+	lg.Info("rebuilding WAL segment index", zap.String("path", filepath.Join(dirpath, name)))
+	if si, err = buildSegmentIndex(dirpath, name, fi.Size(), opts); err != nil {
+		return nil, err
+	}
+	if err = saveSegmentIndex(opts.FS, dirpath, name, si); err != nil {
+		lg.Warn("failed to save WAL segment index", zap.String("path", filepath.Join(dirpath, indexName(name))), zap.Error(err))
+	}
+	return si, nil
+}
+
+// buildSegmentIndex scans the named segment and indexes its entries.
+func buildSegmentIndex(dirpath, name string, size int64, opts *Options) (*segmentIndex, error) {
+	f, err := opts.FS.OpenFile(filepath.Join(dirpath, name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	si := &segmentIndex{size: size}
+	rec := &walpb.Record{}
+	decoder := newDecoderOpts(opts, f)
+	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
+		switch rec.Type {
+		case int64(EntryType):
+			e := opts.Registry.NewEntry()
+			if err = unmarshalRecord(e, rec); err != nil {
+				return nil, err
+			}
+			si.add(e.GetIndex(), decoder.recOff, decoder.recCrc)
+		case int64(TruncateType):
+			index, err := decodeTruncate(rec.Data)
+			if err != nil {
+				return nil, err
+			}
+			si.touch(index + 1)
+		case int64(CrcType):
+			decoder.updateCRC(rec.Crc)
+		}
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return si, nil
+}
+
+// ReadRange returns the entries in the range [lo, hi) from the segment
+// files, without replaying the WAL from its start snapshot. It seeks
+// straight to the closest checkpoint of the per-segment sparse index and
+// only decodes forward from there. maxBytes limits the total size of the
+// entries returned, but at least one entry is returned if any.
+// ReadRange returns ErrRangeUnavailable if entry lo is not in the WAL; entries
+// past the last one in the WAL are not returned.
+// The WAL must be in append mode, which is after ReadAll or Replay.
+func (w *WAL) ReadRange(lo, hi, maxBytes uint64) ([]LogEntry, error) {
+	if lo >= hi {
+		return nil, nil
+	}
+
+	w.mu.Lock()
+	if w.encoder == nil || w.tail() == nil {
+		w.mu.Unlock()
+		return nil, ErrDecoderNotFound
+	}
+	// make every encoded record visible to the readers below
+	if err := w.encoder.flush(); err != nil {
+		w.mu.Unlock()
+		return nil, err
+	}
+	tailName := filepath.Base(w.tail().Name())
+	tailIdx := w.tailIdx.clone()
+	tailIdx.size, _ = w.encoder.position()
+	w.mu.Unlock()
+
+	names, err := readWALNames(w.lg, w.opts.FS, w.dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		if name == tailName {
+			// ignore segments cut after the tail was looked up
+			names = names[:i+1]
+			break
+		}
+	}
+
+	idxs := make([]*segmentIndex, len(names))
+	for i, name := range names {
+		if name == tailName {
+			idxs[i] = &tailIdx
+			continue
+		}
+		if idxs[i], err = loadSegmentIndex(w.lg, w.dir, name, w.opts); err != nil {
+			return nil, err
+		}
+	}
+
+	start, cp, found := len(names)-1, checkpoint{}, false
+	for ; start >= 0; start-- {
+		if cp, found = idxs[start].seek(lo); found {
+			break
+		}
+	}
+	if !found {
+		return nil, ErrRangeUnavailable
+	}
+
+	var ents []LogEntry
+	for i := start; i < len(names); i++ {
+		if i != start && (idxs[i].minIndex == 0 || idxs[i].minIndex >= hi) {
+			// no record of the segment can overwrite the range
+			continue
+		}
+		from := checkpoint{}
+		if i == start {
+			from = cp
+		}
+		if ents, err = w.readSegmentRange(names[i], idxs[i].size, from, lo, hi, ents); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ents) == 0 || ents[0].GetIndex() != lo {
+		return nil, ErrRangeUnavailable
+	}
+	return limitEntriesSize(ents, maxBytes), nil
+}
+
+// readSegmentRange decodes the entries of the named segment from the given
+// checkpoint up to size, and applies those in [lo, hi) on top of ents.
+func (w *WAL) readSegmentRange(name string, size int64, from checkpoint, lo, hi uint64, ents []LogEntry) ([]LogEntry, error) {
+	f, err := w.opts.FS.OpenFile(filepath.Join(w.dir, name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(from.off, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	decoder := newDecoderOpts(w.opts, io.LimitReader(f, size-from.off))
+	decoder.lastValidOff = from.off
+	if from.off != 0 {
+		decoder.updateCRC(from.crc)
+	}
+
+	rec := &walpb.Record{}
+	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
+		switch rec.Type {
+		case int64(EntryType):
+			e := w.opts.Registry.NewEntry()
+			if err = unmarshalRecord(e, rec); err != nil {
+				return nil, err
+			}
+			switch index := e.GetIndex(); {
+			case index < lo:
+				// an older entry overwrites the whole range
+				ents = ents[:0]
+			case index < hi:
+				up := index - lo
+				if up > uint64(len(ents)) {
+					return nil, ErrSliceOutOfRange
+				}
+				ents = append(ents[:up], e)
+			}
+		case int64(TruncateType):
+			index, err := decodeTruncate(rec.Data)
+			if err != nil {
+				return nil, err
+			}
+			ents = truncateEntries(ents, lo, index)
+		case int64(CrcType):
+			if err = decoder.chainCRC(rec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return ents, nil
+}
+
+func limitEntriesSize(ents []LogEntry, maxBytes uint64) []LogEntry {
+	if len(ents) == 0 {
+		return ents
+	}
+	size := ents[0].Size()
+	var limit int
+	for limit = 1; limit < len(ents); limit++ {
+		size += ents[limit].Size()
+		if uint64(size) > maxBytes {
+			break
+		}
+	}
+	return ents[:limit]
+}
@@ -0,0 +1,226 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"go.uber.org/zap"
+)
+
+func TestSegmentIndexMarshal(t *testing.T) {
+	si := &segmentIndex{size: 4096}
+	si.add(5, 64, 1)
+	si.add(6, 128, 2)
+	si.add(7, 64+indexIntervalBytes, 3)
+	si.add(3, 128+indexIntervalBytes, 4)
+	if len(si.cps) != 2 {
+		t.Fatalf("len(cps) = %d, want %d", len(si.cps), 2)
+	}
+	if si.minIndex != 3 {
+		t.Errorf("minIndex = %d, want %d", si.minIndex, 3)
+	}
+
+	b := si.marshal()
+	got := &segmentIndex{}
+	if err := got.unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, si) {
+		t.Errorf("index = %+v, want %+v", got, si)
+	}
+
+	b[len(b)/2] ^= 0xff
+	if err := got.unmarshal(b); err != errBadIndexFile {
+		t.Errorf("err = %v, want %v", err, errBadIndexFile)
+	}
+	if err := got.unmarshal(b[:10]); err != errBadIndexFile {
+		t.Errorf("err = %v, want %v", err, errBadIndexFile)
+	}
+}
+
+func TestSegmentIndexSeek(t *testing.T) {
+	si := &segmentIndex{cps: []checkpoint{{index: 1}, {index: 100}, {index: 50}, {index: 150}}}
+	tests := []struct {
+		index  uint64
+		windex uint64
+		wok    bool
+	}{
+		{0, 0, false},
+		{1, 1, true},
+		{99, 50, true},
+		{120, 50, true},
+		{200, 150, true},
+	}
+	for i, tt := range tests {
+		cp, ok := si.seek(tt.index)
+		if ok != tt.wok || cp.index != tt.windex {
+			t.Errorf("#%d: seek = (%d, %v), want (%d, %v)", i, cp.index, ok, tt.windex, tt.wok)
+		}
+	}
+}
+
+func createRangeWAL(t *testing.T, n int) (string, *WAL) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample(), SegmentSizeBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		es := []LogEntry{&walpb.Entry{Index: uint64(i), Data: bytes.Repeat([]byte{byte(i)}, 100)}}
+		if err = w.Save(&walpb.HardState{Committed: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p, w
+}
+
+func checkRange(t *testing.T, w *WAL, lo, hi uint64, want []byte) {
+	ents, err := w.ReadRange(lo, hi, noLimit)
+	if err != nil {
+		t.Fatalf("ReadRange(%d, %d) err = %v", lo, hi, err)
+	}
+	if len(ents) != int(hi-lo) {
+		t.Fatalf("ReadRange(%d, %d) len = %d, want %d", lo, hi, len(ents), hi-lo)
+	}
+	for i, e := range ents {
+		ent := e.(*walpb.Entry)
+		if ent.Index != lo+uint64(i) {
+			t.Errorf("#%d: index = %d, want %d", i, ent.Index, lo+uint64(i))
+		}
+		if want != nil && ent.Data[0] != want[i] {
+			t.Errorf("#%d: data = %d, want %d", i, ent.Data[0], want[i])
+		}
+	}
+}
+
+const noLimit = ^uint64(0)
+
+func TestReadRange(t *testing.T) {
+	p, w := createRangeWAL(t, 50)
+	defer os.RemoveAll(p)
+	defer w.Close()
+
+	if w.seq() < 3 {
+		t.Fatalf("seq = %d, want at least %d segments", w.seq(), 3)
+	}
+	checkRange(t, w, 1, 51, nil)
+	checkRange(t, w, 17, 33, nil)
+	checkRange(t, w, 50, 51, nil)
+
+	// hi past the last entry returns what is available
+	ents, err := w.ReadRange(45, 100, noLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 6 {
+		t.Errorf("len(ents) = %d, want %d", len(ents), 6)
+	}
+
+	// maxBytes returns at least one entry
+	if ents, err = w.ReadRange(10, 20, 1); err != nil || len(ents) != 1 {
+		t.Errorf("ReadRange = (%d, %v), want (%d, nil)", len(ents), err, 1)
+	}
+	size := uint64(ents[0].Size())
+	if ents, err = w.ReadRange(10, 20, 3*size); err != nil || len(ents) != 3 {
+		t.Errorf("ReadRange = (%d, %v), want (%d, nil)", len(ents), err, 3)
+	}
+
+	if _, err = w.ReadRange(0, 5, noLimit); err != ErrRangeUnavailable {
+		t.Errorf("err = %v, want %v", err, ErrRangeUnavailable)
+	}
+	if _, err = w.ReadRange(51, 60, noLimit); err != ErrRangeUnavailable {
+		t.Errorf("err = %v, want %v", err, ErrRangeUnavailable)
+	}
+}
+
+// TestReadRangeOverwrite ensures entries rewritten by a later append win
+// over the ones they overwrite, even across segments.
+func TestReadRangeOverwrite(t *testing.T) {
+	p, w := createRangeWAL(t, 30)
+	defer os.RemoveAll(p)
+	defer w.Close()
+
+	es := []LogEntry{
+		&walpb.Entry{Index: 12, Data: []byte{112}},
+		&walpb.Entry{Index: 13, Data: []byte{113}},
+	}
+	if err := w.Save(&walpb.HardState{}, es); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRange(t, w, 10, 14, []byte{10, 11, 112, 113})
+	if _, err := w.ReadRange(14, 20, noLimit); err != ErrRangeUnavailable {
+		t.Errorf("err = %v, want %v", err, ErrRangeUnavailable)
+	}
+}
+
+// TestReadRangeRebuildIndex ensures missing or corrupted segment indexes
+// are rebuilt, and that the tail is indexed again after reopening the WAL.
+func TestReadRangeRebuildIndex(t *testing.T) {
+	p, w := createRangeWAL(t, 40)
+	defer os.RemoveAll(p)
+	w.Close()
+
+	idxs, err := filepath.Glob(filepath.Join(p, "*"+indexSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idxs) < 2 {
+		t.Fatalf("len(idxs) = %d, want at least %d", len(idxs), 2)
+	}
+	if err = os.Remove(idxs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(idxs[1], []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample(), SegmentSizeBytes: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, _, err = w.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, w, 1, 41, nil)
+
+	if _, err = os.Stat(idxs[0]); err != nil {
+		t.Errorf("expected index %s to be rebuilt, got %v", idxs[0], err)
+	}
+	b, err := ioutil.ReadFile(idxs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (&segmentIndex{}).unmarshal(b); err != nil {
+		t.Errorf("expected index %s to be rebuilt, got %v", idxs[1], err)
+	}
+}
+
+func TestReadRangeReadMode(t *testing.T) {
+	p, w := createRangeWAL(t, 1)
+	defer os.RemoveAll(p)
+	w.Close()
+
+	w, err := OpenForRead(p, NewEmptySnapshot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err = w.ReadRange(1, 2, noLimit); err != ErrDecoderNotFound {
+		t.Errorf("err = %v, want %v", err, ErrDecoderNotFound)
+	}
+}
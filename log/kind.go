@@ -0,0 +1,128 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// UserRecordType is the smallest type of a user-defined record kind;
+	// smaller types are reserved for the records of the WAL itself.
+	UserRecordType RecordType = 1 << 10
+
+	// IgnorableRecordType is set in the type of user-defined record kinds
+	// that readers which do not know the kind may skip. Records of any
+	// other unknown type fail the read.
+	IgnorableRecordType RecordType = 1 << 30
+)
+
+var ErrUnknownRecordType = errors.New("wal: unknown record type")
+
+// RecordKind describes a user-defined kind of record, such as an audit
+// marker or a config change, saved with WAL.SaveRecord.
+type RecordKind struct {
+	// Type identifies the records of the kind. It must not be smaller than
+	// UserRecordType, and may have IgnorableRecordType set.
+	Type RecordType
+	// New returns an empty value to unmarshal the records of the kind into.
+	New func() RecordData
+	// Handle, if set, is called with every record of the kind read back
+	// by ReadAll, Replay, Follow, Verify, ValidSnapshotEntries and Repair,
+	// in WAL order. An error returned by Handle aborts the read.
+	Handle func(data RecordData) error
+}
+
+// RegisterKind registers a user-defined record kind.
+func (r *Registry) RegisterKind(k RecordKind) {
+	if k.Type < UserRecordType || k.New == nil {
+		panic("invalid record kind")
+	}
+	r.kinds.Store(k.Type, k)
+}
+
+func (r *Registry) lookupKind(rt RecordType) (RecordKind, bool) {
+	k, ok := r.kinds.Load(rt)
+	if !ok {
+		return RecordKind{}, false
+	}
+	return k.(RecordKind), true
+}
+
+// RegisterRecordKind registers a user-defined record kind in the default
+// Registry.
+func RegisterRecordKind(k RecordKind) {
+	defaultRegistry.RegisterKind(k)
+}
+
+// IsIgnorable reports whether readers not knowing records of type rt may
+// skip them.
+func (rt RecordType) IsIgnorable() bool {
+	return rt >= UserRecordType && rt&IgnorableRecordType != 0
+}
+
+// readUserRecord decodes rec, which is not one of the WAL's own records,
+// and passes it to the handler of its kind. ok is false if rec is of an
+// unknown ignorable kind and must be skipped.
+func (r *Registry) readUserRecord(rec *walpb.Record) (data RecordData, ok bool, err error) {
+	data, k, ok, err := r.decodeUserRecord(rec)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	if k.Handle != nil {
+		if err = k.Handle(data); err != nil {
+			return nil, false, err
+		}
+	}
+	return data, true, nil
+}
+
+// decodeUserRecord decodes rec like readUserRecord without handling it.
+func (r *Registry) decodeUserRecord(rec *walpb.Record) (data RecordData, k RecordKind, ok bool, err error) {
+	rt := RecordType(rec.Type)
+	k, known := r.lookupKind(rt)
+	if !known {
+		if rt.IsIgnorable() {
+			return nil, k, false, nil
+		}
+		return nil, k, false, errors.Wrapf(ErrUnknownRecordType, "record type %d", rec.Type)
+	}
+	data = k.New()
+	if err = unmarshalRecord(data, rec); err != nil {
+		return nil, k, false, err
+	}
+	return data, k, true, nil
+}
+
+// SaveRecord saves data as a record of the registered user-defined kind,
+// and blocks until it is on stable storage, or written as the durability
+// policy allows.
+func (w *WAL) SaveRecord(kind RecordType, data RecordData) error {
+	if _, ok := w.opts.Registry.lookupKind(kind); !ok {
+		return errors.Wrapf(ErrUnknownRecordType, "record type %d", kind)
+	}
+	b, err := data.Marshal()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	if w.encoder == nil {
+		w.mu.Unlock()
+		return ErrDecoderNotFound
+	}
+	off, _ := w.encoder.position()
+	if err = w.encoder.encode(&walpb.Record{Type: int64(kind), Data: b}); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	seq := w.appended(off, 1)
+	w.mu.Unlock()
+
+	return w.syncTo(seq, false)
+}
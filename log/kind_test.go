@@ -0,0 +1,133 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type auditMarker struct {
+	Who string
+}
+
+func (m *auditMarker) Marshal() ([]byte, error) { return json.Marshal(m) }
+
+func (m *auditMarker) Unmarshal(data []byte) error { return json.Unmarshal(data, m) }
+
+const (
+	auditMarkerType   = UserRecordType + 1
+	unknownIgnorable  = UserRecordType + 2 | IgnorableRecordType
+	unknownRecordType = UserRecordType + 3
+)
+
+func TestSaveRecord(t *testing.T) {
+	var handled []string
+	RegisterRecordKind(RecordKind{
+		Type: auditMarkerType,
+		New:  func() RecordData { return &auditMarker{} },
+		Handle: func(data RecordData) error {
+			handled = append(handled, data.(*auditMarker).Who)
+			return nil
+		},
+	})
+
+	p, w := createRangeWAL(t, 2)
+	defer os.RemoveAll(p)
+	if err := w.SaveRecord(auditMarkerType, &auditMarker{Who: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SaveRecord(unknownRecordType, &auditMarker{}); errors.Cause(err) != ErrUnknownRecordType {
+		t.Errorf("err = %v, want %v", err, ErrUnknownRecordType)
+	}
+	t.Log("CLOSE", w.Close())
+
+	w, err := Open(p, NewEmptySnapshot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var views []RecordView
+	err = w.Replay(func(rec RecordView) error {
+		if rec.Type == auditMarkerType {
+			views = append(views, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 1 || views[0].Record.(*auditMarker).Who != "alice" {
+		t.Errorf("views = %+v, want one audit marker", views)
+	}
+
+	if err = Verify(zap.NewExample(), p, NewEmptySnapshot(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ValidSnapshotEntries(zap.NewExample(), p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 3 {
+		t.Errorf("handled = %v, want %d records", handled, 3)
+	}
+}
+
+// TestUnknownRecordKinds ensures records of unknown kinds are skipped if
+// ignorable, and fail the read otherwise.
+func TestUnknownRecordKinds(t *testing.T) {
+	p, w := createRangeWAL(t, 2)
+	defer os.RemoveAll(p)
+	if err := w.encoder.encode(&walpb.Record{Type: int64(unknownIgnorable), Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Save(&walpb.HardState{Committed: 3}, []LogEntry{&walpb.Entry{Index: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err := Open(p, NewEmptySnapshot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 3 {
+		t.Errorf("len(ents) = %d, want %d", len(ents), 3)
+	}
+	if err = Verify(zap.NewExample(), p, NewEmptySnapshot(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = w.encoder.encode(&walpb.Record{Type: int64(unknownRecordType), Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, NewEmptySnapshot(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = w.ReadAll(); errors.Cause(err) != ErrUnknownRecordType {
+		t.Errorf("err = %v, want %v", err, ErrUnknownRecordType)
+	}
+	w.Close()
+	if err = Verify(zap.NewExample(), p, NewEmptySnapshot(), nil); errors.Cause(err) != ErrUnknownRecordType {
+		t.Errorf("err = %v, want %v", err, ErrUnknownRecordType)
+	}
+	if Repair(zap.NewExample(), p, nil) {
+		t.Errorf("expected repair to fail")
+	}
+}
@@ -0,0 +1,610 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"bytes"
+	"os"
+	"sync"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/pkg/fileutil"
+	"go.etcd.io/etcd/pkg/pbutil"
+)
+
+// MemoryStore holds the records of a MemoryWAL in place of its directory.
+// It outlives the WALs opened on it, so that a MemoryWAL can be closed or
+// crashed with Crash and opened again.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records []walpb.Record
+	synced  int  // number of records on stable storage
+	locked  bool // held by a MemoryWAL in append mode
+	gen     int  // incremented by Crash, which kills the WALs opened before
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Crash simulates a power failure: the records not synced yet are lost,
+// and the MemoryWALs open on s fail every call with os.ErrClosed but Close.
+func (s *MemoryStore) Crash() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = s.records[:s.synced]
+	s.locked = false
+	s.gen++
+}
+
+// Records returns the number of records in s, and how many of them are on
+// stable storage.
+func (s *MemoryStore) Records() (records, synced int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records), s.synced
+}
+
+// unsynced returns the size of the data of the records not synced yet and
+// their number. s.mu must be held.
+func (s *MemoryStore) unsynced() (bytes, records int64) {
+	for _, rec := range s.records[s.synced:] {
+		bytes += int64(len(rec.Data))
+	}
+	return bytes, int64(len(s.records) - s.synced)
+}
+
+var _ WALAPI = &MemoryWAL{}
+
+// MemoryWAL is a WAL keeping its records in a MemoryStore instead of segment
+// files, for tests and ephemeral deployments. It decodes what it reads back
+// like WAL, and matches the semantics of WAL for the snapshot it is opened
+// at, ErrSnapshotNotFound and the read and append modes. Appends are synced
+// as the durability policy of its Options asks, except for SyncInterval,
+// which is only synced by Sync and Close, the worst case of a crash.
+type MemoryWAL struct {
+	store *MemoryStore
+	gen   int
+	opts  *Options
+
+	mu       sync.Mutex
+	reading  bool // opened and not read out yet
+	write    bool // appends are allowed once read out
+	closed   bool
+	start    Snapshot  // snapshot to start reading
+	metadata []byte    // metadata recorded at the head of the WAL
+	state    HardState // last state saved
+	enti     uint64    // index of the last entry saved
+
+	durability   DurabilityPolicy
+	unsafeNoSync bool
+	parked       []memoryFuture // futures of AppendAsync waiting for a sync
+}
+
+// memoryFuture resolves f once the first records of the store are synced.
+type memoryFuture struct {
+	records int
+	f       *SyncFuture
+}
+
+// CreateMemory creates a MemoryWAL on the empty store s, ready for appending
+// records. It fails with os.ErrExist if s holds records already.
+func CreateMemory(s *MemoryStore, metadata []byte, opts *Options) (*MemoryWAL, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.records) != 0 {
+		return nil, os.ErrExist
+	}
+
+	s.records = append(s.records,
+		walpb.Record{Type: int64(MetadataType), Data: metadata},
+		walpb.Record{Type: int64(SnapshotType), Data: pbutil.MustMarshal(opts.Registry.NewSnapshot())},
+	)
+	s.synced = len(s.records)
+	s.locked = true
+	return &MemoryWAL{
+		store:        s,
+		gen:          s.gen,
+		opts:         opts,
+		write:        true,
+		start:        opts.Registry.NewSnapshot(),
+		metadata:     metadata,
+		state:        opts.Registry.NewState(),
+		durability:   opts.Durability,
+		unsafeNoSync: opts.UnsafeNoFsync,
+	}, nil
+}
+
+// OpenMemory opens the MemoryWAL of s at the given snap, like Open. It
+// fails with fileutil.ErrLocked while another MemoryWAL of s is open for
+// appending, and with ErrFileNotFound if s is empty.
+func OpenMemory(s *MemoryStore, snap Snapshot, opts *Options) (*MemoryWAL, error) {
+	return openMemory(s, snap, true, opts)
+}
+
+// OpenMemoryForRead opens the MemoryWAL of s at the given snap for reading
+// only, like OpenForRead.
+func OpenMemoryForRead(s *MemoryStore, snap Snapshot, opts *Options) (*MemoryWAL, error) {
+	return openMemory(s, snap, false, opts)
+}
+
+func openMemory(s *MemoryStore, snap Snapshot, write bool, opts *Options) (*MemoryWAL, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.records) == 0 {
+		return nil, ErrFileNotFound
+	}
+	if write {
+		if s.locked {
+			return nil, fileutil.ErrLocked
+		}
+		s.locked = true
+	}
+	return &MemoryWAL{
+		store:        s,
+		gen:          s.gen,
+		opts:         opts,
+		reading:      true,
+		write:        write,
+		start:        snap,
+		state:        opts.Registry.NewState(),
+		durability:   opts.Durability,
+		unsafeNoSync: opts.UnsafeNoFsync,
+	}, nil
+}
+
+// SetDurability replaces the durability policy of the WAL.
+func (w *MemoryWAL) SetDurability(p DurabilityPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.durability = p
+	return nil
+}
+
+func (w *MemoryWAL) SetUnsafeNoFsync() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.unsafeNoSync = true
+}
+
+// appendable returns ErrDecoderNotFound unless the WAL is read out in
+// append mode. w.mu must be held.
+func (w *MemoryWAL) appendable() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	if !w.write || w.reading {
+		return ErrDecoderNotFound
+	}
+	return nil
+}
+
+// append adds recs to the store, and syncs them if force is set or the
+// durability policy asks for it. w.mu must be held.
+func (w *MemoryWAL) append(force bool, recs ...walpb.Record) error {
+	s := w.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen != w.gen {
+		return os.ErrClosed
+	}
+	s.records = append(s.records, recs...)
+	if w.unsafeNoSync {
+		return nil
+	}
+	if force || w.durability.syncDue(s.unsynced()) {
+		s.synced = len(s.records)
+		w.unpark(false)
+	}
+	return nil
+}
+
+// park resolves f once the records in the store are synced. w.mu and
+// w.store.mu must be held.
+func (w *MemoryWAL) park(f *SyncFuture) {
+	w.parked = append(w.parked, memoryFuture{records: len(w.store.records), f: f})
+	w.unpark(false)
+}
+
+// unpark resolves the parked futures whose records are synced, or every
+// one if all is set. w.mu and w.store.mu must be held.
+func (w *MemoryWAL) unpark(all bool) {
+	s := w.store
+	parked := w.parked[:0]
+	for _, p := range w.parked {
+		switch {
+		case s.gen != w.gen:
+			p.f.resolve(os.ErrClosed)
+		case all || s.synced >= p.records || w.unsafeNoSync:
+			p.f.resolve(nil)
+		default:
+			parked = append(parked, p)
+		}
+	}
+	w.parked = parked
+}
+
+// Save saves ents and st, and blocks until they are on stable storage, or
+// only added to the store as the durability policy allows.
+func (w *MemoryWAL) Save(st HardState, ents []LogEntry) error {
+	if len(ents) == 0 && st.GetCommitted() == 0 {
+		return nil
+	}
+	return w.commit(st, ents, nil)
+}
+
+// SaveState saves st, and blocks until it is on stable storage.
+func (w *MemoryWAL) SaveState(st HardState) error {
+	w.mu.Lock()
+	unchanged := st.GetCommitted() == 0 || st.GetCommitted() == w.state.GetCommitted()
+	w.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	return w.commit(st, nil, nil)
+}
+
+// SaveEntry saves ents, and blocks until they are on stable storage.
+func (w *MemoryWAL) SaveEntry(ents []LogEntry) error {
+	if len(ents) == 0 {
+		return nil
+	}
+	return w.commit(nil, ents, nil)
+}
+
+// AppendAsync saves st and ents. The returned SyncFuture resolves once they
+// are synced, as the durability policy, Sync or Close sync them. The
+// futures of records lost to a Crash fail with os.ErrClosed on Close.
+func (w *MemoryWAL) AppendAsync(st HardState, ents []LogEntry) (*SyncFuture, error) {
+	f := newSyncFuture()
+	if len(ents) == 0 && (st == nil || st.GetCommitted() == 0) {
+		f.resolve(nil)
+		return f, nil
+	}
+	if err := w.commit(st, ents, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// commit saves st and ents, and parks f, if not nil, until they are synced.
+func (w *MemoryWAL) commit(st HardState, ents []LogEntry, f *SyncFuture) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.appendable(); err != nil {
+		return err
+	}
+
+	recs := make([]walpb.Record, 0, len(ents)+1)
+	for _, e := range ents {
+		recs = append(recs, walpb.Record{Type: int64(EntryType), Data: pbutil.MustMarshal(e)})
+	}
+	if st != nil && st.GetCommitted() != 0 {
+		recs = append(recs, walpb.Record{Type: int64(StateType), Data: pbutil.MustMarshal(st)})
+	}
+	if err := w.append(false, recs...); err != nil {
+		return err
+	}
+	if f != nil {
+		w.store.mu.Lock()
+		w.park(f)
+		w.store.mu.Unlock()
+	}
+	if len(ents) != 0 {
+		w.enti = ents[len(ents)-1].GetIndex()
+	}
+	if st != nil && st.GetCommitted() != 0 {
+		w.state = st
+	}
+	return nil
+}
+
+// SaveSnapshot saves e, and blocks until it is on stable storage.
+func (w *MemoryWAL) SaveSnapshot(e Snapshot) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.appendable(); err != nil {
+		return err
+	}
+	if err := w.append(true, walpb.Record{Type: int64(SnapshotType), Data: pbutil.MustMarshal(e)}); err != nil {
+		return err
+	}
+	// update enti only when snapshot is ahead of last index
+	if w.enti < e.GetIndex() {
+		w.enti = e.GetIndex()
+	}
+	return nil
+}
+
+// TruncateAfter discards every entry with an index larger than index, as
+// WAL.TruncateAfter does.
+func (w *MemoryWAL) TruncateAfter(index uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.appendable(); err != nil {
+		return err
+	}
+	if index < w.state.GetCommitted() {
+		return ErrTruncateCommitted
+	}
+	if index >= w.enti {
+		// nothing to discard
+		return nil
+	}
+	if err := w.append(true, walpb.Record{Type: int64(TruncateType), Data: encodeTruncate(index)}); err != nil {
+		return err
+	}
+	w.enti = index
+	return nil
+}
+
+// SaveRecord saves data as a record of the registered user-defined kind.
+func (w *MemoryWAL) SaveRecord(kind RecordType, data RecordData) error {
+	if _, ok := w.opts.Registry.lookupKind(kind); !ok {
+		return errors.Wrapf(ErrUnknownRecordType, "record type %d", kind)
+	}
+	b, err := data.Marshal()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err = w.appendable(); err != nil {
+		return err
+	}
+	return w.append(false, walpb.Record{Type: int64(kind), Data: b})
+}
+
+// Sync makes every record saved so far stable, whatever the durability
+// policy.
+func (w *MemoryWAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	return w.append(true)
+}
+
+// ReleaseLockTo does nothing: the MemoryWAL keeps every record, as WAL
+// keeps the segments it releases on disk.
+func (w *MemoryWAL) ReleaseLockTo(index uint64) error {
+	return nil
+}
+
+// ReadAll reads out the records of the WAL, as WAL.ReadAll does.
+func (w *MemoryWAL) ReadAll() (metadata []byte, state HardState, ents []LogEntry, err error) {
+	w.mu.Lock()
+	startIndex := w.start.GetIndex()
+	w.mu.Unlock()
+	return readAll(w.opts.Registry, startIndex, w.Replay)
+}
+
+// records returns the records of the store. w.mu must be held.
+func (w *MemoryWAL) records() ([]walpb.Record, error) {
+	s := w.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen != w.gen {
+		return nil, os.ErrClosed
+	}
+	return s.records[:len(s.records):len(s.records)], nil
+}
+
+// Replay streams the records of the WAL to fn, as WAL.Replay does.
+func (w *MemoryWAL) Replay(fn func(rec RecordView) error) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if !w.reading {
+		return ErrDecoderNotFound
+	}
+	recs, err := w.records()
+	if err != nil {
+		return err
+	}
+
+	var (
+		metadata []byte
+		match    bool
+		stopped  bool
+	)
+	reg := w.opts.Registry
+	state := reg.NewState()
+
+	deliver := func(view RecordView) error {
+		if stopped {
+			return nil
+		}
+		if ferr := fn(view); ferr != nil {
+			if ferr != ErrStopReplay {
+				return ferr
+			}
+			stopped = true
+		}
+		return nil
+	}
+
+	for i := range recs {
+		rec := &recs[i]
+		switch rec.Type {
+		case int64(EntryType):
+			e := reg.NewEntry()
+			if err = unmarshalRecord(e, rec); err != nil {
+				return err
+			}
+			if e.GetIndex() > w.start.GetIndex() {
+				err = deliver(RecordView{Type: EntryType, Entry: e})
+			}
+			w.enti = e.GetIndex()
+
+		case int64(StateType):
+			s := reg.NewState()
+			if err = unmarshalRecord(s, rec); err != nil {
+				return err
+			}
+			state = s
+			err = deliver(RecordView{Type: StateType, State: s})
+
+		case int64(TruncateType):
+			var index uint64
+			if index, err = decodeTruncate(rec.Data); err != nil {
+				return err
+			}
+			if index < w.start.GetIndex() {
+				// the snap was taken past the truncation
+				match = false
+			}
+			if index < w.enti {
+				w.enti = index
+			}
+			err = deliver(RecordView{Type: TruncateType, Index: index})
+
+		case int64(MetadataType):
+			if metadata != nil && !bytes.Equal(metadata, rec.Data) {
+				return ErrMetadataConflict
+			}
+			if metadata == nil {
+				err = deliver(RecordView{Type: MetadataType, Metadata: rec.Data})
+			}
+			metadata = rec.Data
+
+		case int64(SnapshotType):
+			snap := reg.NewSnapshot()
+			if err = unmarshalRecord(snap, rec); err != nil {
+				return err
+			}
+			if snap.GetIndex() == w.start.GetIndex() {
+				match = true
+			}
+			err = deliver(RecordView{Type: SnapshotType, Snapshot: snap})
+
+		default:
+			var (
+				data RecordData
+				ok   bool
+			)
+			if data, ok, err = reg.readUserRecord(rec); err == nil && ok {
+				err = deliver(RecordView{Type: RecordType(rec.Type), Record: data})
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if stopped && !w.write {
+			break
+		}
+	}
+
+	w.reading = false
+	w.start = reg.NewSnapshot()
+	w.metadata = metadata
+	w.state = state
+	if !match {
+		return ErrSnapshotNotFound
+	}
+	return nil
+}
+
+// ReadRange returns the entries in the range [lo, hi), as WAL.ReadRange
+// does.
+func (w *MemoryWAL) ReadRange(lo, hi, maxBytes uint64) ([]LogEntry, error) {
+	if lo >= hi {
+		return nil, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.appendable(); err != nil {
+		return nil, err
+	}
+	recs, err := w.records()
+	if err != nil {
+		return nil, err
+	}
+
+	// the entries of the log, each overwriting those from its index on
+	var ents []LogEntry
+	for i := range recs {
+		switch recs[i].Type {
+		case int64(EntryType):
+			e := w.opts.Registry.NewEntry()
+			if err = unmarshalRecord(e, &recs[i]); err != nil {
+				return nil, err
+			}
+			n := len(ents)
+			for n > 0 && ents[n-1].GetIndex() >= e.GetIndex() {
+				n--
+			}
+			ents = append(ents[:n], e)
+		case int64(TruncateType):
+			index, err := decodeTruncate(recs[i].Data)
+			if err != nil {
+				return nil, err
+			}
+			n := len(ents)
+			for n > 0 && ents[n-1].GetIndex() > index {
+				n--
+			}
+			ents = ents[:n]
+		}
+	}
+
+	for i, e := range ents {
+		if e.GetIndex() != lo {
+			continue
+		}
+		j := i
+		for j < len(ents) && ents[j].GetIndex() < hi {
+			j++
+		}
+		return limitEntriesSize(ents[i:j], maxBytes), nil
+	}
+	return nil, ErrRangeUnavailable
+}
+
+// Close makes every record saved stable and releases the store for the
+// next MemoryWAL opened for appending. Closing a WAL killed by
+// MemoryStore.Crash does nothing.
+func (w *MemoryWAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	s := w.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer w.unpark(true)
+	if s.gen != w.gen {
+		return nil
+	}
+	if w.write {
+		if !w.unsafeNoSync {
+			s.synced = len(s.records)
+		}
+		s.locked = false
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"go.etcd.io/etcd/pkg/fileutil"
+)
+
+// writeWAL saves the same records to w whatever its backend.
+func writeWAL(t *testing.T, w WALAPI) {
+	for i := uint64(1); i <= 10; i++ {
+		if err := w.Save(&walpb.HardState{Committed: i - 1}, []LogEntry{&walpb.Entry{Index: i, Data: []byte{byte(i)}}}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 5 {
+			if err := w.SaveSnapshot(&walpb.Snapshot{Index: 5}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.TruncateAfter(9); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SaveEntry([]LogEntry{&walpb.Entry{Index: 10, Data: []byte("new")}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type readResult struct {
+	Metadata []byte
+	State    HardState
+	Ents     []LogEntry
+	Err      error
+	Range    []LogEntry
+}
+
+func readWAL(w WALAPI) readResult {
+	var r readResult
+	r.Metadata, r.State, r.Ents, r.Err = w.ReadAll()
+	r.Range, _ = w.ReadRange(3, 11, 1<<20)
+	return r
+}
+
+// TestMemoryWALMatchesWAL ensures that a MemoryWAL reads back what a WAL
+// does from the same records, at each snapshot.
+func TestMemoryWALMatchesWAL(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	dir := filepath.Join(p, "wal")
+
+	w, err := Create(dir, []byte("metadata"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeWAL(t, w)
+	w.Close()
+
+	s := NewMemoryStore()
+	mw, err := CreateMemory(s, []byte("metadata"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeWAL(t, mw)
+	mw.Close()
+
+	for _, index := range []uint64{0, 5, 7} {
+		w, err := Open(dir, &walpb.Snapshot{Index: index}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := readWAL(w)
+		w.Close()
+
+		mw, err := OpenMemory(s, &walpb.Snapshot{Index: index}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readWAL(mw)
+		mw.Close()
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("snap %d: read %+v, want %+v", index, got, want)
+		}
+	}
+}
+
+func TestMemoryWALCrash(t *testing.T) {
+	s := NewMemoryStore()
+	w, err := CreateMemory(s, nil, &Options{Durability: DurabilityPolicy{Mode: SyncNever}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateMemory(s, nil, nil); err != os.ErrExist {
+		t.Fatalf("err = %v, want %v", err, os.ErrExist)
+	}
+	if _, err = OpenMemory(s, NewEmptySnapshot(), nil); err != fileutil.ErrLocked {
+		t.Fatalf("err = %v, want %v", err, fileutil.ErrLocked)
+	}
+
+	for i := uint64(1); i <= 10; i++ {
+		if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: i}}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 6 {
+			if err = w.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if records, synced := s.Records(); records != 12 || synced != 8 {
+		t.Fatalf("records = %d, synced %d, want 12, synced 8", records, synced)
+	}
+
+	f, err := w.AppendAsync(nil, []LogEntry{&walpb.Entry{Index: 11}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-f.Done():
+		t.Fatal("future resolved before its entry is synced")
+	default:
+	}
+
+	s.Crash()
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 12}}); err != os.ErrClosed {
+		t.Fatalf("save after crash: err = %v, want %v", err, os.ErrClosed)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Wait(); err != os.ErrClosed {
+		t.Fatalf("future of a lost entry: err = %v, want %v", err, os.ErrClosed)
+	}
+
+	w, err = OpenMemory(s, NewEmptySnapshot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 7}}); err != ErrDecoderNotFound {
+		t.Fatalf("save before ReadAll: err = %v, want %v", err, ErrDecoderNotFound)
+	}
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 6 || ents[5].GetIndex() != 6 {
+		t.Fatalf("recovered %d entries, want the 6 synced", len(ents))
+	}
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 7}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryWALSnapshotNotFound(t *testing.T) {
+	s := NewMemoryStore()
+	w, err := CreateMemory(s, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: 1}, &walpb.Entry{Index: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	r, err := OpenMemoryForRead(s, &walpb.Snapshot{Index: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, _, ents, err := r.ReadAll()
+	if err != ErrSnapshotNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrSnapshotNotFound)
+	}
+	if len(ents) != 1 {
+		t.Fatalf("len(ents) = %d, want 1", len(ents))
+	}
+	if err = r.SaveEntry([]LogEntry{&walpb.Entry{Index: 3}}); err != ErrDecoderNotFound {
+		t.Fatalf("save in read mode: err = %v, want %v", err, ErrDecoderNotFound)
+	}
+}
@@ -14,29 +14,320 @@
 
 package log
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrMetricsInUse is returned by Create and Open for a WAL configured with
+// a Registerer or ConstLabels whose gauges are held by another open WAL.
+var ErrMetricsInUse = errors.New("wal: metrics in use by an open WAL, set distinct ConstLabels")
+
+// metrics are the Prometheus collectors of a WAL. WALs registering their
+// metrics with the same Registerer and constant labels share them, but for
+// the gauges of the state of a WAL, which one open WAL holds at a time.
+type metrics struct {
+	fsyncSec        prometheus.Histogram
+	writeBytes      prometheus.Gauge
+	commitBatchSize prometheus.Histogram
+	unsyncedBytes   prometheus.Gauge
+	unsyncedRecords prometheus.Gauge
+	purgedSegments  prometheus.Counter
+	purgedBytes     prometheus.Counter
+	appendedRecords *prometheus.CounterVec
+	appendedBytes   *prometheus.CounterVec
+	segments        prometheus.Gauge
+	cutSec          prometheus.Histogram
+	lastIndex       prometheus.Gauge
+	repairs         prometheus.Counter
+
+	registered bool
+}
 
 var (
-	walFsyncSec = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Namespace: "wal",
-		Subsystem: "disk",
-		Name:      "wal_fsync_duration_seconds",
-		Help:      "The latency distributions of fsync called by WAL.",
-
-		// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
-		// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
-		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
-	})
+	// discardMetrics are registered nowhere, for the encoders and WALs
+	// built without Options.
+	discardMetrics, _ = newMetrics(nil, nil)
 
-	walWriteBytes = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "wal",
-		Subsystem: "disk",
-		Name:      "wal_write_bytes_total",
-		Help:      "Total number of bytes written in WAL.",
-	})
+	defaultMetricsOnce sync.Once
+	defaultMetrics     *metrics
+
+	heldMu sync.Mutex
+	// held are the registered gauges of the open WALs, by their segments
+	// gauge.
+	held = make(map[prometheus.Gauge]bool)
 )
 
-func init() {
-	prometheus.MustRegister(walFsyncSec)
-	prometheus.MustRegister(walWriteBytes)
+// packageMetrics returns the metrics registered with the default
+// Prometheus registerer on first use, shared by the WALs, purges,
+// migrations and repairs configured with no ConstLabels and either no
+// Registerer or the default one.
+func packageMetrics() *metrics {
+	defaultMetricsOnce.Do(func() {
+		m, err := newMetrics(prometheus.DefaultRegisterer, nil)
+		if err != nil {
+			m = discardMetrics
+		}
+		defaultMetrics = m
+	})
+	return defaultMetrics
+}
+
+// metrics returns the metrics of the WAL configured by opts.
+func (opts *Options) metrics() (*metrics, error) {
+	if len(opts.ConstLabels) == 0 && (opts.Registerer == nil || opts.Registerer == prometheus.DefaultRegisterer) {
+		return packageMetrics(), nil
+	}
+	reg := opts.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return newMetrics(reg, opts.ConstLabels)
+}
+
+// newMetrics returns the metrics labeled with labels, registered with reg
+// unless it is nil. Metrics registered with reg before under the same
+// labels are returned in place of new ones.
+func newMetrics(reg prometheus.Registerer, labels prometheus.Labels) (*metrics, error) {
+	r := &registerer{reg: reg, labels: labels}
+	m := &metrics{
+		fsyncSec: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_fsync_duration_seconds",
+			Help:      "The latency distributions of fsync called by WAL.",
+
+			// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
+			// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+
+		writeBytes: r.gauge(prometheus.GaugeOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_write_bytes_total",
+			Help:      "Total number of bytes written in WAL.",
+		}),
+
+		commitBatchSize: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_commit_batch_size",
+			Help:      "The number of appends group committed by a single sync.",
+
+			// lowest bucket start of upper bound 1 with factor 2
+			// highest bucket start of 1 * 2^9 == 512
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+
+		unsyncedBytes: r.gauge(prometheus.GaugeOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_unsynced_bytes",
+			Help:      "The number of bytes appended to the WAL but not synced yet.",
+		}),
+
+		unsyncedRecords: r.gauge(prometheus.GaugeOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_unsynced_records",
+			Help:      "The number of records appended to the WAL but not synced yet.",
+		}),
+
+		purgedSegments: r.counter(prometheus.CounterOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_purged_segments_total",
+			Help:      "Total number of WAL segments removed by purging.",
+		}),
+
+		purgedBytes: r.counter(prometheus.CounterOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_purged_bytes_total",
+			Help:      "Total number of bytes of WAL segments removed by purging.",
+		}),
+
+		appendedRecords: r.counterVec(prometheus.CounterOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_appended_records_total",
+			Help:      "Total number of records appended to the WAL by record type.",
+		}, "type"),
+
+		appendedBytes: r.counterVec(prometheus.CounterOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_appended_bytes_total",
+			Help:      "Total number of bytes of the records appended to the WAL by record type.",
+		}, "type"),
+
+		segments: r.gauge(prometheus.GaugeOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_segments",
+			Help:      "The number of segments held by the WAL.",
+		}),
+
+		cutSec: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_cut_duration_seconds",
+			Help:      "The latency distributions of cutting a new WAL segment.",
+
+			// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
+			// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+
+		lastIndex: r.gauge(prometheus.GaugeOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_last_index",
+			Help:      "The index of the last entry saved to the WAL.",
+		}),
+
+		repairs: r.counter(prometheus.CounterOpts{
+			Namespace: "wal",
+			Subsystem: "disk",
+			Name:      "wal_repairs_total",
+			Help:      "Total number of torn WAL tails and corrupted WALs repaired.",
+		}),
+	}
+	if r.err != nil {
+		return nil, errors.Wrap(r.err, "wal: failed to register metrics")
+	}
+	m.registered = reg != nil
+	return m, nil
+}
+
+// hold claims the gauges of the state of a WAL, its segments, last index
+// and unsynced appends, for an open WAL. If another WAL holds them, hold
+// fails with ErrMetricsInUse, but for the metrics of packageMetrics: those
+// are returned with gauges registered nowhere, so the default metrics
+// export the state of the first WAL open only. ok reports whether the
+// returned metrics hold their gauges, to be released with unhold.
+func (m *metrics) hold() (hm *metrics, ok bool, err error) {
+	if !m.registered {
+		return m, false, nil
+	}
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	if !held[m.segments] {
+		held[m.segments] = true
+		return m, true, nil
+	}
+	if m != packageMetrics() {
+		return nil, false, ErrMetricsInUse
+	}
+	hm = new(metrics)
+	*hm = *m
+	hm.segments = discardMetrics.segments
+	hm.lastIndex = discardMetrics.lastIndex
+	hm.unsyncedBytes = discardMetrics.unsyncedBytes
+	hm.unsyncedRecords = discardMetrics.unsyncedRecords
+	hm.registered = false
+	return hm, false, nil
+}
+
+// unhold releases the gauges claimed by hold.
+func (m *metrics) unhold() {
+	if !m.registered {
+		return
+	}
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	delete(held, m.segments)
+}
+
+// appended accounts for a record of type rt encoded into n bytes.
+func (m *metrics) appended(rt int64, n int) {
+	label := recordTypeLabel(rt)
+	m.appendedRecords.WithLabelValues(label).Inc()
+	m.appendedBytes.WithLabelValues(label).Add(float64(n))
+}
+
+// recordTypeLabel returns the value of the type label of records of type
+// rt. The user-defined kinds share a single value, to bound the number of
+// series.
+func recordTypeLabel(rt int64) string {
+	switch RecordType(rt) {
+	case MetadataType:
+		return "metadata"
+	case EntryType:
+		return "entry"
+	case StateType:
+		return "state"
+	case CrcType:
+		return "crc"
+	case SnapshotType:
+		return "snapshot"
+	case TruncateType:
+		return "truncate"
+	}
+	if RecordType(rt) >= UserRecordType {
+		return "user"
+	}
+	return strconv.FormatInt(rt, 10)
+}
+
+// registerer creates collectors with constant labels and registers them,
+// keeping the first registration error.
+type registerer struct {
+	reg    prometheus.Registerer
+	labels prometheus.Labels
+	err    error
+}
+
+// register registers c, and returns the equal collector registered before
+// in its place, if any.
+func (r *registerer) register(c prometheus.Collector) prometheus.Collector {
+	if r.reg == nil || r.err != nil {
+		return c
+	}
+	err := r.reg.Register(c)
+	if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return are.ExistingCollector
+	}
+	r.err = err
+	return c
+}
+
+func (r *registerer) histogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	opts.ConstLabels = r.labels
+	h := prometheus.NewHistogram(opts)
+	if c, ok := r.register(h).(prometheus.Histogram); ok {
+		return c
+	}
+	return h
+}
+
+func (r *registerer) gauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	opts.ConstLabels = r.labels
+	g := prometheus.NewGauge(opts)
+	if c, ok := r.register(g).(prometheus.Gauge); ok {
+		return c
+	}
+	return g
+}
+
+func (r *registerer) counter(opts prometheus.CounterOpts) prometheus.Counter {
+	opts.ConstLabels = r.labels
+	c := prometheus.NewCounter(opts)
+	if rc, ok := r.register(c).(prometheus.Counter); ok {
+		return rc
+	}
+	return c
+}
+
+func (r *registerer) counterVec(opts prometheus.CounterOpts, labelNames ...string) *prometheus.CounterVec {
+	opts.ConstLabels = r.labels
+	c := prometheus.NewCounterVec(opts, labelNames)
+	if rc, ok := r.register(c).(*prometheus.CounterVec); ok {
+		return rc
+	}
+	return c
 }
@@ -0,0 +1,236 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRegisterer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	open := func(name string) (*WAL, string) {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := Create(p, nil, &Options{
+			SegmentSizeBytes: 2048,
+			Registerer:       reg,
+			ConstLabels:      prometheus.Labels{"wal": name},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w, p
+	}
+	wa, pa := open("a")
+	defer os.RemoveAll(pa)
+	wb, pb := open("b")
+	defer os.RemoveAll(pb)
+	defer wb.Close()
+
+	for _, es := range makeEnts(200) {
+		if err := wa.Save(&walpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := testutil.ToFloat64(wa.metrics.appendedRecords.WithLabelValues("entry")); n != 200 {
+		t.Errorf("a: entries appended = %v, want 200", n)
+	}
+	if n := testutil.ToFloat64(wb.metrics.appendedRecords.WithLabelValues("entry")); n != 0 {
+		t.Errorf("b: entries appended = %v, want 0", n)
+	}
+	if n := testutil.ToFloat64(wa.metrics.appendedBytes.WithLabelValues("entry")); n == 0 {
+		t.Error("a: no entry bytes appended")
+	}
+	if n := testutil.ToFloat64(wa.metrics.lastIndex); n != 200 {
+		t.Errorf("a: last index = %v, want 200", n)
+	}
+	if n := testutil.ToFloat64(wa.metrics.segments); n != float64(len(wa.locks)) || n < 2 {
+		t.Errorf("a: segments = %v, want %d", n, len(wa.locks))
+	}
+	if n := testutil.ToFloat64(wb.metrics.segments); n != 1 {
+		t.Errorf("b: segments = %v, want 1", n)
+	}
+	if n, err := testutil.GatherAndCount(reg, "wal_disk_wal_last_index", "wal_disk_wal_cut_duration_seconds"); err != nil || n != 4 {
+		t.Errorf("series = %d, %v, want 4", n, err)
+	}
+
+	// reopening with the same labels shares the metrics
+	wa.Close()
+	w, err := Open(pa, &walpb.Snapshot{}, &Options{Registerer: reg, ConstLabels: prometheus.Labels{"wal": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.metrics.appendedRecords != wa.metrics.appendedRecords {
+		t.Error("reopened WAL does not share the metrics of its labels")
+	}
+}
+
+func TestMetricsInvalidLabels(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	// "type" is the variable label of the appended records
+	opts := &Options{Registerer: prometheus.NewRegistry(), ConstLabels: prometheus.Labels{"type": "x"}}
+	if _, err = Create(p, nil, opts); err == nil {
+		t.Fatal("expected an error registering the metrics")
+	}
+	if exist(OSFS, p) {
+		t.Error("WAL created despite the error")
+	}
+}
+
+func TestMetricsRepair(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	opts := &Options{Registerer: prometheus.NewRegistry()}
+	w, err := Create(p, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, es := range makeEnts(10) {
+		if err = w.Save(&walpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offset, err := w.tail().Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	f, err := openLast(opts.Logger, OSFS, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(offset - 4); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err = RepairTail(nil, p, opts); err != nil {
+		t.Fatal(err)
+	}
+	m, err := opts.metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(m.repairs); n != 1 {
+		t.Errorf("repairs = %v, want 1", n)
+	}
+}
+
+func TestMetricsInUse(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	opts := &Options{Registerer: reg, ConstLabels: prometheus.Labels{"wal": "a"}}
+	pa, wa := createRangeWAL(t, 0)
+	defer os.RemoveAll(pa)
+	wa.Close()
+	wa, err := Open(pa, &walpb.Snapshot{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the gauges of the labels are held by wa
+	pb, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pb)
+	if _, err = Create(pb, nil, opts); err != ErrMetricsInUse {
+		t.Fatalf("err = %v, want %v", err, ErrMetricsInUse)
+	}
+	if exist(OSFS, pb) {
+		t.Error("WAL created despite the error")
+	}
+	wa.Close()
+	wb, err := Create(pb, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb.Close()
+
+	// the WALs without a Registerer nor ConstLabels do not fail, only the
+	// first one open exports its gauges
+	w1, err := Open(pa, &walpb.Snapshot{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w1.Close()
+	w2, err := Open(pb, &walpb.Snapshot{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	if m := packageMetrics(); w2.metrics.segments == m.segments || w2.metrics.fsyncSec != m.fsyncSec {
+		t.Error("default WALs share the gauges of their state, or not their other metrics")
+	}
+}
+
+// TestMetricsDefaultRegisterer ensures WALs given the default Registerer
+// and no ConstLabels share the metrics as WALs given no Registerer do.
+func TestMetricsDefaultRegisterer(t *testing.T) {
+	opts := &Options{Registerer: prometheus.DefaultRegisterer}
+	var ws []*WAL
+	for i := 0; i < 3; i++ {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(p)
+		o := opts
+		if i == 2 {
+			o = nil
+		}
+		w, err := Create(p, nil, o)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		defer w.Close()
+		ws = append(ws, w)
+	}
+	m := packageMetrics()
+	for i, w := range ws[1:] {
+		if w.metrics.segments == m.segments || w.metrics.fsyncSec != m.fsyncSec {
+			t.Errorf("#%d: WAL shares the gauges of its state, or not its other metrics", i+1)
+		}
+	}
+}
+
+func TestMetricsPurge(t *testing.T) {
+	p, w := createRangeWAL(t, 100)
+	defer os.RemoveAll(p)
+	w.Close()
+
+	opts := &Options{Registerer: prometheus.NewRegistry()}
+	removed, err := PurgeSegments(nil, p, 60, PurgePolicy{MaxSegments: 1}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := opts.metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(m.purgedSegments); n == 0 || n != float64(len(removed)) {
+		t.Errorf("purged segments = %v, want %d", n, len(removed))
+	}
+}
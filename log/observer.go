@@ -0,0 +1,82 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import "time"
+
+// Observer is notified of the lifecycle events of a WAL, for alerting,
+// auditing or test assertions. Its methods are called synchronously by the
+// goroutine causing the event, possibly with the locks of the WAL held, so
+// they must return quickly and must not call back into the WAL. Embed
+// NopObserver to handle only some of the events.
+type Observer interface {
+	// SegmentCut is called once a new tail segment is in place.
+	SegmentCut(e SegmentCutEvent)
+	// Synced is called after every successful fdatasync of a segment.
+	Synced(e SyncEvent)
+	// SlowSync is called after an fdatasync taking longer than expected,
+	// whether it failed or not.
+	SlowSync(e SlowSyncEvent)
+	// LocksReleased is called when ReleaseLockTo unlocks segments.
+	LocksReleased(e LocksReleasedEvent)
+	// Repaired is called when a repair truncates a torn segment tail, or
+	// cuts a corrupted WAL before its first bad record.
+	Repaired(e RepairEvent)
+}
+
+// SegmentCutEvent reports the cut of a new segment.
+type SegmentCutEvent struct {
+	OldPath string // the segment completed by the cut
+	NewPath string // the new tail segment
+	Index   uint64 // the index the new segment is named after, of its first entry
+}
+
+// SyncEvent reports a completed fdatasync.
+type SyncEvent struct {
+	Path string
+	Took time.Duration
+}
+
+// SlowSyncEvent reports an fdatasync taking longer than Expected.
+type SlowSyncEvent struct {
+	Path     string
+	Took     time.Duration
+	Expected time.Duration
+	Err      error // the error of the fdatasync, if any
+}
+
+// LocksReleasedEvent reports the segments unlocked by ReleaseLockTo.
+type LocksReleasedEvent struct {
+	Index uint64   // the index ReleaseLockTo was called with
+	Paths []string // the segments unlocked, in order
+}
+
+// RepairEvent reports the truncation of a torn segment tail, or the cut of
+// a corrupted WAL by ApplyRepairPlan.
+type RepairEvent struct {
+	Path           string // the repaired segment, holding the first bad record
+	BrokenPath     string // the copy of the segment taken before truncating it
+	TruncatedBytes int64  // the bytes cut off, with those of the segments quarantined
+	// QuarantineDir holds the original segments and the manifest of a cut
+	// by ApplyRepairPlan, and LastGoodIndex is the index of the last entry
+	// it kept. Both are unset for a torn tail.
+	QuarantineDir string
+	LastGoodIndex uint64
+}
+
+// NopObserver is an Observer ignoring every event.
+type NopObserver struct{}
+
+func (NopObserver) SegmentCut(SegmentCutEvent) {}
+
+func (NopObserver) Synced(SyncEvent) {}
+
+func (NopObserver) SlowSync(SlowSyncEvent) {}
+
+func (NopObserver) LocksReleased(LocksReleasedEvent) {}
+
+func (NopObserver) Repaired(RepairEvent) {}
@@ -0,0 +1,138 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+)
+
+// recordingObserver records the events of a WAL.
+type recordingObserver struct {
+	NopObserver
+
+	mu       sync.Mutex
+	cuts     []SegmentCutEvent
+	syncs    int
+	releases []LocksReleasedEvent
+	repairs  []RepairEvent
+}
+
+func (o *recordingObserver) SegmentCut(e SegmentCutEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cuts = append(o.cuts, e)
+}
+
+func (o *recordingObserver) Synced(SyncEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.syncs++
+}
+
+func (o *recordingObserver) LocksReleased(e LocksReleasedEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.releases = append(o.releases, e)
+}
+
+func (o *recordingObserver) Repaired(e RepairEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.repairs = append(o.repairs, e)
+}
+
+func TestObserver(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	o := &recordingObserver{}
+	w, err := Create(p, nil, &Options{Observer: o})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for i := uint64(1); i <= 3; i++ {
+		if err = w.Save(&walpb.HardState{}, []LogEntry{&walpb.Entry{Index: i}}); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.cut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wcuts := []SegmentCutEvent{
+		{OldPath: filepath.Join(p, walName(0, 0)), NewPath: filepath.Join(p, walName(1, 2)), Index: 2},
+		{OldPath: filepath.Join(p, walName(1, 2)), NewPath: filepath.Join(p, walName(2, 3)), Index: 3},
+		{OldPath: filepath.Join(p, walName(2, 3)), NewPath: filepath.Join(p, walName(3, 4)), Index: 4},
+	}
+	if !reflect.DeepEqual(o.cuts, wcuts) {
+		t.Errorf("cuts = %+v, want %+v", o.cuts, wcuts)
+	}
+	if o.syncs == 0 {
+		t.Error("no sync observed")
+	}
+
+	if err = w.ReleaseLockTo(4); err != nil {
+		t.Fatal(err)
+	}
+	wrelease := []LocksReleasedEvent{{
+		Index: 4,
+		Paths: []string{filepath.Join(p, walName(0, 0)), filepath.Join(p, walName(1, 2))},
+	}}
+	if !reflect.DeepEqual(o.releases, wrelease) {
+		t.Errorf("releases = %+v, want %+v", o.releases, wrelease)
+	}
+}
+
+func TestObserverRepair(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	o := &recordingObserver{}
+	opts := &Options{Observer: o}
+	w, err := Create(p, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, es := range makeEnts(10) {
+		if err = w.Save(&walpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offset, err := w.tail().Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err = os.Truncate(filepath.Join(p, walName(0, 0)), offset-4); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := RepairTail(nil, p, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(p, walName(0, 0))
+	wrepair := []RepairEvent{{Path: path, BrokenPath: path + ".broken", TruncatedBytes: n}}
+	if !reflect.DeepEqual(o.repairs, wrepair) {
+		t.Errorf("repairs = %+v, want %+v", o.repairs, wrepair)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultSegmentSizeBytes is the default preallocated size of each wal segment file.
+	DefaultSegmentSizeBytes int64 = 64 * 1000 * 1000 // 64MB
+
+	// DefaultEncoderBufferBytes is the default size of the buffer records are
+	// marshaled into before they are written out.
+	DefaultEncoderBufferBytes = 1024 * 1024 // 1MB
+
+	// DefaultPageBytes is the default alignment for flushing records to the backing Writer.
+	DefaultPageBytes = walPageBytes
+
+	// DefaultMaxRecordBytes is the default upper bound of a single decoded record.
+	DefaultMaxRecordBytes = maxWALEntrySizeLimit
+)
+
+var ErrInvalidOptions = errors.New("wal: invalid options")
+
+// Options configures a WAL instance. The zero value of every field selects
+// its default. Every function of this package taking an *Options accepts
+// nil, which is equivalent to a zero Options.
+type Options struct {
+	// Logger is used by the WAL for all of its logging. Defaults to a no-op logger.
+	Logger *zap.Logger
+
+	// SegmentSizeBytes is the preallocated size of each wal segment file.
+	// The actual size might be larger than this.
+	SegmentSizeBytes int64
+
+	// EncoderBufferBytes is the size of the buffer records are marshaled into.
+	// Larger records are marshaled into a freshly allocated slice.
+	EncoderBufferBytes int
+
+	// PageBytes is the alignment for flushing records to the segment file.
+	// It must be a multiple of the minimum sector size so that the WAL can
+	// safely distinguish between torn writes and ordinary data corruption.
+	PageBytes int
+
+	// MaxRecordBytes is the largest record the decoder accepts when reading
+	// the WAL back; bigger frames fail with ErrMaxWALEntrySizeLimitExceeded.
+	MaxRecordBytes int64
+
+	// Codec compresses the payload of the records the WAL writes. Records
+	// it does not shrink are written uncompressed. Defaults to no compression.
+	// Records of any registered codec are read back regardless.
+	Codec Codec
+
+	// KeyProvider, if set, encrypts the payload of the records the WAL
+	// writes with AES-GCM, and decrypts encrypted records read back.
+	KeyProvider KeyProvider
+
+	// Registry decodes the records of the WAL. Defaults to the default
+	// Registry, which RegisterRecord and RegisterRecordKind add to.
+	Registry *Registry
+
+	// UnsafeNoFsync disables fsync on every write. Data may be lost on
+	// power failure; see SetUnsafeNoFsync.
+	UnsafeNoFsync bool
+
+	// Durability selects when appends are synced. Defaults to syncing
+	// every write; see SetDurability.
+	Durability DurabilityPolicy
+
+	// FS is the filesystem the segments are kept on. Defaults to OSFS.
+	FS FS
+
+	// Registerer registers the Prometheus metrics of the WAL. Defaults to
+	// prometheus.DefaultRegisterer. WALs registering with the same
+	// Registerer and ConstLabels share their metrics, but for the gauges
+	// of the state of a WAL, which fail Create and Open with
+	// ErrMetricsInUse while another WAL holds them. The WALs registering
+	// with prometheus.DefaultRegisterer and no ConstLabels do not fail,
+	// only the first one open exports these gauges.
+	Registerer prometheus.Registerer
+
+	// ConstLabels are set on every metric of the WAL, to tell the WALs of
+	// a process apart.
+	ConstLabels prometheus.Labels
+
+	// Observer is notified of the lifecycle events of the WAL, and of the
+	// repairs made with the Options. Defaults to NopObserver.
+	Observer Observer
+}
+
+// withDefaults returns a validated copy of opts with every unset field
+// replaced by its default.
+func (opts *Options) withDefaults() (*Options, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.Logger == nil {
+		o.Logger = zap.NewNop()
+	}
+	if o.SegmentSizeBytes == 0 {
+		o.SegmentSizeBytes = DefaultSegmentSizeBytes
+	}
+	if o.EncoderBufferBytes == 0 {
+		o.EncoderBufferBytes = DefaultEncoderBufferBytes
+	}
+	if o.PageBytes == 0 {
+		o.PageBytes = DefaultPageBytes
+	}
+	if o.MaxRecordBytes == 0 {
+		o.MaxRecordBytes = DefaultMaxRecordBytes
+	}
+	if o.Registry == nil {
+		o.Registry = defaultRegistry
+	}
+	if o.FS == nil {
+		o.FS = OSFS
+	}
+	if o.Observer == nil {
+		o.Observer = NopObserver{}
+	}
+
+	switch {
+	case o.SegmentSizeBytes < 0:
+		return nil, errors.Wrapf(ErrInvalidOptions, "negative segment size %d", o.SegmentSizeBytes)
+	case o.EncoderBufferBytes < 0:
+		return nil, errors.Wrapf(ErrInvalidOptions, "negative encoder buffer size %d", o.EncoderBufferBytes)
+	case o.PageBytes < 0 || o.PageBytes%minSectorSize != 0:
+		return nil, errors.Wrapf(ErrInvalidOptions, "page size %d is not a multiple of %d", o.PageBytes, minSectorSize)
+	case o.MaxRecordBytes < 0:
+		return nil, errors.Wrapf(ErrInvalidOptions, "negative max record size %d", o.MaxRecordBytes)
+	}
+	if err := o.Durability.validate(); err != nil {
+		return nil, err
+	}
+	if o.Codec != nil {
+		if _, err := lookupCodec(o.Codec.ID()); err != nil {
+			return nil, errors.Wrapf(ErrInvalidOptions, "codec id %d is not registered", o.Codec.ID())
+		}
+	}
+	return &o, nil
+}
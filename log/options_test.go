@@ -0,0 +1,99 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestOptionsDefaults(t *testing.T) {
+	var opts *Options
+	o, err := opts.withDefaults()
+	assert.NoError(t, err)
+	assert.NotNil(t, o.Logger)
+	assert.Equal(t, DefaultSegmentSizeBytes, o.SegmentSizeBytes)
+	assert.Equal(t, DefaultEncoderBufferBytes, o.EncoderBufferBytes)
+	assert.Equal(t, DefaultPageBytes, o.PageBytes)
+	assert.Equal(t, DefaultMaxRecordBytes, o.MaxRecordBytes)
+	assert.False(t, o.UnsafeNoFsync)
+
+	in := &Options{SegmentSizeBytes: 1024}
+	o, err = in.withDefaults()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), o.SegmentSizeBytes)
+	// the caller's options must not be modified
+	assert.Nil(t, in.Logger)
+}
+
+func TestOptionsInvalid(t *testing.T) {
+	tests := []*Options{
+		{SegmentSizeBytes: -1},
+		{EncoderBufferBytes: -1},
+		{PageBytes: 100},
+		{PageBytes: -minSectorSize},
+		{MaxRecordBytes: -1},
+	}
+	for i, tt := range tests {
+		if _, err := tt.withDefaults(); errors.Cause(err) != ErrInvalidOptions {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrInvalidOptions)
+		}
+	}
+
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	if _, err = Create(p, nil, &Options{PageBytes: 100}); errors.Cause(err) != ErrInvalidOptions {
+		t.Errorf("err = %v, want %v", err, ErrInvalidOptions)
+	}
+}
+
+// TestOptionsPerInstance ensures that two WALs in one process keep their own segment size.
+func TestOptionsPerInstance(t *testing.T) {
+	root, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	small, err := Create(filepath.Join(root, "small"), nil, &Options{Logger: zap.NewExample(), SegmentSizeBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	large, err := Create(filepath.Join(root, "large"), nil, &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer large.Close()
+
+	for i := 1; i <= 3; i++ {
+		es := []LogEntry{&walpb.Entry{Index: uint64(i), Data: make([]byte, 64)}}
+		if err = small.Save(&walpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+		if err = large.Save(&walpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if small.seq() == 0 {
+		t.Errorf("small seq = %d, want > 0", small.seq())
+	}
+	if large.seq() != 0 {
+		t.Errorf("large seq = %d, want %d", large.seq(), 0)
+	}
+}
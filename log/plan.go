@@ -0,0 +1,302 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var ErrStalePlan = errors.New("wal: repair plan does not match the WAL")
+
+// ProblemType classifies why a record does not read back.
+type ProblemType string
+
+const (
+	// TornWrite is a record partially written, cut short or zeroed.
+	TornWrite ProblemType = "torn-write"
+	// CRCMismatch is a record whose data does not match its crc, or a crc
+	// record breaking the crc chain.
+	CRCMismatch ProblemType = "crc-mismatch"
+	// BadFrameLength is a record whose length runs past its segment.
+	BadFrameLength ProblemType = "bad-frame-length"
+	// OversizeRecord is a record of Options.MaxRecordBytes or more.
+	OversizeRecord ProblemType = "oversize-record"
+	// BadRecord is a record whose data does not decode, such as a record
+	// of an unknown type or one that fails to decrypt.
+	BadRecord ProblemType = "bad-record"
+)
+
+// Problem is the first record of a segment that does not read back.
+type Problem struct {
+	Segment string      `json:"segment"`
+	Offset  int64       `json:"offset"`
+	Type    ProblemType `json:"type"`
+	Reason  string      `json:"reason"`
+	// LostBytes are the bytes of data from Offset to the end of Segment.
+	LostBytes int64 `json:"lost_bytes"`
+}
+
+// SegmentInfo is a segment as RepairPlan found it.
+type SegmentInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// RepairReport describes the problems RepairPlan finds in a WAL, and the
+// repair ApplyRepairPlan makes of them: the WAL is cut before the first
+// problem, losing every record after it.
+type RepairReport struct {
+	Dir      string        `json:"dir"`
+	Segments []SegmentInfo `json:"segments"`
+	// Problems holds the first problem of each segment, in order. The
+	// segments after a problem are checked on their own.
+	Problems []Problem `json:"problems"`
+
+	// Truncate is the segment cut at Offset, the offset of the first
+	// problem; it is empty if that segment keeps no record.
+	Truncate string `json:"truncate,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+	// Quarantine are the segments moved away whole.
+	Quarantine []string `json:"quarantine,omitempty"`
+
+	// LastGoodIndex is the index of the last entry the WAL keeps.
+	LastGoodIndex uint64 `json:"last_good_index"`
+	// FirstLostIndex and LastLostIndex are the range of the entries lost.
+	// LastLostIndex is the largest index of the lost entries that read
+	// back, or 0 if none does and the end of the range is unknown.
+	FirstLostIndex uint64 `json:"first_lost_index,omitempty"`
+	LastLostIndex  uint64 `json:"last_lost_index,omitempty"`
+	// LostBytes are the bytes of data cut off or quarantined.
+	LostBytes int64 `json:"lost_bytes"`
+}
+
+// Corrupted reports whether the WAL needs repairing.
+func (r *RepairReport) Corrupted() bool {
+	return len(r.Problems) != 0
+}
+
+// RepairPlan reads through the segments of the WAL in dirpath and reports
+// its problems and the repair ApplyRepairPlan would make, without changing
+// anything. Like Verify, it does not conflict with an open WAL.
+func RepairPlan(lg *zap.Logger, dirpath string, opts *Options) (*RepairReport, error) {
+	if lg == nil {
+		lg = zap.NewNop()
+	}
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	names, err := readWALNames(lg, opts.FS, dirpath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RepairReport{Dir: dirpath}
+	var (
+		prevCrc uint32
+		cut     bool // whether the records read are past the cut
+	)
+	for _, name := range names {
+		s, err := scanSegment(filepath.Join(dirpath, name), prevCrc, opts)
+		if err != nil {
+			return nil, err
+		}
+		r.Segments = append(r.Segments, SegmentInfo{Name: name, Size: s.size, ModTime: s.modTime})
+
+		if cut {
+			r.Quarantine = append(r.Quarantine, name)
+			r.LostBytes += s.end
+			if s.maxIndex > r.LastLostIndex {
+				r.LastLostIndex = s.maxIndex
+			}
+		} else if s.hasIndex {
+			r.LastGoodIndex = s.lastIndex
+		}
+		prevCrc = s.crc
+
+		if s.problem == nil {
+			continue
+		}
+		r.Problems = append(r.Problems, *s.problem)
+		// the crc chain is broken: check the next segment on its own
+		prevCrc = 0
+		if cut {
+			continue
+		}
+		cut = true
+		if s.kept != 0 {
+			r.Truncate, r.Offset = name, s.problem.Offset
+		} else {
+			r.Quarantine = append(r.Quarantine, name)
+		}
+		r.LostBytes += s.problem.LostBytes
+	}
+	if cut {
+		r.FirstLostIndex = r.LastGoodIndex + 1
+		if r.LastLostIndex < r.FirstLostIndex {
+			r.LastLostIndex = 0
+		}
+	}
+	return r, nil
+}
+
+// segmentScan is what scanSegment finds in a segment.
+type segmentScan struct {
+	size    int64
+	modTime time.Time
+	end     int64  // end of the data written
+	crc     uint32 // crc of the last record read back
+	kept    int    // records read back
+	problem *Problem
+
+	lastIndex uint64 // index of the last entry, if hasIndex
+	hasIndex  bool
+	maxIndex  uint64 // largest index of the entries read back
+}
+
+// scanSegment reads the segment at fpath up to its first problem. prevCrc
+// is the crc the segment is chained to, or 0 if it is not checked.
+func scanSegment(fpath string, prevCrc uint32, opts *Options) (*segmentScan, error) {
+	f, err := opts.FS.OpenFile(fpath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s := &segmentScan{size: fi.Size(), modTime: fi.ModTime()}
+	if s.end, err = dataEnd(f, s.size); err != nil {
+		return nil, err
+	}
+	if _, err = readSegmentVersion(f); err != nil {
+		return nil, err
+	}
+
+	rec := &walpb.Record{}
+	decoder := newDecoderOpts(opts, f)
+	decoder.updateCRC(prevCrc)
+	for ; ; s.kept++ {
+		off := decoder.lastOffset()
+		err = decoder.decode(rec)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			var (
+				index uint64
+				ok    bool
+			)
+			if index, ok, err = checkRecord(decoder, rec, opts); ok {
+				s.lastIndex, s.hasIndex = index, true
+				if rec.Type == int64(EntryType) && index > s.maxIndex {
+					s.maxIndex = index
+				}
+			}
+		}
+		if err != nil {
+			lost := s.end - off
+			if lost < 0 {
+				lost = 0
+			}
+			s.problem = &Problem{
+				Segment:   filepath.Base(fpath),
+				Offset:    off,
+				Type:      problemType(f, off, s.size, err),
+				Reason:    err.Error(),
+				LostBytes: lost,
+			}
+			break
+		}
+	}
+	s.crc = decoder.lastCRC()
+	return s, nil
+}
+
+// checkRecord checks that rec, just decoded by decoder, reads back. ok is
+// true for an entry or a truncate record, with the index of the last entry.
+func checkRecord(decoder *decoder, rec *walpb.Record, opts *Options) (index uint64, ok bool, err error) {
+	switch rec.Type {
+	case int64(EntryType):
+		e := opts.Registry.NewEntry()
+		if err = unmarshalRecord(e, rec); err != nil {
+			return 0, false, err
+		}
+		return e.GetIndex(), true, nil
+	case int64(TruncateType):
+		if index, err = decodeTruncate(rec.Data); err != nil {
+			return 0, false, err
+		}
+		return index, true, nil
+	case int64(StateType):
+		err = unmarshalRecord(opts.Registry.NewState(), rec)
+	case int64(SnapshotType):
+		err = unmarshalRecord(opts.Registry.NewSnapshot(), rec)
+	case int64(CrcType):
+		if err = decoder.chainCRC(rec); err != nil {
+			return 0, false, err
+		}
+	case int64(MetadataType):
+	default:
+		_, _, _, err = opts.Registry.decodeUserRecord(rec)
+	}
+	return 0, false, err
+}
+
+// problemType classifies err, the failure to read the record at off of a
+// segment of the given size.
+func problemType(f io.ReaderAt, off, size int64, err error) ProblemType {
+	var b [frameSizeBytes]byte
+	if _, rerr := f.ReadAt(b[:], off); rerr == nil {
+		recBytes, padBytes := decodeFrameSize(int64(binary.LittleEndian.Uint64(b[:])))
+		if recBytes > size || off+frameSizeBytes+recBytes+padBytes > size {
+			return BadFrameLength
+		}
+	}
+	switch errors.Cause(err) {
+	case ErrMaxWALEntrySizeLimitExceeded:
+		return OversizeRecord
+	case io.ErrUnexpectedEOF:
+		return TornWrite
+	case ErrCRCMismatch, walpb.ErrCRCMismatch:
+		return CRCMismatch
+	}
+	return BadRecord
+}
+
+// dataEnd returns the offset following the last non-zero byte of f, the
+// end of the data written to a preallocated segment of the given size.
+func dataEnd(f io.ReaderAt, size int64) (int64, error) {
+	buf := make([]byte, 32*1024)
+	for end := size; end > 0; {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := n - 1; i >= 0; i-- {
+			if buf[i] != 0 {
+				return end - n + i + 1, nil
+			}
+		}
+		end -= n
+	}
+	return 0, nil
+}
@@ -0,0 +1,199 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// createPlanWAL creates a WAL in dir of entries 1 to n, the data of each
+// being 64 bytes of its index.
+func createPlanWAL(t *testing.T, dir string, n int, opts *Options) {
+	w, err := Create(dir, []byte("metadata"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		e := &walpb.Entry{Index: uint64(i), Data: bytes.Repeat([]byte{byte(i)}, 64)}
+		if err = w.SaveEntry([]LogEntry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+}
+
+// recordOffsets returns the offsets of the records of the segment at p.
+func recordOffsets(t *testing.T, p string) []int64 {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var offs []int64
+	rec := &walpb.Record{}
+	d := newDecoder(f)
+	for off := d.lastOffset(); d.decode(rec) == nil; off = d.lastOffset() {
+		offs = append(offs, off)
+		if rec.Type == int64(CrcType) {
+			d.updateCRC(rec.Crc)
+		}
+	}
+	return offs
+}
+
+func TestRepairPlanProblems(t *testing.T) {
+	writeLen := func(n int64) func(p string, b []byte, off int64) {
+		return func(p string, b []byte, off int64) {
+			binary.LittleEndian.PutUint64(b[off:], uint64(n))
+		}
+	}
+	tests := []struct {
+		corrupt func(p string, b []byte, off int64)
+		want    ProblemType
+	}{
+		{
+			// flip a byte of the entry data
+			func(p string, b []byte, off int64) { b[off+frameSizeBytes+40] ^= 0xff },
+			CRCMismatch,
+		},
+		{writeLen(1 << 40), BadFrameLength},
+		{writeLen(maxWALEntrySizeLimit + 1), OversizeRecord},
+		{
+			// zero the entry as a torn write does
+			func(p string, b []byte, off int64) {
+				recBytes, padBytes := decodeFrameSize(int64(binary.LittleEndian.Uint64(b[off:])))
+				for i := off + frameSizeBytes; i < off+frameSizeBytes+recBytes+padBytes; i++ {
+					b[i] = 0
+				}
+			},
+			TornWrite,
+		},
+	}
+	for i, tt := range tests {
+		p, err := ioutil.TempDir(os.TempDir(), "waltest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(p)
+
+		createPlanWAL(t, p, 10, nil)
+		seg := filepath.Join(p, walName(0, 0))
+		offs := recordOffsets(t, seg)
+		// the crc, metadata and snapshot records precede the entries
+		off := offs[len(offs)-5]
+		b, err := ioutil.ReadFile(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.corrupt(seg, b, off)
+		if err = ioutil.WriteFile(seg, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := RepairPlan(zap.NewExample(), p, nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if len(r.Problems) != 1 {
+			t.Fatalf("#%d: problems = %+v, want 1", i, r.Problems)
+		}
+		if pb := r.Problems[0]; pb.Type != tt.want || pb.Offset != off || pb.LostBytes <= 0 {
+			t.Errorf("#%d: problem = %+v, want %s at %d", i, pb, tt.want, off)
+		}
+		if r.Truncate != walName(0, 0) || r.Offset != off || len(r.Quarantine) != 0 {
+			t.Errorf("#%d: repair = truncate %q at %d, quarantine %v", i, r.Truncate, r.Offset, r.Quarantine)
+		}
+		if r.LastGoodIndex != 5 || r.FirstLostIndex != 6 {
+			t.Errorf("#%d: last good index = %d, first lost index = %d, want 5, 6", i, r.LastGoodIndex, r.FirstLostIndex)
+		}
+	}
+}
+
+func TestApplyRepairPlan(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	dir, q := filepath.Join(p, "wal"), filepath.Join(p, "quarantine")
+
+	createPlanWAL(t, dir, 100, &Options{SegmentSizeBytes: 2048})
+	names, err := readWALNames(zap.NewExample(), OSFS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) < 3 {
+		t.Fatalf("len(names) = %d, want at least 3", len(names))
+	}
+	// corrupt an entry of the second segment
+	seg := filepath.Join(dir, names[1])
+	offs := recordOffsets(t, seg)
+	off := offs[len(offs)-2]
+	b, err := ioutil.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[off+frameSizeBytes+40] ^= 0xff
+	if err = ioutil.WriteFile(seg, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := RepairPlan(zap.NewExample(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncate != names[1] || r.Offset != off {
+		t.Errorf("truncate = %q at %d, want %q at %d", r.Truncate, r.Offset, names[1], off)
+	}
+	if len(r.Quarantine) != len(names)-2 {
+		t.Errorf("quarantine = %v, want %v", r.Quarantine, names[2:])
+	}
+	if r.FirstLostIndex != r.LastGoodIndex+1 || r.LastLostIndex != 100 {
+		t.Errorf("lost index range = [%d, %d], want [%d, 100]", r.FirstLostIndex, r.LastLostIndex, r.LastGoodIndex+1)
+	}
+	// planning changes nothing
+	if _, err = os.Stat(q); !os.IsNotExist(err) {
+		t.Fatalf("stat quarantine = %v, want not exist", err)
+	}
+
+	// the plan does not apply once the WAL changed
+	stale := *r
+	stale.Segments = append([]SegmentInfo{}, r.Segments...)
+	stale.Segments[0].Size++
+	if _, err = ApplyRepairPlan(zap.NewExample(), &stale, q, nil); errors.Cause(err) != ErrStalePlan {
+		t.Fatalf("err = %v, want %v", err, ErrStalePlan)
+	}
+
+	m, err := ApplyRepairPlan(zap.NewExample(), r, q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != len(names)-1 || m.LastGoodIndex != r.LastGoodIndex {
+		t.Errorf("manifest = %+v", m)
+	}
+	w, err := Open(dir, &walpb.Snapshot{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(ents)) != r.LastGoodIndex {
+		t.Fatalf("len(ents) = %d, want %d", len(ents), r.LastGoodIndex)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/pkg/fileutil"
+	"go.uber.org/zap"
+)
+
+// PurgePolicy decides how many of the old segments of a WAL are retained.
+// A zero field sets no limit; the zero PurgePolicy retains every segment.
+type PurgePolicy struct {
+	// MaxSegments is the maximum number of segments to retain.
+	MaxSegments int
+	// MaxBytes is the maximum total size of the segments to retain.
+	MaxBytes int64
+	// MaxAge is the maximum time since a retained segment was last written.
+	MaxAge time.Duration
+}
+
+func (p PurgePolicy) validate() error {
+	switch {
+	case p.MaxSegments < 0:
+		return errors.Wrapf(ErrInvalidOptions, "negative max segments %d", p.MaxSegments)
+	case p.MaxBytes < 0:
+		return errors.Wrapf(ErrInvalidOptions, "negative max bytes %d", p.MaxBytes)
+	case p.MaxAge < 0:
+		return errors.Wrapf(ErrInvalidOptions, "negative max age %v", p.MaxAge)
+	}
+	return nil
+}
+
+// exceeded reports whether the policy asks for the oldest of n segments
+// totalling size bytes, last written age ago, to be removed.
+func (p PurgePolicy) exceeded(n int, size int64, age time.Duration) bool {
+	return (p.MaxSegments > 0 && n > p.MaxSegments) ||
+		(p.MaxBytes > 0 && size > p.MaxBytes) ||
+		(p.MaxAge > 0 && age > p.MaxAge)
+}
+
+// PurgeSegments removes the oldest segments of the WAL in dirpath, together
+// with their index files, for as long as the policy is exceeded. Only the
+// segments before the one holding snapIndex, the index of the latest
+// snapshot, are removed; the segment holding it and every later one are
+// needed to recover from that snapshot. As a further check, purging stops
+// at the first segment a WAL holds a lock on, since ReleaseLockTo has not
+// released it yet. The directory is synced once the segments are removed.
+// PurgeSegments returns the names of the removed segments.
+func PurgeSegments(lg *zap.Logger, dirpath string, snapIndex uint64, policy PurgePolicy, opts *Options) ([]string, error) {
+	if lg == nil {
+		lg = zap.NewNop()
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	m, err := opts.metrics()
+	if err != nil {
+		return nil, err
+	}
+	fs := opts.FS
+
+	names, err := readWALNames(lg, fs, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	// the segments from the one holding snapIndex on are kept
+	snapSeg, ok := searchIndex(lg, names, snapIndex)
+	if !ok {
+		return nil, nil
+	}
+	fis := make([]os.FileInfo, len(names))
+	var total int64
+	for i, name := range names {
+		if fis[i], err = fs.Stat(filepath.Join(dirpath, name)); err != nil {
+			return nil, err
+		}
+		total += fis[i].Size()
+	}
+
+	var removed []string
+	now := time.Now()
+	for i := 0; i < snapSeg; i++ {
+		if !policy.exceeded(len(names)-i, total, now.Sub(fis[i].ModTime())) {
+			break
+		}
+		fpath := filepath.Join(dirpath, names[i])
+		l, lerr := fs.TryLockFile(fpath, os.O_WRONLY, fileutil.PrivateFileMode)
+		if lerr != nil {
+			// still in use by a WAL
+			break
+		}
+		if err = fs.Remove(fpath); err != nil {
+			l.Close()
+			lg.Warn("failed to purge WAL segment", zap.String("path", fpath), zap.Error(err))
+			return removed, err
+		}
+		if err = fs.Remove(filepath.Join(dirpath, indexName(names[i]))); err != nil && !os.IsNotExist(err) {
+			lg.Warn("failed to remove WAL segment index", zap.String("path", filepath.Join(dirpath, indexName(names[i]))), zap.Error(err))
+		}
+		if err = l.Close(); err != nil {
+			lg.Warn("failed to unlock/close", zap.String("path", l.Name()), zap.Error(err))
+		}
+		lg.Info("purged WAL segment", zap.String("path", fpath), zap.Int64("size", fis[i].Size()))
+
+		m.purgedSegments.Inc()
+		m.purgedBytes.Add(float64(fis[i].Size()))
+		total -= fis[i].Size()
+		removed = append(removed, names[i])
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, syncDir(fs, dirpath)
+}
+
+// syncDir fsyncs the directory at dirpath to persist the removal or the
+// renaming of its entries.
+func syncDir(fs FS, dirpath string) error {
+	d, err := fs.OpenDir(dirpath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return fs.Fsync(d)
+}
+
+// Purge runs PurgeSegments on the WAL in dirpath every interval until stop
+// is closed, bounded by the snapshot index snapIndex returns each time. If
+// purging fails, the error is sent on the returned channel and Purge stops.
+func Purge(lg *zap.Logger, dirpath string, snapIndex func() uint64, policy PurgePolicy, interval time.Duration, stop <-chan struct{}, opts *Options) <-chan error {
+	errC := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := PurgeSegments(lg, dirpath, snapIndex(), policy, opts); err != nil {
+				errC <- err
+				return
+			}
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return errC
+}
@@ -0,0 +1,169 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPurgeSegments(t *testing.T) {
+	p, w := createRangeWAL(t, 60)
+	defer os.RemoveAll(p)
+	defer w.Close()
+
+	names, err := readWALNames(zap.NewExample(), OSFS, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) < 5 {
+		t.Fatalf("len(names) = %d, want at least %d", len(names), 5)
+	}
+
+	// segments locked by the WAL are kept
+	removed, err := PurgeSegments(zap.NewExample(), p, 60, PurgePolicy{MaxSegments: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("removed = %v, want none", removed)
+	}
+
+	// release the locks on the first two segments only
+	_, index, err := parseWALName(names[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.ReleaseLockTo(index); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err = PurgeSegments(zap.NewExample(), p, 60, PurgePolicy{MaxSegments: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0] != names[0] || removed[1] != names[1] {
+		t.Fatalf("removed = %v, want %v", removed, names[:2])
+	}
+	for _, name := range removed {
+		if _, err = os.Stat(filepath.Join(p, indexName(name))); !os.IsNotExist(err) {
+			t.Errorf("expected index of %s to be removed, got %v", name, err)
+		}
+	}
+
+	// the last segment is never removed
+	if err = w.ReleaseLockTo(60); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err = PurgeSegments(zap.NewExample(), p, 60, PurgePolicy{MaxSegments: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != len(names)-3 {
+		t.Errorf("len(removed) = %d, want %d", len(removed), len(names)-3)
+	}
+	if names, err = readWALNames(zap.NewExample(), OSFS, p); err != nil || len(names) != 1 {
+		t.Errorf("names = %v, want %d segment", names, 1)
+	}
+}
+
+func TestPurgeSegmentsPolicy(t *testing.T) {
+	p, w := createRangeWAL(t, 60)
+	defer os.RemoveAll(p)
+	w.Close()
+
+	names, err := readWALNames(zap.NewExample(), OSFS, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		total int64
+		sizes []int64
+	)
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(p, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += fi.Size()
+		sizes = append(sizes, fi.Size())
+	}
+
+	// the segment holding the snapshot index and the later ones are kept
+	_, index, err := parseWALName(names[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := PurgeSegments(zap.NewExample(), p, index-1, PurgePolicy{MaxSegments: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != names[0] {
+		t.Fatalf("removed = %v, want [%s]", removed, names[0])
+	}
+	if removed, err = PurgeSegments(zap.NewExample(), p, 0, PurgePolicy{MaxSegments: 1}, nil); err != nil || len(removed) != 0 {
+		t.Fatalf("PurgeSegments = (%v, %v), want (none, nil)", removed, err)
+	}
+	names = names[1:]
+	total -= sizes[0]
+
+	// an empty policy retains everything
+	removed, err = PurgeSegments(zap.NewExample(), p, 60, PurgePolicy{}, nil)
+	if err != nil || len(removed) != 0 {
+		t.Fatalf("PurgeSegments = (%v, %v), want (none, nil)", removed, err)
+	}
+
+	if removed, err = PurgeSegments(zap.NewExample(), p, 60, PurgePolicy{MaxBytes: total - 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 {
+		t.Errorf("len(removed) = %d, want %d", len(removed), 1)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(filepath.Join(p, names[1]), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err = PurgeSegments(zap.NewExample(), p, 60, PurgePolicy{MaxAge: time.Minute}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != names[1] {
+		t.Errorf("removed = %v, want [%s]", removed, names[1])
+	}
+
+	if _, err = PurgeSegments(zap.NewExample(), p, 60, PurgePolicy{MaxSegments: -1}, nil); err == nil {
+		t.Errorf("expected error for a negative policy")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	p, w := createRangeWAL(t, 60)
+	defer os.RemoveAll(p)
+	w.Close()
+
+	stop := make(chan struct{})
+	errC := Purge(zap.NewExample(), p, func() uint64 { return 60 }, PurgePolicy{MaxSegments: 2}, 10*time.Millisecond, stop, nil)
+	deadline := time.After(5 * time.Second)
+	for {
+		names, err := readWALNames(zap.NewExample(), OSFS, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) == 2 {
+			break
+		}
+		select {
+		case err = <-errC:
+			t.Fatal(err)
+		case <-deadline:
+			t.Fatalf("len(names) = %d, want %d", len(names), 2)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(stop)
+}
@@ -0,0 +1,300 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/pkg/fileutil"
+	"go.uber.org/zap"
+)
+
+// manifestName is the name of the manifest in a quarantine directory.
+const manifestName = "manifest.json"
+
+// headRecords is the number of records at the head of the first segment of
+// a WAL: the crc, the metadata and the snapshot written by Create.
+const headRecords = 3
+
+// Statuses of a QuarantineManifest.
+const (
+	// QuarantinePending is the status of a repair in progress: the WAL may
+	// not be cut yet, and Files may not all be in the quarantine directory.
+	QuarantinePending = "pending"
+	// QuarantineComplete is the status of a repair made in full.
+	QuarantineComplete = "complete"
+)
+
+var ErrHeadCorrupted = errors.New("wal: the head of the first segment is corrupted")
+
+// QuarantineManifest records a repair of a corrupted WAL by
+// RepairCorruption. It is written as manifest.json next to the original
+// segments it moved to the quarantine directory.
+type QuarantineManifest struct {
+	Dir     string    `json:"dir"` // the repaired WAL directory
+	Time    time.Time `json:"time"`
+	Status  string    `json:"status"`  // QuarantinePending until the repair is made
+	Segment string    `json:"segment"` // segment of the first bad record
+	Offset  int64     `json:"offset"`  // offset of the first bad record, where Segment was cut
+	Reason  string    `json:"reason"`  // why the record is bad
+	// Problems are the problems RepairPlan found.
+	Problems []Problem `json:"problems"`
+	// LastGoodIndex is the index of the last entry the WAL kept.
+	LastGoodIndex uint64 `json:"last_good_index"`
+	// Files are the original segments in the quarantine directory: Segment
+	// as it was before it was cut, and all the segments after it.
+	Files []string `json:"files"`
+	// Path is the quarantine directory of the repair.
+	Path string `json:"-"`
+}
+
+// RepairCorruption repairs a WAL whose records stop reading back anywhere
+// in the log, not only at a torn write at its end as Repair does. It is
+// ApplyRepairPlan of the RepairPlan of the WAL: the WAL is cut before the
+// first bad record, and the original segments are moved to a new directory
+// in quarantineDir together with a QuarantineManifest describing the
+// repair. A WAL reading back entirely is left untouched, and the returned
+// manifest has no Files.
+//
+// The entries after LastGoodIndex are lost; they have to be recovered from
+// a snapshot or a peer. The WAL must not be open.
+func RepairCorruption(lg *zap.Logger, dirpath, quarantineDir string, opts *Options) (*QuarantineManifest, error) {
+	r, err := RepairPlan(lg, dirpath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyRepairPlan(lg, r, quarantineDir, opts)
+}
+
+// ApplyRepairPlan makes the repair r reports: the segment r.Truncate is
+// truncated at r.Offset, and the segments r.Quarantine are moved away. The
+// originals go to a new directory in quarantineDir, on the FS of opts like
+// the WAL, with the manifest of the repair. It fails with ErrStalePlan,
+// changing nothing, if the segments of the WAL are no longer those r was
+// planned on, and with ErrHeadCorrupted if the first bad record is at the
+// head of the first segment, as cutting it would leave no metadata nor
+// snapshot to open the WAL at. The WAL must not be open.
+//
+// The repair is made in an order a crash can interrupt at any point without
+// losing a record: the original of r.Truncate is copied to the quarantine
+// directory and synced, the manifest is written with QuarantinePending,
+// the segments r.Quarantine are moved, r.Truncate is cut and the
+// directories are synced, and only then is the manifest marked
+// QuarantineComplete.
+func ApplyRepairPlan(lg *zap.Logger, r *RepairReport, quarantineDir string, opts *Options) (*QuarantineManifest, error) {
+	if lg == nil {
+		lg = zap.NewNop()
+	}
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	met, err := opts.metrics()
+	if err != nil {
+		return nil, err
+	}
+	fs, dirpath := opts.FS, r.Dir
+	names, err := readWALNames(lg, fs, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) != len(r.Segments) {
+		return nil, errors.Wrapf(ErrStalePlan, "%d segments, planned on %d", len(names), len(r.Segments))
+	}
+
+	// hold every segment so that no WAL opens it meanwhile
+	locks := make(map[string]File, len(names))
+	for i, name := range names {
+		l, err := fs.TryLockFile(filepath.Join(dirpath, name), os.O_RDWR, fileutil.PrivateFileMode)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		locks[name] = l
+
+		fi, err := l.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if s := r.Segments[i]; s.Name != name || s.Size != fi.Size() || !s.ModTime.Equal(fi.ModTime()) {
+			return nil, errors.Wrapf(ErrStalePlan, "segment %s changed", name)
+		}
+	}
+
+	m := &QuarantineManifest{Dir: dirpath, Time: time.Now().UTC(), LastGoodIndex: r.LastGoodIndex, Problems: r.Problems}
+	if !r.Corrupted() {
+		return m, nil
+	}
+	first := r.Problems[0]
+	if seq, _, perr := parseWALName(first.Segment); perr == nil && seq == 0 {
+		n, err := recordsBefore(locks[first.Segment], first.Offset)
+		if err != nil {
+			return nil, err
+		}
+		if n < headRecords {
+			return nil, errors.Wrapf(ErrHeadCorrupted, "%s at offset %d", first.Segment, first.Offset)
+		}
+	}
+	m.Segment, m.Offset, m.Reason = first.Segment, first.Offset, first.Reason
+	m.Status = QuarantinePending
+	if r.Truncate != "" {
+		m.Files = append(m.Files, r.Truncate)
+	}
+	m.Files = append(m.Files, r.Quarantine...)
+	m.Path = filepath.Join(quarantineDir, m.Time.Format("20060102T150405.000000000Z"))
+	if err = mkdirAllSync(fs, m.Path); err != nil {
+		return nil, err
+	}
+
+	lg.Warn(
+		"quarantining corrupted WAL segments",
+		zap.String("segment", first.Segment),
+		zap.Int64("offset", first.Offset),
+		zap.String("problem", string(first.Type)),
+		zap.Uint64("last-good-index", r.LastGoodIndex),
+		zap.Int64("lost-bytes", r.LostBytes),
+	)
+
+	if r.Truncate != "" {
+		if err = copyFile(fs, met, locks[r.Truncate], filepath.Join(m.Path, r.Truncate)); err != nil {
+			return nil, err
+		}
+	}
+	if err = writeManifest(fs, met, m); err != nil {
+		return nil, err
+	}
+
+	for _, name := range r.Quarantine {
+		if err = fs.Rename(filepath.Join(dirpath, name), filepath.Join(m.Path, name)); err != nil {
+			return nil, err
+		}
+	}
+	if r.Truncate != "" {
+		if err = locks[r.Truncate].Truncate(r.Offset); err != nil {
+			return nil, err
+		}
+		if err = fsync(fs, met, locks[r.Truncate]); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range m.Files {
+		// the indexes describe the records cut off
+		if err = fs.Remove(filepath.Join(dirpath, indexName(name))); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for _, p := range []string{dirpath, m.Path} {
+		if err = syncDir(fs, p); err != nil {
+			return nil, err
+		}
+	}
+
+	m.Status = QuarantineComplete
+	if err = writeManifest(fs, met, m); err != nil {
+		return nil, err
+	}
+	met.repairs.Inc()
+	e := RepairEvent{
+		Path:           filepath.Join(dirpath, first.Segment),
+		TruncatedBytes: r.LostBytes,
+		QuarantineDir:  m.Path,
+		LastGoodIndex:  r.LastGoodIndex,
+	}
+	if r.Truncate != "" {
+		e.BrokenPath = filepath.Join(m.Path, r.Truncate)
+	}
+	opts.Observer.Repaired(e)
+
+	lg.Info("quarantined corrupted WAL segments", zap.String("path", m.Path), zap.Strings("files", m.Files))
+	return m, nil
+}
+
+// recordsBefore returns the number of records of the segment read by f
+// that end at or before off, walking their frames.
+func recordsBefore(f io.ReaderAt, off int64) (int, error) {
+	version, err := readSegmentVersion(f)
+	if err != nil {
+		return 0, err
+	}
+	var cur int64
+	if version != 0 {
+		cur = segmentHeaderBytes
+	}
+	b := make([]byte, frameSizeBytes)
+	for n := 0; ; n++ {
+		if _, err = f.ReadAt(b, cur); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		recBytes, padBytes := decodeFrameSize(int64(binary.LittleEndian.Uint64(b)))
+		next := cur + frameSizeBytes + recBytes + padBytes
+		if recBytes == 0 || next > off {
+			return n, nil
+		}
+		cur = next
+	}
+}
+
+// writeManifest replaces the manifest of m on fs atomically, and syncs it.
+func writeManifest(fs FS, met *metrics, m *QuarantineManifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(m.Path, manifestName)
+	f, err := fs.OpenFile(p+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = fsync(fs, met, f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = fs.Rename(p+".tmp", p); err != nil {
+		return err
+	}
+	return syncDir(fs, m.Path)
+}
+
+// copyFile copies src from its start to the new file to on fs, and syncs
+// the copy.
+func copyFile(fs FS, met *metrics, src File, to string) error {
+	dst, err := fs.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, io.NewSectionReader(src, 0, 1<<63-1)); err == nil {
+		err = fsync(fs, met, dst)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fsync syncs f on fs, observing the time it takes in met.
+func fsync(fs FS, met *metrics, f File) error {
+	start := time.Now()
+	if err := fs.Fsync(f); err != nil {
+		return err
+	}
+	met.fsyncSec.Observe(time.Since(start).Seconds())
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+func TestRepairCorruption(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	q := filepath.Join(p, "quarantine")
+	dir := filepath.Join(p, "wal")
+
+	w, err := Create(dir, []byte("metadata"), &Options{SegmentSizeBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 100; i++ {
+		if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: i, Data: make([]byte, 32)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// a WAL reading back is left untouched
+	m, err := RepairCorruption(zap.NewExample(), dir, q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.LastGoodIndex != 100 || len(m.Files) != 0 || fileExists(q) {
+		t.Fatalf("manifest = %+v, want last good index 100 and no files", m)
+	}
+
+	names, err := readWALNames(zap.NewExample(), OSFS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) < 4 {
+		t.Fatalf("len(names) = %d, want at least 4", len(names))
+	}
+	// flip a byte in the middle of the second segment
+	seg := filepath.Join(dir, names[1])
+	b, err := ioutil.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err = ioutil.WriteFile(seg, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &recordingObserver{}
+	m, err = RepairCorruption(zap.NewExample(), dir, q, &Options{Observer: o})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Segment != names[1] || m.Offset <= segmentHeaderBytes || m.Offset > int64(len(b)/2) {
+		t.Fatalf("manifest = %+v, want corruption in %s before %d", m, names[1], len(b)/2)
+	}
+	if !reflect.DeepEqual(m.Files, names[1:]) {
+		t.Errorf("files = %v, want %v", m.Files, names[1:])
+	}
+	for _, name := range m.Files {
+		if !fileExists(filepath.Join(m.Path, name)) {
+			t.Errorf("%s is not quarantined", name)
+		}
+	}
+	if m.LastGoodIndex == 0 || m.LastGoodIndex >= 100 {
+		t.Fatalf("last good index = %d, want within (0, 100)", m.LastGoodIndex)
+	}
+	if len(o.repairs) != 1 {
+		t.Fatalf("repairs = %+v, want one", o.repairs)
+	}
+	wrepair := []RepairEvent{{
+		Path:           filepath.Join(dir, names[1]),
+		BrokenPath:     filepath.Join(m.Path, names[1]),
+		TruncatedBytes: o.repairs[0].TruncatedBytes,
+		QuarantineDir:  m.Path,
+		LastGoodIndex:  m.LastGoodIndex,
+	}}
+	if !reflect.DeepEqual(o.repairs, wrepair) || wrepair[0].TruncatedBytes <= 0 {
+		t.Errorf("repairs = %+v, want %+v", o.repairs, wrepair)
+	}
+
+	mb, err := ioutil.ReadFile(filepath.Join(m.Path, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved QuarantineManifest
+	if err = json.Unmarshal(mb, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.LastGoodIndex != m.LastGoodIndex || saved.Segment != m.Segment || saved.Status != QuarantineComplete {
+		t.Errorf("saved manifest = %+v, want %+v", saved, m)
+	}
+
+	// the WAL recovers up to the last good index, and appends after it
+	w, err = Open(dir, &walpb.Snapshot{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(ents)) != m.LastGoodIndex {
+		t.Fatalf("len(ents) = %d, want %d", len(ents), m.LastGoodIndex)
+	}
+	if err = w.SaveEntry([]LogEntry{&walpb.Entry{Index: m.LastGoodIndex + 1}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err = Verify(zap.NewExample(), dir, &walpb.Snapshot{}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairCorruptionHead(t *testing.T) {
+	dir, w := createRangeWAL(t, 10)
+	defer os.RemoveAll(dir)
+	w.Close()
+	q := filepath.Join(dir, "quarantine")
+
+	// flip a byte of the metadata record
+	seg := filepath.Join(dir, walName(0, 0))
+	offs := recordOffsets(t, seg)
+	b, err := ioutil.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[offs[1]+frameSizeBytes+1] ^= 0xff
+	if err = ioutil.WriteFile(seg, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = RepairCorruption(zap.NewExample(), dir, q, nil); errors.Cause(err) != ErrHeadCorrupted {
+		t.Fatalf("err = %v, want %v", err, ErrHeadCorrupted)
+	}
+	if fileExists(q) {
+		t.Errorf("quarantine directory created")
+	}
+	if nb, err := ioutil.ReadFile(seg); err != nil || len(nb) != len(b) {
+		t.Errorf("segment changed: %d bytes, want %d (%v)", len(nb), len(b), err)
+	}
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
 )
 
 type RecordType int64
@@ -15,6 +16,7 @@ const (
 	StateType
 	CrcType
 	SnapshotType
+	TruncateType
 )
 
 type RecordData interface {
@@ -47,76 +49,162 @@ type Snapshot interface {
 	GetIndex() uint64
 }
 
-var recordTypes sync.Map // map[RecordType]interface{}
+// unmarshalRecord decodes the data of rec into v. Data that passed the crc
+// but does not decode is reported as ErrInvalidRecord instead of a panic.
+func unmarshalRecord(v RecordData, rec *walpb.Record) error {
+	if err := v.Unmarshal(rec.Data); err != nil {
+		return errors.Wrapf(ErrInvalidRecord, "record type %d: %v", rec.Type, err)
+	}
+	return nil
+}
 
-func RegisterRecord(rt RecordType, ent interface{}) {
+// Registry maps record types to the values records are decoded into. Each
+// WAL decodes with the Registry of its Options, so WALs of different entry
+// types can live in the same process; the package-level functions use the
+// default Registry.
+type Registry struct {
+	factories sync.Map // map[RecordType]func() interface{}
+	kinds     sync.Map // map[RecordType]RecordKind
+}
+
+// NewRegistry returns a Registry with the walpb records registered.
+func NewRegistry() *Registry {
+	r := &Registry{}
+	r.RegisterEntryFactory(func() LogEntry { return &walpb.Entry{} })
+	r.RegisterStateFactory(func() HardState { return &walpb.HardState{} })
+	r.RegisterSnapshotFactory(func() Snapshot { return &walpb.Snapshot{} })
+	return r
+}
+
+var defaultRegistry = NewRegistry()
+
+// DefaultRegistry returns the Registry used by WALs whose Options set none.
+func DefaultRegistry() *Registry { return defaultRegistry }
+
+// Register registers the type of ent for the records of type rt. Decoded
+// records are new zero values of that type, constructed by reflection;
+// the Register*Factory methods avoid it.
+func (r *Registry) Register(rt RecordType, ent interface{}) {
 	switch ent.(type) {
 	case LogEntry, HardState, Snapshot:
-		recordTypes.Store(rt, ent)
+		r.factories.Store(rt, reflectFactory(ent))
 	default:
 		panic("invalid record struct")
 	}
 }
 
-func NewEmptyEntry() (e LogEntry) {
-	entry, ok := recordTypes.Load(EntryType)
-	if !ok {
-		panic("not register entry record type")
-	}
-	ent, ok := entry.(LogEntry)
-	if !ok {
-		panic("invalid entry record data")
-	}
-	if reflect.TypeOf(ent).Kind() == reflect.Ptr {
+// RegisterEntryFactory registers newEntry to construct decoded entries.
+func (r *Registry) RegisterEntryFactory(newEntry func() LogEntry) {
+	r.factories.Store(EntryType, func() interface{} { return newEntry() })
+}
+
+// RegisterStateFactory registers newState to construct decoded states.
+func (r *Registry) RegisterStateFactory(newState func() HardState) {
+	r.factories.Store(StateType, func() interface{} { return newState() })
+}
+
+// RegisterSnapshotFactory registers newSnap to construct decoded snapshots.
+func (r *Registry) RegisterSnapshotFactory(newSnap func() Snapshot) {
+	r.factories.Store(SnapshotType, func() interface{} { return newSnap() })
+}
+
+func reflectFactory(v interface{}) func() interface{} {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
 		// Pointer:
-		e = reflect.New(reflect.ValueOf(ent).Elem().Type()).Interface().(LogEntry)
-	} else {
-		// Not pointer:
-		e = reflect.New(reflect.TypeOf(ent)).Elem().Interface().(LogEntry)
+		et := t.Elem()
+		return func() interface{} { return reflect.New(et).Interface() }
 	}
-	return
+	// Not pointer:
+	return func() interface{} { return reflect.New(t).Elem().Interface() }
 }
 
-func NewEmptyState() (s HardState) {
-	state, ok := recordTypes.Load(StateType)
+// newEmpty returns a new value of the type registered for rt.
+func (r *Registry) newEmpty(rt RecordType) interface{} {
+	f, ok := r.factories.Load(rt)
 	if !ok {
-		panic("not register hardstate record type")
+		return nil
 	}
-	hs, ok := state.(HardState)
+	return f.(func() interface{})()
+}
+
+func (r *Registry) NewEntry() LogEntry {
+	e, ok := r.newEmpty(EntryType).(LogEntry)
 	if !ok {
-		panic("invalid hardstate record data")
-	}
-	if reflect.TypeOf(hs).Kind() == reflect.Ptr {
-		// Pointer:
-		s = reflect.New(reflect.ValueOf(hs).Elem().Type()).Interface().(HardState)
-	} else {
-		// Not pointer:
-		s = reflect.New(reflect.TypeOf(hs)).Elem().Interface().(HardState)
+		panic("not register entry record type")
 	}
-	return
+	return e
 }
 
-func NewEmptySnapshot() (s Snapshot) {
-	snapshot, ok := recordTypes.Load(SnapshotType)
+func (r *Registry) NewState() HardState {
+	s, ok := r.newEmpty(StateType).(HardState)
 	if !ok {
-		panic("not register snapshot record type")
+		panic("not register hardstate record type")
 	}
-	snap, ok := snapshot.(Snapshot)
+	return s
+}
+
+func (r *Registry) NewSnapshot() Snapshot {
+	s, ok := r.newEmpty(SnapshotType).(Snapshot)
 	if !ok {
-		panic("invalid snapshot record data")
+		panic("not register snapshot record type")
 	}
-	if reflect.TypeOf(snap).Kind() == reflect.Ptr {
-		// Pointer:
-		s = reflect.New(reflect.ValueOf(snap).Elem().Type()).Interface().(Snapshot)
-	} else {
-		// Not pointer:
-		s = reflect.New(reflect.TypeOf(snap)).Elem().Interface().(Snapshot)
+	return s
+}
+
+// EntryPool is a pooled allocator of entries. Register its New method as
+// the entry factory, and Put back the entries passed to a Replay callback
+// once they are applied, so that recovering a large log reuses them.
+type EntryPool struct {
+	pool sync.Pool
+}
+
+func NewEntryPool(newEntry func() LogEntry) *EntryPool {
+	return &EntryPool{pool: sync.Pool{New: func() interface{} { return newEntry() }}}
+}
+
+// New returns an entry from the pool, or a new one from the factory.
+func (p *EntryPool) New() LogEntry {
+	return p.pool.Get().(LogEntry)
+}
+
+// Put returns e to the pool; e must no longer be referenced. It is reset
+// first if it has a Reset method, as Unmarshal may leave the fields the
+// record does not set untouched.
+func (p *EntryPool) Put(e LogEntry) {
+	if r, ok := e.(interface{ Reset() }); ok {
+		r.Reset()
 	}
-	return
+	p.pool.Put(e)
+}
+
+func RegisterRecord(rt RecordType, ent interface{}) {
+	defaultRegistry.Register(rt, ent)
+}
+
+// RegisterEntryFactory registers newEntry in the default Registry.
+func RegisterEntryFactory(newEntry func() LogEntry) {
+	defaultRegistry.RegisterEntryFactory(newEntry)
+}
+
+// RegisterStateFactory registers newState in the default Registry.
+func RegisterStateFactory(newState func() HardState) {
+	defaultRegistry.RegisterStateFactory(newState)
+}
+
+// RegisterSnapshotFactory registers newSnap in the default Registry.
+func RegisterSnapshotFactory(newSnap func() Snapshot) {
+	defaultRegistry.RegisterSnapshotFactory(newSnap)
+}
+
+func NewEmptyEntry() LogEntry {
+	return defaultRegistry.NewEntry()
+}
+
+func NewEmptyState() HardState {
+	return defaultRegistry.NewState()
 }
 
-func init() {
-	RegisterRecord(EntryType, LogEntry(&walpb.Entry{}))
-	RegisterRecord(StateType, HardState(&walpb.HardState{}))
-	RegisterRecord(SnapshotType, Snapshot(&walpb.Snapshot{}))
+func NewEmptySnapshot() Snapshot {
+	return defaultRegistry.NewSnapshot()
 }
@@ -7,10 +7,15 @@ SPDX-License-Identifier: Apache-2.0
 package log
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/BeDreamCoder/wal/log/walpb"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func TestNewEmptyEntry(t *testing.T) {
@@ -18,6 +23,83 @@ func TestNewEmptyEntry(t *testing.T) {
 	assert.EqualValues(t, &walpb.Entry{}, e)
 }
 
+type jsonEntry struct {
+	Index uint64
+	Value string
+}
+
+func (m *jsonEntry) Marshal() ([]byte, error) { return json.Marshal(m) }
+
+func (m *jsonEntry) Unmarshal(data []byte) error { return json.Unmarshal(data, m) }
+
+func (m *jsonEntry) GetIndex() uint64 { return m.Index }
+
+func (m *jsonEntry) Size() int { return 16 + len(m.Value) }
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	assert.EqualValues(t, &walpb.Entry{}, r.NewEntry())
+	r.Register(EntryType, LogEntry(&jsonEntry{}))
+	assert.EqualValues(t, &jsonEntry{}, r.NewEntry())
+	assert.EqualValues(t, &walpb.HardState{}, r.NewState())
+	// the default registry is left untouched
+	assert.EqualValues(t, &walpb.Entry{}, NewEmptyEntry())
+}
+
+// TestRegistryPerWAL ensures two WALs of different entry types can be
+// used side by side.
+func TestRegistryPerWAL(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	r := NewRegistry()
+	r.Register(EntryType, LogEntry(&jsonEntry{}))
+	jsonOpts := &Options{Logger: zap.NewExample(), Registry: r}
+
+	jw, err := Create(filepath.Join(p, "json"), nil, jsonOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := Create(filepath.Join(p, "pb"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = jw.SaveEntry([]LogEntry{&jsonEntry{Index: 1, Value: "v"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = pw.SaveEntry([]LogEntry{&walpb.Entry{Index: 1, Data: []byte("v")}}); err != nil {
+		t.Fatal(err)
+	}
+	jw.Close()
+	pw.Close()
+
+	if jw, err = Open(filepath.Join(p, "json"), r.NewSnapshot(), jsonOpts); err != nil {
+		t.Fatal(err)
+	}
+	defer jw.Close()
+	_, _, ents, err := jw.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, []LogEntry{&jsonEntry{Index: 1, Value: "v"}}, ents)
+
+	if pw, err = Open(filepath.Join(p, "pb"), NewEmptySnapshot(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+	if _, _, ents, err = pw.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, []LogEntry{&walpb.Entry{Index: 1, Data: []byte("v")}}, ents)
+
+	assert.NoError(t, Verify(zap.NewExample(), filepath.Join(p, "json"), r.NewSnapshot(), jsonOpts))
+	_, err = ValidSnapshotEntries(zap.NewExample(), filepath.Join(p, "json"), jsonOpts)
+	assert.NoError(t, err)
+}
+
 func BenchmarkNewEmptyEntry(b *testing.B) {
 	b.ReportAllocs()
 
@@ -29,6 +111,59 @@ func BenchmarkNewEmptyEntry(b *testing.B) {
 	}
 }
 
+func TestRegistryFactories(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterEntryFactory(func() LogEntry { return &jsonEntry{Value: "new"} })
+	assert.EqualValues(t, &jsonEntry{Value: "new"}, r.NewEntry())
+
+	// values are registered as such
+	r.Register(SnapshotType, Snapshot(valueSnapshot{}))
+	assert.EqualValues(t, valueSnapshot{}, r.NewSnapshot())
+
+	var n int
+	pool := NewEntryPool(func() LogEntry {
+		n++
+		return &walpb.Entry{}
+	})
+	r.RegisterEntryFactory(pool.New)
+	e := r.NewEntry().(*walpb.Entry)
+	e.Index = 7
+	pool.Put(e)
+	assert.EqualValues(t, &walpb.Entry{}, r.NewEntry())
+	assert.NotZero(t, n)
+}
+
+type valueSnapshot struct{}
+
+func (valueSnapshot) Marshal() ([]byte, error) { return nil, nil }
+
+func (valueSnapshot) Unmarshal([]byte) error { return nil }
+
+func (valueSnapshot) GetIndex() uint64 { return 0 }
+
+func BenchmarkRegisterRecordEntry(b *testing.B) {
+	b.ReportAllocs()
+
+	r := NewRegistry()
+	r.Register(EntryType, LogEntry(&walpb.Entry{}))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.NewEntry()
+	}
+}
+
+func BenchmarkEntryPool(b *testing.B) {
+	b.ReportAllocs()
+
+	r := NewRegistry()
+	pool := NewEntryPool(func() LogEntry { return &walpb.Entry{} })
+	r.RegisterEntryFactory(pool.New)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pool.Put(r.NewEntry())
+	}
+}
+
 func BenchmarkEmptyEntry(b *testing.B) {
 	b.ReportAllocs()
 
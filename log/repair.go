@@ -27,20 +27,37 @@ import (
 
 // Repair tries to repair ErrUnexpectedEOF in the
 // last wal file by truncating.
-func Repair(lg *zap.Logger, dirpath string) bool {
+func Repair(lg *zap.Logger, dirpath string, opts *Options) bool {
+	_, err := RepairTail(lg, dirpath, opts)
+	return err == nil
+}
+
+// RepairTail is Repair returning the number of bytes truncated from the
+// last wal file, or the reason it cannot be repaired.
+func RepairTail(lg *zap.Logger, dirpath string, opts *Options) (int64, error) {
 	if lg == nil {
 		lg = zap.NewNop()
 	}
-	f, err := openLast(lg, dirpath)
+	opts, err := opts.withDefaults()
+	if err != nil {
+		lg.Warn("failed to repair", zap.String("path", dirpath), zap.Error(err))
+		return 0, err
+	}
+	m, err := opts.metrics()
 	if err != nil {
-		return false
+		lg.Warn("failed to repair", zap.String("path", dirpath), zap.Error(err))
+		return 0, err
+	}
+	f, err := openLast(lg, opts.FS, dirpath)
+	if err != nil {
+		return 0, err
 	}
 	defer f.Close()
 
 	lg.Info("repairing", zap.String("path", f.Name()))
 
 	rec := &walpb.Record{}
-	decoder := newDecoder(f)
+	decoder := newDecoderOpts(opts, f)
 	for {
 		lastOffset := decoder.lastOffset()
 		err := decoder.decode(rec)
@@ -49,66 +66,71 @@ func Repair(lg *zap.Logger, dirpath string) bool {
 			// update crc of the decoder when necessary
 			switch rec.Type {
 			case int64(CrcType):
-				crc := decoder.crc.Sum32()
-				// current crc of decoder must match the crc of the record.
-				// do no need to match 0 crc, since the decoder is a new one at this case.
-				if crc != 0 && rec.Validate(crc) != nil {
-					return false
+				if err = decoder.chainCRC(rec); err != nil {
+					return 0, err
+				}
+			case int64(MetadataType), int64(EntryType), int64(StateType), int64(SnapshotType), int64(TruncateType):
+			default:
+				if _, _, err = opts.Registry.readUserRecord(rec); err != nil {
+					lg.Warn("failed to repair", zap.String("path", f.Name()), zap.Error(err))
+					return 0, err
 				}
-				decoder.updateCRC(rec.Crc)
 			}
 			continue
 
 		case io.EOF:
 			lg.Info("repaired", zap.String("path", f.Name()), zap.Error(io.EOF))
-			return true
+			return 0, nil
 
 		case io.ErrUnexpectedEOF:
-			bf, bferr := os.Create(f.Name() + ".broken")
+			bf, bferr := opts.FS.OpenFile(f.Name()+".broken", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 			if bferr != nil {
 				lg.Warn("failed to create backup file", zap.String("path", f.Name()+".broken"), zap.Error(bferr))
-				return false
+				return 0, bferr
 			}
 			defer bf.Close()
 
 			if _, err = f.Seek(0, io.SeekStart); err != nil {
 				lg.Warn("failed to read file", zap.String("path", f.Name()), zap.Error(err))
-				return false
+				return 0, err
 			}
 
-			if _, err = io.Copy(bf, f); err != nil {
+			size, err := io.Copy(bf, f)
+			if err != nil {
 				lg.Warn("failed to copy", zap.String("from", f.Name()+".broken"), zap.String("to", f.Name()), zap.Error(err))
-				return false
+				return 0, err
 			}
 
 			if err = f.Truncate(lastOffset); err != nil {
 				lg.Warn("failed to truncate", zap.String("path", f.Name()), zap.Error(err))
-				return false
+				return 0, err
 			}
 
 			start := time.Now()
-			if err = fileutil.Fsync(f.File); err != nil {
+			if err = opts.FS.Fsync(f); err != nil {
 				lg.Warn("failed to fsync", zap.String("path", f.Name()), zap.Error(err))
-				return false
+				return 0, err
 			}
-			walFsyncSec.Observe(time.Since(start).Seconds())
+			m.fsyncSec.Observe(time.Since(start).Seconds())
+			m.repairs.Inc()
+			opts.Observer.Repaired(RepairEvent{Path: f.Name(), BrokenPath: bf.Name(), TruncatedBytes: size - lastOffset})
 
 			lg.Info("repaired", zap.String("path", f.Name()), zap.Error(io.ErrUnexpectedEOF))
-			return true
+			return size - lastOffset, nil
 
 		default:
 			lg.Warn("failed to repair", zap.String("path", f.Name()), zap.Error(err))
-			return false
+			return 0, err
 		}
 	}
 }
 
 // openLast opens the last wal file for read and write.
-func openLast(lg *zap.Logger, dirpath string) (*fileutil.LockedFile, error) {
-	names, err := readWALNames(lg, dirpath)
+func openLast(lg *zap.Logger, fs FS, dirpath string) (File, error) {
+	names, err := readWALNames(lg, fs, dirpath)
 	if err != nil {
 		return nil, err
 	}
 	last := filepath.Join(dirpath, names[len(names)-1])
-	return fileutil.LockFile(last, os.O_RDWR, fileutil.PrivateFileMode)
+	return fs.LockFile(last, os.O_RDWR, fileutil.PrivateFileMode)
 }
@@ -19,6 +19,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/BeDreamCoder/wal/log/walpb"
@@ -30,7 +31,7 @@ type corruptFunc func(string, int64) error
 // TestRepairTruncate ensures a truncated file can be repaired
 func TestRepairTruncate(t *testing.T) {
 	corruptf := func(p string, offset int64) error {
-		f, err := openLast(zap.NewExample(), p)
+		f, err := openLast(zap.NewExample(), OSFS, p)
 		if err != nil {
 			return err
 		}
@@ -49,7 +50,7 @@ func testRepair(t *testing.T, ents [][]LogEntry, corrupt corruptFunc, expectedEn
 	defer os.RemoveAll(p)
 
 	// create WAL
-	w, err := Create(zap.NewExample(), p, nil)
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample()})
 	defer func() {
 		if err = w.Close(); err != nil {
 			t.Fatal(err)
@@ -77,7 +78,7 @@ func testRepair(t *testing.T, ents [][]LogEntry, corrupt corruptFunc, expectedEn
 	}
 
 	// verify we broke the wal
-	w, err = Open(zap.NewExample(), p, &walpb.Snapshot{})
+	w, err = Open(p, &walpb.Snapshot{}, &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -88,12 +89,12 @@ func testRepair(t *testing.T, ents [][]LogEntry, corrupt corruptFunc, expectedEn
 	w.Close()
 
 	// repair the wal
-	if ok := Repair(zap.NewExample(), p); !ok {
+	if ok := Repair(zap.NewExample(), p, nil); !ok {
 		t.Fatalf("'Repair' returned '%v', want 'true'", ok)
 	}
 
 	// read it back
-	w, err = Open(zap.NewExample(), p, &walpb.Snapshot{})
+	w, err = Open(p, &walpb.Snapshot{}, &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -115,7 +116,7 @@ func testRepair(t *testing.T, ents [][]LogEntry, corrupt corruptFunc, expectedEn
 	w.Close()
 
 	// read back entries following repair, ensure it's all there
-	w, err = Open(zap.NewExample(), p, NewEmptySnapshot())
+	w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,29 +139,70 @@ func makeEnts(ents int) (ret [][]LogEntry) {
 // TestRepairWriteTearLast repairs the WAL in case the last record is a torn write
 // that straddled two sectors.
 func TestRepairWriteTearLast(t *testing.T) {
+	// an entry frame holds at least its length field and 8 bytes of record,
+	// so the entries span two sectors past the segment header
+	ents := makeEnts(2 * minSectorSize / (2 * frameSizeBytes))
+	tear, before := tearOffset(t, ents)
 	corruptf := func(p string, offset int64) error {
-		f, err := openLast(zap.NewExample(), p)
+		f, err := openLast(zap.NewExample(), OSFS, p)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-		// 512 bytes perfectly aligns the last record, so use 1024
-		if offset < 1024 {
-			return fmt.Errorf("got offset %d, expected >1024", offset)
+		if offset <= tear {
+			return fmt.Errorf("got offset %d, expected >%d", offset, tear)
 		}
-		if terr := f.Truncate(1024); terr != nil {
+		if terr := f.Truncate(tear); terr != nil {
 			return terr
 		}
 		return f.Truncate(offset)
 	}
-	testRepair(t, makeEnts(50), corruptf, 40)
+	testRepair(t, ents, corruptf, before)
+}
+
+// tearOffset lays ents out in a scratch WAL as testRepair does, and returns
+// the first sector boundary that falls inside an entry record rather than
+// between two, as the segment header shifts the records, and the number of
+// entries before it.
+func tearOffset(t *testing.T, ents [][]LogEntry) (tear int64, before int) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, es := range ents {
+		if err = w.Save(&walpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	end, err := w.tail().Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the crc, metadata and snapshot records precede the entries
+	offs := append(recordOffsets(t, filepath.Join(p, walName(0, 0)))[3:], end)
+	for tear = minSectorSize; tear < end; tear += minSectorSize {
+		for i := 0; i+1 < len(offs); i++ {
+			if offs[i] < tear && tear < offs[i+1] {
+				return tear, i
+			}
+		}
+	}
+	t.Fatal("no sector boundary inside an entry record")
+	return 0, 0
 }
 
 // TestRepairWriteTearMiddle repairs the WAL when there is write tearing
 // in the middle of a record.
 //func TestRepairWriteTearMiddle(t *testing.T) {
 //	corruptf := func(p string, offset int64) error {
-//		f, err := openLast(zap.NewExample(), p)
+//		f, err := openLast(zap.NewExample(), OSFS, p)
 //		if err != nil {
 //			return err
 //		}
@@ -188,16 +230,11 @@ func TestRepairFailDeleteDir(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(zap.NewExample(), p, nil)
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample(), SegmentSizeBytes: 64})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	oldSegmentSizeBytes := SegmentSizeBytes
-	SegmentSizeBytes = 64
-	defer func() {
-		SegmentSizeBytes = oldSegmentSizeBytes
-	}()
 	for _, es := range makeEnts(50) {
 		if err = w.Save(NewEmptyState(), es); err != nil {
 			t.Fatal(err)
@@ -210,7 +247,7 @@ func TestRepairFailDeleteDir(t *testing.T) {
 	}
 	w.Close()
 
-	f, err := openLast(zap.NewExample(), p)
+	f, err := openLast(zap.NewExample(), OSFS, p)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -219,7 +256,7 @@ func TestRepairFailDeleteDir(t *testing.T) {
 	}
 	f.Close()
 
-	w, err = Open(zap.NewExample(), p, NewEmptySnapshot())
+	w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -230,7 +267,7 @@ func TestRepairFailDeleteDir(t *testing.T) {
 	w.Close()
 
 	os.RemoveAll(p)
-	if Repair(zap.NewExample(), p) {
+	if Repair(zap.NewExample(), p, nil) {
 		t.Fatal("expect 'Repair' fail on unexpected directory deletion")
 	}
 }
@@ -0,0 +1,220 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+)
+
+// ErrStopReplay can be returned by a Replay callback to stop receiving records.
+var ErrStopReplay = errors.New("wal: stop replay")
+
+// RecordView is a single decoded record passed to a Replay callback.
+// Only the field matching Type is set.
+type RecordView struct {
+	Type RecordType
+
+	Entry    LogEntry  // set if Type is EntryType
+	State    HardState // set if Type is StateType
+	Snapshot Snapshot  // set if Type is SnapshotType
+	Metadata []byte    // set if Type is MetadataType
+	Index    uint64    // set if Type is TruncateType
+
+	Record RecordData // set if Type is a user-defined record kind
+}
+
+// Replay streams the records of the current WAL to fn one at a time, in the
+// order they were written, instead of materializing them like ReadAll.
+// Only entries after the snap the WAL was opened at are passed to fn; an
+// entry may overwrite entries of an equal or higher index passed before it,
+// so callers must truncate what they have kept accordingly. Likewise a
+// TruncateType record discards every entry passed before it whose index is
+// larger than its Index. Crc records are verified but never passed to fn,
+// and neither are records of unknown ignorable kinds; see RegisterRecordKind.
+//
+// If fn returns ErrStopReplay, no more records are passed to fn. A WAL opened
+// for reading stops decoding right away; a WAL opened in write mode still
+// reads through the remaining records, without handing them out, so that it
+// is ready for appending afterwards. Any other error returned by fn aborts
+// Replay and is returned as is.
+//
+// Like ReadAll, Replay returns ErrSnapshotNotFound if it cannot read out the
+// expected snap, and the WAL is ready for appending after it returns nil or
+// ErrSnapshotNotFound. fn is called with the WAL locked and must not call
+// back into it.
+func (w *WAL) Replay(fn func(rec RecordView) error) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.decoder == nil {
+		return ErrDecoderNotFound
+	}
+	decoder := w.decoder
+
+	var (
+		metadata []byte
+		match    bool
+		stopped  bool
+	)
+	state := w.opts.Registry.NewState()
+	rec := &walpb.Record{}
+
+	deliver := func(view RecordView) error {
+		if stopped {
+			return nil
+		}
+		if ferr := fn(view); ferr != nil {
+			if ferr != ErrStopReplay {
+				return ferr
+			}
+			stopped = true
+		}
+		return nil
+	}
+
+	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
+		switch rec.Type {
+		case int64(EntryType):
+			e := w.opts.Registry.NewEntry()
+			if err = unmarshalRecord(e, rec); err != nil {
+				return err
+			}
+			if e.GetIndex() > w.start.GetIndex() {
+				err = deliver(RecordView{Type: EntryType, Entry: e})
+			}
+			w.enti = e.GetIndex()
+			if w.tail() != nil && len(decoder.brs) == 1 {
+				// index the tail segment for ReadRange
+				w.tailIdx.add(e.GetIndex(), decoder.recOff, decoder.recCrc)
+			}
+
+		case int64(StateType):
+			s := w.opts.Registry.NewState()
+			if err = unmarshalRecord(s, rec); err != nil {
+				return err
+			}
+			state = s
+			err = deliver(RecordView{Type: StateType, State: s})
+
+		case int64(TruncateType):
+			var index uint64
+			if index, err = decodeTruncate(rec.Data); err != nil {
+				return err
+			}
+			if index < w.start.GetIndex() {
+				// the snap was taken past the truncation
+				match = false
+			}
+			if index < w.enti {
+				w.enti = index
+			}
+			if w.tail() != nil && len(decoder.brs) == 1 {
+				w.tailIdx.touch(index + 1)
+			}
+			err = deliver(RecordView{Type: TruncateType, Index: index})
+
+		case int64(MetadataType):
+			if metadata != nil && !bytes.Equal(metadata, rec.Data) {
+				return ErrMetadataConflict
+			}
+			if metadata == nil {
+				err = deliver(RecordView{Type: MetadataType, Metadata: rec.Data})
+			}
+			metadata = rec.Data
+
+		case int64(CrcType):
+			if err = decoder.chainCRC(rec); err != nil {
+				return err
+			}
+
+		case int64(SnapshotType):
+			snap := w.opts.Registry.NewSnapshot()
+			if err = unmarshalRecord(snap, rec); err != nil {
+				return err
+			}
+			if snap.GetIndex() == w.start.GetIndex() {
+				match = true
+			}
+			err = deliver(RecordView{Type: SnapshotType, Snapshot: snap})
+
+		default:
+			var (
+				data RecordData
+				ok   bool
+			)
+			if data, ok, err = w.opts.Registry.readUserRecord(rec); err == nil && ok {
+				err = deliver(RecordView{Type: RecordType(rec.Type), Record: data})
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if stopped && w.tail() == nil {
+			// nothing to prepare for appending in read mode
+			err = io.EOF
+			break
+		}
+	}
+
+	switch w.tail() {
+	case nil:
+		// We do not have to read out all entries in read mode.
+		// The last record maybe a partial written one, so
+		// ErrunexpectedEOF might be returned.
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	default:
+		// We must read all of the entries if WAL is opened in write mode.
+		if err != io.EOF {
+			return err
+		}
+		// decodeRecord() will return io.EOF if it detects a zero record,
+		// but this zero record may be followed by non-zero records from
+		// a torn write. Overwriting some of these non-zero records, but
+		// not all, will cause CRC errors on WAL open. Since the records
+		// were never fully synced to disk in the first place, it's safe
+		// to zero them out to avoid any CRC errors from new writes.
+		if _, err = w.tail().Seek(w.decoder.lastOffset(), io.SeekStart); err != nil {
+			return err
+		}
+		if err = zeroToEnd(w.opts.FS, w.tail()); err != nil {
+			return err
+		}
+	}
+
+	err = nil
+	if !match {
+		err = ErrSnapshotNotFound
+	}
+
+	// close decoder, disable reading
+	if w.readClose != nil {
+		w.readClose()
+		w.readClose = nil
+	}
+	w.start = w.opts.Registry.NewSnapshot()
+
+	w.metadata = metadata
+	w.state = state
+
+	if w.tail() != nil {
+		// create encoder (chain crc with the decoder), enable appending
+		var eerr error
+		if w.encoder, eerr = newFileEncoder(w.tail(), w.decoder.lastCRC(), w.opts, w.metrics); eerr != nil {
+			return eerr
+		}
+		w.metrics.lastIndex.Set(float64(w.enti))
+	}
+	w.decoder = nil
+
+	return err
+}
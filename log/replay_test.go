@@ -0,0 +1,186 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"go.uber.org/zap"
+)
+
+// createReplayWAL creates a WAL holding entries 1..n and a committed state per entry.
+func createReplayWAL(t *testing.T, n int) string {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 1; i <= n; i++ {
+		es := []LogEntry{&walpb.Entry{Index: uint64(i), Data: []byte{byte(i)}}}
+		if err = w.Save(&walpb.HardState{Committed: uint64(i)}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func TestReplay(t *testing.T) {
+	p := createReplayWAL(t, 5)
+	defer os.RemoveAll(p)
+
+	w, err := Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var (
+		metadata []byte
+		snaps    int
+		ents     []LogEntry
+		state    HardState
+	)
+	err = w.Replay(func(rec RecordView) error {
+		switch rec.Type {
+		case MetadataType:
+			metadata = rec.Metadata
+		case SnapshotType:
+			snaps++
+		case EntryType:
+			ents = append(ents, rec.Entry)
+		case StateType:
+			state = rec.State
+		default:
+			t.Errorf("unexpected record type %d", rec.Type)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(metadata, []byte("metadata")) {
+		t.Errorf("metadata = %s, want %s", metadata, "metadata")
+	}
+	if snaps != 1 {
+		t.Errorf("snapshots = %d, want %d", snaps, 1)
+	}
+	if len(ents) != 5 {
+		t.Errorf("len(ents) = %d, want %d", len(ents), 5)
+	}
+	for i, e := range ents {
+		if e.GetIndex() != uint64(i+1) {
+			t.Errorf("#%d: index = %d, want %d", i, e.GetIndex(), i+1)
+		}
+	}
+	if state.GetCommitted() != 5 {
+		t.Errorf("committed = %d, want %d", state.GetCommitted(), 5)
+	}
+
+	// the WAL is ready to append, including a state only append
+	if err = w.SaveState(&walpb.HardState{Committed: 6}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReplayStop ensures that a WAL opened in write mode is ready to append
+// after the callback stops the replay early.
+func TestReplayStop(t *testing.T) {
+	p := createReplayWAL(t, 5)
+	defer os.RemoveAll(p)
+
+	w, err := Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen int
+	err = w.Replay(func(rec RecordView) error {
+		if rec.Type == EntryType {
+			seen++
+			if seen == 2 {
+				return ErrStopReplay
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != 2 {
+		t.Errorf("seen = %d, want %d", seen, 2)
+	}
+	if w.enti != 5 {
+		t.Errorf("enti = %d, want %d", w.enti, 5)
+	}
+	es := []LogEntry{&walpb.Entry{Index: 6, Data: []byte{6}}}
+	if err = w.Save(&walpb.HardState{Committed: 6}, es); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()}); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, state, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 6 {
+		t.Errorf("len(ents) = %d, want %d", len(ents), 6)
+	}
+	if state.GetCommitted() != 6 {
+		t.Errorf("committed = %d, want %d", state.GetCommitted(), 6)
+	}
+}
+
+func TestReplayStopForRead(t *testing.T) {
+	p := createReplayWAL(t, 5)
+	defer os.RemoveAll(p)
+
+	w, err := OpenForRead(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var seen int
+	err = w.Replay(func(rec RecordView) error {
+		seen++
+		return ErrStopReplay
+	})
+	if err != ErrSnapshotNotFound {
+		t.Errorf("err = %v, want %v", err, ErrSnapshotNotFound)
+	}
+	if seen != 1 {
+		t.Errorf("seen = %d, want %d", seen, 1)
+	}
+}
+
+func TestReplayCallbackError(t *testing.T) {
+	p := createReplayWAL(t, 5)
+	defer os.RemoveAll(p)
+
+	w, err := Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	errReplay := errors.New("replay failed")
+	if err = w.Replay(func(rec RecordView) error { return errReplay }); err != errReplay {
+		t.Errorf("err = %v, want %v", err, errReplay)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// SegmentRecord is a record as it is stored in a segment.
+type SegmentRecord struct {
+	Segment string
+	Offset  int64 // offset of the record frame in Segment
+	Size    int64 // size of the record frame, with its length and padding
+	Type    RecordType
+	Crc     uint32
+	Data    []byte // the record data, decrypted and decompressed
+}
+
+// ScanRecords reads through the segments of the WAL in dirpath in order,
+// and passes every record to fn, checking the crc chain across them. It
+// stops at the first record that does not read back, returning the error
+// with its segment and offset, or at the first error of fn. Like Verify,
+// it does not conflict with an open WAL.
+func ScanRecords(lg *zap.Logger, dirpath string, opts *Options, fn func(rec SegmentRecord) error) error {
+	if lg == nil {
+		lg = zap.NewNop()
+	}
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	names, err := readWALNames(lg, opts.FS, dirpath)
+	if err != nil {
+		return err
+	}
+
+	var prevCrc uint32
+	for _, name := range names {
+		if prevCrc, err = scanRecords(filepath.Join(dirpath, name), prevCrc, opts, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanRecords passes the records of the segment at fpath, chained to
+// prevCrc, to fn, and returns the crc of its last record.
+func scanRecords(fpath string, prevCrc uint32, opts *Options, fn func(rec SegmentRecord) error) (uint32, error) {
+	f, err := opts.FS.OpenFile(fpath, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err = readSegmentVersion(f); err != nil {
+		return 0, errors.Wrapf(err, "open %s", fpath)
+	}
+
+	name := filepath.Base(fpath)
+	rec := &walpb.Record{}
+	decoder := newDecoderOpts(opts, f)
+	decoder.updateCRC(prevCrc)
+	for {
+		off := decoder.lastOffset()
+		err = decoder.decode(rec)
+		if err == io.EOF {
+			return decoder.lastCRC(), nil
+		}
+		if err == nil && rec.Type == int64(CrcType) {
+			err = decoder.chainCRC(rec)
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "%s at offset %d", name, off)
+		}
+		if err = fn(SegmentRecord{
+			Segment: name,
+			Offset:  decoder.recOff,
+			Size:    decoder.lastOffset() - decoder.recOff,
+			Type:    RecordType(rec.Type),
+			Crc:     rec.Crc,
+			Data:    rec.Data,
+		}); err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"go.uber.org/zap"
+)
+
+func TestScanRecords(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p)
+
+	createPlanWAL(t, p, 50, &Options{SegmentSizeBytes: 2048})
+	names, err := readWALNames(zap.NewExample(), OSFS, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ents []uint64
+		segs = map[string]bool{}
+		next int64
+		last string
+	)
+	err = ScanRecords(zap.NewExample(), p, nil, func(rec SegmentRecord) error {
+		if rec.Segment != last {
+			// records follow the header of each segment
+			last, next = rec.Segment, segmentHeaderBytes
+		}
+		if rec.Offset != next {
+			t.Fatalf("%s: offset = %d, want %d", rec.Segment, rec.Offset, next)
+		}
+		next = rec.Offset + rec.Size
+		segs[rec.Segment] = true
+		if rec.Type == EntryType {
+			e := &walpb.Entry{}
+			if err := e.Unmarshal(rec.Data); err != nil {
+				return err
+			}
+			ents = append(ents, e.Index)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != len(names) {
+		t.Errorf("scanned %d segments, want %d", len(segs), len(names))
+	}
+	if len(ents) != 50 || ents[49] != 50 {
+		t.Errorf("entries = %v, want 1 to 50", ents)
+	}
+}
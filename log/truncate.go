@@ -0,0 +1,85 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"encoding/binary"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrTruncateCommitted = errors.New("wal: cannot truncate committed entries")
+	errBadTruncateRecord = errors.New("wal: bad truncate record")
+)
+
+// TruncateAfter discards every entry with an index larger than index, such
+// as the conflicting suffix of an uncommitted log, and blocks until the
+// truncation is on stable storage. The segments are not rewritten: a
+// truncate record is appended instead, which every reader of the WAL
+// applies in order, so entries saved afterwards continue the log at
+// index+1. Snapshots taken past index are discarded as well.
+// TruncateAfter returns ErrTruncateCommitted if index is below the committed
+// index of the last saved state.
+func (w *WAL) TruncateAfter(index uint64) error {
+	w.mu.Lock()
+	if w.encoder == nil {
+		w.mu.Unlock()
+		return ErrDecoderNotFound
+	}
+	if index < w.state.GetCommitted() {
+		w.mu.Unlock()
+		return ErrTruncateCommitted
+	}
+	if index >= w.enti {
+		// nothing to discard
+		w.mu.Unlock()
+		return nil
+	}
+
+	off, _ := w.encoder.position()
+	rec := &walpb.Record{Type: int64(TruncateType), Data: encodeTruncate(index)}
+	if err := w.encoder.encode(rec); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	w.enti = index
+	w.tailIdx.touch(index + 1)
+	seq := w.appended(off, 1)
+	w.mu.Unlock()
+
+	// the truncation is synced whatever the durability policy, so that
+	// the entries discarded do not reappear
+	return w.syncTo(seq, true)
+}
+
+func encodeTruncate(index uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, index)
+	return b
+}
+
+// decodeTruncate returns the index a truncate record keeps entries up to.
+func decodeTruncate(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, errBadTruncateRecord
+	}
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// truncateEntries drops the entries of ents, which start at index first,
+// that come after index.
+func truncateEntries(ents []LogEntry, first, index uint64) []LogEntry {
+	if index < first {
+		return ents[:0]
+	}
+	if up := index - first + 1; up < uint64(len(ents)) {
+		return ents[:up]
+	}
+	return ents
+}
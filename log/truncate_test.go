@@ -0,0 +1,145 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"go.uber.org/zap"
+)
+
+func TestTruncateAfter(t *testing.T) {
+	p, w := createRangeWAL(t, 30)
+	defer os.RemoveAll(p)
+
+	if err := w.TruncateAfter(10); err != ErrTruncateCommitted {
+		t.Fatalf("err = %v, want %v", err, ErrTruncateCommitted)
+	}
+	// entries past the committed index of the last saved state are fine
+	if err := w.Save(&walpb.HardState{Committed: 30}, nil); err != nil {
+		t.Fatal(err)
+	}
+	es := []LogEntry{
+		&walpb.Entry{Index: 31, Data: []byte{31}},
+		&walpb.Entry{Index: 32, Data: []byte{32}},
+	}
+	if err := w.Save(&walpb.HardState{}, es); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.TruncateAfter(31); err != nil {
+		t.Fatal(err)
+	}
+	// truncating past the last entry is a no-op
+	if err := w.TruncateAfter(40); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ReadRange(32, 33, noLimit); err != ErrRangeUnavailable {
+		t.Errorf("err = %v, want %v", err, ErrRangeUnavailable)
+	}
+	es = []LogEntry{&walpb.Entry{Index: 32, Data: []byte{132}}}
+	if err := w.Save(&walpb.HardState{}, es); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, w, 30, 33, []byte{30, 31, 132})
+	w.Close()
+
+	w, err := Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample(), SegmentSizeBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 32 {
+		t.Fatalf("len(ents) = %d, want %d", len(ents), 32)
+	}
+	if d := ents[31].(*walpb.Entry).Data[0]; d != 132 {
+		t.Errorf("data = %d, want %d", d, 132)
+	}
+}
+
+// TestTruncateAfterAcrossSegments ensures a truncation recorded in a later
+// segment discards the entries of earlier ones, also once the segment
+// indexes are rebuilt.
+func TestTruncateAfterAcrossSegments(t *testing.T) {
+	p, w := createRangeWAL(t, 10)
+	defer os.RemoveAll(p)
+
+	seq := w.seq()
+	for i := 11; w.seq() == seq; i++ {
+		es := []LogEntry{&walpb.Entry{Index: uint64(i), Data: make([]byte, 100)}}
+		if err := w.Save(&walpb.HardState{}, es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.TruncateAfter(10); err != nil {
+		t.Fatal(err)
+	}
+	if ents, err := w.ReadRange(5, 20, noLimit); err != nil || len(ents) != 6 {
+		t.Errorf("ReadRange = (%d, %v), want (%d, nil)", len(ents), err, 6)
+	}
+	w.Close()
+
+	idxs, err := filepath.Glob(filepath.Join(p, "*"+indexSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range idxs {
+		os.Remove(idx)
+	}
+
+	w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample(), SegmentSizeBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var truncated bool
+	err = w.Replay(func(rec RecordView) error {
+		if rec.Type == TruncateType {
+			truncated = rec.Index == 10
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Errorf("expected a truncate record at index %d", 10)
+	}
+	if ents, err := w.ReadRange(5, 20, noLimit); err != nil || len(ents) != 6 {
+		t.Errorf("ReadRange = (%d, %v), want (%d, nil)", len(ents), err, 6)
+	}
+	if err = w.Save(&walpb.HardState{}, []LogEntry{&walpb.Entry{Index: 11}}); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, w, 9, 12, nil)
+}
+
+func TestTruncateEntries(t *testing.T) {
+	ents := []LogEntry{&walpb.Entry{Index: 3}, &walpb.Entry{Index: 4}, &walpb.Entry{Index: 5}}
+	tests := []struct {
+		index uint64
+		wlen  int
+	}{
+		{1, 0},
+		{2, 0},
+		{3, 1},
+		{4, 2},
+		{5, 3},
+		{9, 3},
+	}
+	for i, tt := range tests {
+		if got := truncateEntries(ents, 3, tt.index); len(got) != tt.wlen {
+			t.Errorf("#%d: len = %d, want %d", i, len(got), tt.wlen)
+		}
+	}
+}
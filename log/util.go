@@ -20,7 +20,6 @@ import (
 	"io"
 	"strings"
 
-	"go.etcd.io/etcd/pkg/fileutil"
 	"go.uber.org/zap"
 )
 
@@ -28,11 +27,16 @@ var errBadWALName = errors.New("bad wal name")
 
 // Exist returns true if there are any files in a given directory.
 func Exist(dir string) bool {
-	names, err := fileutil.ReadDir(dir)
-	if err != nil {
-		return false
+	return exist(OSFS, dir)
+}
+
+// ExistWithOptions is Exist on the FS of opts.
+func ExistWithOptions(dir string, opts *Options) bool {
+	fs := OSFS
+	if opts != nil && opts.FS != nil {
+		fs = opts.FS
 	}
-	return len(names) != 0
+	return exist(fs, dir)
 }
 
 // searchIndex returns the last array index of names whose raft index section is
@@ -69,8 +73,8 @@ func isValidSeq(lg *zap.Logger, names []string) bool {
 	return true
 }
 
-func readWALNames(lg *zap.Logger, dirpath string) ([]string, error) {
-	names, err := fileutil.ReadDir(dirpath)
+func readWALNames(lg *zap.Logger, fs FS, dirpath string) ([]string, error) {
+	names, err := fs.ReadDir(dirpath)
 	if err != nil {
 		return nil, err
 	}
@@ -85,8 +89,8 @@ func checkWalNames(lg *zap.Logger, names []string) []string {
 	wnames := make([]string, 0)
 	for _, name := range names {
 		if _, _, err := parseWALName(name); err != nil {
-			// don't complain about left over tmp files
-			if !strings.HasSuffix(name, ".tmp") {
+			// don't complain about left over tmp files or segment indexes
+			if !strings.HasSuffix(name, ".tmp") && !strings.HasSuffix(name, indexSuffix) {
 				lg.Warn(
 					"ignored file in WAL directory",
 					zap.String("path", name),
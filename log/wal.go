@@ -45,13 +45,8 @@ var (
 	ErrSliceOutOfRange              = errors.New("wal: slice bounds out of range")
 	ErrMaxWALEntrySizeLimitExceeded = errors.New("wal: max entry size limit exceeded")
 	ErrDecoderNotFound              = errors.New("wal: decoder not found")
+	ErrInvalidRecord                = errors.New("wal: invalid record data")
 	crcTable                        = crc32.MakeTable(crc32.Castagnoli)
-
-	// SegmentSizeBytes is the preallocated size of each wal segment file.
-	// The actual size might be larger than this. In general, the default
-	// value should be used, but this is defined as an exported variable
-	// so that tests can set a different segment size.
-	SegmentSizeBytes int64 = 64 * 1000 * 1000 // 64MB
 )
 
 var _ WALAPI = &WAL{}
@@ -64,6 +59,10 @@ type WALAPI interface {
 	SaveState(st HardState) error
 	// SaveState function saves ents to the underlying stable storage.
 	SaveEntry(ents []LogEntry) error
+	// AppendAsync appends st and ents without waiting for them to be synced.
+	// The returned future resolves once they are on stable storage, whatever
+	// the durability policy.
+	AppendAsync(st HardState, ents []LogEntry) (*SyncFuture, error)
 	// SaveSnapshot function saves snapshot to the underlying stable storage.
 	SaveSnapshot(e Snapshot) error
 	// ReleaseLockTo releases the locks, which has smaller index than the given index
@@ -71,6 +70,14 @@ type WALAPI interface {
 	ReleaseLockTo(index uint64) error
 	// ReadAll reads out records of the current WAL.
 	ReadAll() (metadata []byte, state HardState, ents []LogEntry, err error)
+	// Replay streams the records of the current WAL to fn one at a time.
+	Replay(fn func(rec RecordView) error) error
+	// ReadRange returns the entries in the range [lo, hi) from stable storage.
+	ReadRange(lo, hi, maxBytes uint64) ([]LogEntry, error)
+	// TruncateAfter durably discards the entries with an index larger than index.
+	TruncateAfter(index uint64) error
+	// SaveRecord saves data as a record of a registered user-defined kind.
+	SaveRecord(kind RecordType, data RecordData) error
 	// Sync WAL
 	Sync() error
 
@@ -85,12 +92,13 @@ type WALAPI interface {
 // A just opened WAL is in read mode, and ready for reading records.
 // The WAL will be ready for appending after reading out all the previous records.
 type WAL struct {
-	lg *zap.Logger
+	lg   *zap.Logger
+	opts *Options // validated options the WAL was created or opened with
 
 	dir string // the living directory of the underlay files
 
 	// dirFile is a fd for the wal directory for syncing on Rename
-	dirFile *os.File
+	dirFile File
 
 	metadata []byte    // metadata recorded at the head of each WAL
 	state    HardState // state recorded at the head of WAL
@@ -100,34 +108,77 @@ type WAL struct {
 	decoder   *decoder     // decoder to decode records
 	encoder   *encoder     // encoder to encode records
 	readClose func() error // closer for decode reader
+	segments  int          // number of segments opened for reading
 
 	unsafeNoSync bool // if set, do not fsync
 
 	mu    sync.Mutex
-	locks []*fileutil.LockedFile // the locked files the WAL holds (the name is increasing)
+	locks []File // the locked files the WAL holds (the name is increasing)
 	fp    *filePipeline
+
+	appendSeq uint64      // sequence number of the last encoded append
+	cq        commitQueue // group commit queue of concurrent appends
+
+	durability DurabilityPolicy
+	durMu      sync.Mutex    // serializes changes of the durability policy
+	stopSync   chan struct{} // stops the background sync of SyncInterval
+	syncDone   chan struct{}
+
+	// totals of the bytes and records appended, and of those synced
+	bytesAppended, recordsAppended int64
+	bytesSynced, recordsSynced     int64
+
+	tailIdx segmentIndex // sparse index of the tail segment
+
+	metrics *metrics
+	held    bool // whether the WAL holds the gauges of metrics
 }
 
 // Create creates a WAL ready for appending records. The given metadata is
 // recorded at the head of each WAL file, and can be retrieved with ReadAll
 // after the file is Open.
-func Create(lg *zap.Logger, dirpath string, metadata []byte) (*WAL, error) {
-	if Exist(dirpath) {
-		return nil, os.ErrExist
+func Create(dirpath string, metadata []byte, opts *Options) (*WAL, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	m, err := opts.metrics()
+	if err != nil {
+		return nil, err
+	}
+	m, held, err := m.hold()
+	if err != nil {
+		return nil, err
 	}
+	w, err := create(dirpath, metadata, opts, m)
+	if err != nil {
+		if held {
+			m.unhold()
+		}
+		return nil, err
+	}
+	w.held = held
+	return w, nil
+}
 
-	if lg == nil {
-		lg = zap.NewNop()
+func create(dirpath string, metadata []byte, opts *Options, m *metrics) (*WAL, error) {
+	lg, fs := opts.Logger, opts.FS
+	if exist(fs, dirpath) {
+		return nil, os.ErrExist
 	}
 
 	// keep temporary wal directory so WAL initialization appears atomic
 	tmpdirpath := filepath.Clean(dirpath) + ".tmp"
-	if fileutil.Exist(tmpdirpath) {
-		if err := os.RemoveAll(tmpdirpath); err != nil {
+	if _, err := fs.Stat(tmpdirpath); err == nil {
+		if err := fs.RemoveAll(tmpdirpath); err != nil {
 			return nil, err
 		}
 	}
-	if err := fileutil.CreateDirAll(tmpdirpath); err != nil {
+	// the parents of the WAL directory must survive a crash too
+	if err := mkdirAllSync(fs, filepath.Dir(tmpdirpath)); err != nil {
+		return nil, err
+	}
+	if err := createDirAll(fs, tmpdirpath); err != nil {
 		lg.Warn(
 			"failed to create a temporary WAL directory",
 			zap.String("tmp-dir-path", tmpdirpath),
@@ -138,7 +189,7 @@ func Create(lg *zap.Logger, dirpath string, metadata []byte) (*WAL, error) {
 	}
 
 	p := filepath.Join(tmpdirpath, walName(0, 0))
-	f, err := fileutil.LockFile(p, os.O_WRONLY|os.O_CREATE, fileutil.PrivateFileMode)
+	f, err := fs.LockFile(p, os.O_WRONLY|os.O_CREATE, fileutil.PrivateFileMode)
 	if err != nil {
 		lg.Warn(
 			"failed to flock an initial WAL file",
@@ -155,24 +206,35 @@ func Create(lg *zap.Logger, dirpath string, metadata []byte) (*WAL, error) {
 		)
 		return nil, err
 	}
-	if err = fileutil.Preallocate(f.File, SegmentSizeBytes, true); err != nil {
+	if err = fs.Preallocate(f, opts.SegmentSizeBytes, true); err != nil {
 		lg.Warn(
 			"failed to preallocate an initial WAL file",
 			zap.String("path", p),
-			zap.Int64("segment-bytes", SegmentSizeBytes),
+			zap.Int64("segment-bytes", opts.SegmentSizeBytes),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	if err = writeSegmentHeader(f); err != nil {
+		lg.Warn(
+			"failed to write the header of an initial WAL file",
+			zap.String("path", p),
 			zap.Error(err),
 		)
 		return nil, err
 	}
 
 	w := &WAL{
-		lg:       lg,
-		dir:      dirpath,
-		metadata: metadata,
-		state:    NewEmptyState(),
-		start:    NewEmptySnapshot(),
-	}
-	w.encoder, err = newFileEncoder(f.File, 0)
+		lg:           lg,
+		opts:         opts,
+		dir:          dirpath,
+		metadata:     metadata,
+		state:        opts.Registry.NewState(),
+		start:        opts.Registry.NewSnapshot(),
+		unsafeNoSync: opts.UnsafeNoFsync,
+		metrics:      m,
+	}
+	w.encoder, err = newFileEncoder(f, 0, opts, m)
 	if err != nil {
 		return nil, err
 	}
@@ -184,7 +246,16 @@ func Create(lg *zap.Logger, dirpath string, metadata []byte) (*WAL, error) {
 		return nil, err
 	}
 
-	if err = w.SaveSnapshot(NewEmptySnapshot()); err != nil {
+	if err = w.SaveSnapshot(opts.Registry.NewSnapshot()); err != nil {
+		return nil, err
+	}
+	// the renamed directory must hold the first segment
+	if err = syncDir(fs, tmpdirpath); err != nil {
+		lg.Warn(
+			"failed to fsync the temporary WAL directory",
+			zap.String("tmp-dir-path", tmpdirpath),
+			zap.Error(err),
+		)
 		return nil, err
 	}
 
@@ -207,7 +278,7 @@ func Create(lg *zap.Logger, dirpath string, metadata []byte) (*WAL, error) {
 	}()
 
 	// directory was renamed; sync parent dir to persist rename
-	pdir, perr := fileutil.OpenDir(filepath.Dir(w.dir))
+	pdir, perr := fs.OpenDir(filepath.Dir(w.dir))
 	if perr != nil {
 		lg.Warn(
 			"failed to open the parent data directory",
@@ -230,7 +301,7 @@ func Create(lg *zap.Logger, dirpath string, metadata []byte) (*WAL, error) {
 		return nil
 	}
 	start := time.Now()
-	if perr = fileutil.Fsync(pdir); perr != nil {
+	if perr = fs.Fsync(pdir); perr != nil {
 		dirCloser()
 		lg.Warn(
 			"failed to fsync the parent data directory file",
@@ -240,10 +311,14 @@ func Create(lg *zap.Logger, dirpath string, metadata []byte) (*WAL, error) {
 		)
 		return nil, perr
 	}
-	walFsyncSec.Observe(time.Since(start).Seconds())
+	w.metrics.fsyncSec.Observe(time.Since(start).Seconds())
 	if err = dirCloser(); err != nil {
 		return nil, err
 	}
+	if err = w.SetDurability(opts.Durability); err != nil {
+		w.Close()
+		return nil, err
+	}
 
 	return w, nil
 }
@@ -258,7 +333,7 @@ func (w *WAL) cleanupWAL(lg *zap.Logger) {
 		lg.Panic("failed to close WAL during cleanup", zap.Error(err))
 	}
 	brokenDirName := fmt.Sprintf("%s.broken.%v", w.dir, time.Now().Format("20060102.150405.999999"))
-	if err = os.Rename(w.dir, brokenDirName); err != nil {
+	if err = w.opts.FS.Rename(w.dir, brokenDirName); err != nil {
 		lg.Panic(
 			"failed to rename WAL during cleanup",
 			zap.Error(err),
@@ -269,7 +344,7 @@ func (w *WAL) cleanupWAL(lg *zap.Logger) {
 }
 
 func (w *WAL) renameWAL(tmpdirpath string) (*WAL, error) {
-	if err := os.RemoveAll(w.dir); err != nil {
+	if err := w.opts.FS.RemoveAll(w.dir); err != nil {
 		return nil, err
 	}
 	// On non-Windows platforms, hold the lock while renaming. Releasing
@@ -278,14 +353,15 @@ func (w *WAL) renameWAL(tmpdirpath string) (*WAL, error) {
 	// happening. The fds are set up as close-on-exec by the Go runtime,
 	// but there is a window between the fork and the exec where another
 	// process holds the lock.
-	if err := os.Rename(tmpdirpath, w.dir); err != nil {
+	if err := w.opts.FS.Rename(tmpdirpath, w.dir); err != nil {
 		if _, ok := err.(*os.LinkError); ok {
 			return w.renameWALUnlock(tmpdirpath)
 		}
 		return nil, err
 	}
-	w.fp = newFilePipeline(w.lg, w.dir, SegmentSizeBytes)
-	df, err := fileutil.OpenDir(w.dir)
+	w.fp = newFilePipeline(w.lg, w.opts.FS, w.dir, w.opts.SegmentSizeBytes)
+	w.metrics.segments.Set(float64(len(w.locks)))
+	df, err := w.opts.FS.OpenDir(w.dir)
 	w.dirFile = df
 	return w, err
 }
@@ -300,15 +376,16 @@ func (w *WAL) renameWALUnlock(tmpdirpath string) (*WAL, error) {
 	)
 	w.Close()
 
-	if err := os.Rename(tmpdirpath, w.dir); err != nil {
+	if err := w.opts.FS.Rename(tmpdirpath, w.dir); err != nil {
 		return nil, err
 	}
 
-	// reopen and relock
-	newWAL, oerr := Open(w.lg, w.dir, NewEmptySnapshot())
+	// reopen and relock, under the gauges Create holds
+	newWAL, oerr := open(w.dir, w.opts.Registry.NewSnapshot(), w.opts)
 	if oerr != nil {
 		return nil, oerr
 	}
+	newWAL.metrics.segments.Set(float64(len(newWAL.locks)))
 	if _, _, _, err := newWAL.ReadAll(); err != nil {
 		newWAL.Close()
 		return nil, err
@@ -322,12 +399,31 @@ func (w *WAL) renameWALUnlock(tmpdirpath string) (*WAL, error) {
 // The returned WAL is ready to read and the first record will be the one after
 // the given snap. The WAL cannot be appended to before reading out all of its
 // previous records.
-func Open(lg *zap.Logger, dirpath string, snap Snapshot) (*WAL, error) {
-	w, err := openAtIndex(lg, dirpath, snap, true)
+func Open(dirpath string, snap Snapshot, opts *Options) (*WAL, error) {
+	w, err := open(dirpath, snap, opts)
 	if err != nil {
 		return nil, err
 	}
-	if w.dirFile, err = fileutil.OpenDir(w.dir); err != nil {
+	m, held, err := w.metrics.hold()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	w.metrics, w.held = m, held
+	w.metrics.segments.Set(float64(len(w.locks)))
+	return w, nil
+}
+
+func open(dirpath string, snap Snapshot, opts *Options) (*WAL, error) {
+	w, err := openAtIndex(dirpath, snap, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	if w.dirFile, err = w.opts.FS.OpenDir(w.dir); err != nil {
+		return nil, err
+	}
+	if err = w.SetDurability(w.opts.Durability); err != nil {
+		w.Close()
 		return nil, err
 	}
 	return w, nil
@@ -335,32 +431,48 @@ func Open(lg *zap.Logger, dirpath string, snap Snapshot) (*WAL, error) {
 
 // OpenForRead only opens the wal files for read.
 // Write on a read only wal panics.
-func OpenForRead(lg *zap.Logger, dirpath string, snap Snapshot) (*WAL, error) {
-	return openAtIndex(lg, dirpath, snap, false)
+func OpenForRead(dirpath string, snap Snapshot, opts *Options) (*WAL, error) {
+	return openAtIndex(dirpath, snap, false, opts)
 }
 
-func openAtIndex(lg *zap.Logger, dirpath string, snap Snapshot, write bool) (*WAL, error) {
-	if lg == nil {
-		lg = zap.NewNop()
+// SegmentsRead returns the number of segments an opened WAL reads, from
+// the one holding its start snapshot to the last.
+func (w *WAL) SegmentsRead() int {
+	return w.segments
+}
+
+func openAtIndex(dirpath string, snap Snapshot, write bool, opts *Options) (*WAL, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
 	}
-	names, nameIndex, err := selectWALFiles(lg, dirpath, snap)
+	m, err := opts.metrics()
+	if err != nil {
+		return nil, err
+	}
+	lg := opts.Logger
+	names, nameIndex, err := selectWALFiles(lg, opts.FS, dirpath, snap)
 	if err != nil {
 		return nil, err
 	}
 
-	rs, ls, closer, err := openWALFiles(lg, dirpath, names, nameIndex, write)
+	rs, ls, closer, err := openWALFiles(lg, opts.FS, dirpath, names, nameIndex, write)
 	if err != nil {
 		return nil, err
 	}
 
 	// create a WAL ready for reading
 	w := &WAL{
-		lg:        lg,
-		dir:       dirpath,
-		start:     snap,
-		decoder:   newDecoder(rs...),
-		readClose: closer,
-		locks:     ls,
+		lg:           lg,
+		opts:         opts,
+		dir:          dirpath,
+		start:        snap,
+		decoder:      newDecoderOpts(opts, rs...),
+		readClose:    closer,
+		segments:     len(rs),
+		locks:        ls,
+		unsafeNoSync: opts.UnsafeNoFsync,
+		metrics:      m,
 	}
 
 	if write {
@@ -371,14 +483,14 @@ func openAtIndex(lg *zap.Logger, dirpath string, snap Snapshot, write bool) (*WA
 			closer()
 			return nil, err
 		}
-		w.fp = newFilePipeline(lg, w.dir, SegmentSizeBytes)
+		w.fp = newFilePipeline(lg, opts.FS, w.dir, opts.SegmentSizeBytes)
 	}
 
 	return w, nil
 }
 
-func selectWALFiles(lg *zap.Logger, dirpath string, snap Snapshot) ([]string, int, error) {
-	names, err := readWALNames(lg, dirpath)
+func selectWALFiles(lg *zap.Logger, fs FS, dirpath string, snap Snapshot) ([]string, int, error) {
+	names, err := readWALNames(lg, fs, dirpath)
 	if err != nil {
 		return nil, -1, err
 	}
@@ -392,14 +504,14 @@ func selectWALFiles(lg *zap.Logger, dirpath string, snap Snapshot) ([]string, in
 	return names, nameIndex, nil
 }
 
-func openWALFiles(lg *zap.Logger, dirpath string, names []string, nameIndex int, write bool) ([]io.Reader, []*fileutil.LockedFile, func() error, error) {
+func openWALFiles(lg *zap.Logger, fs FS, dirpath string, names []string, nameIndex int, write bool) ([]io.Reader, []File, func() error, error) {
 	rcs := make([]io.ReadCloser, 0)
 	rs := make([]io.Reader, 0)
-	ls := make([]*fileutil.LockedFile, 0)
+	ls := make([]File, 0)
 	for _, name := range names[nameIndex:] {
 		p := filepath.Join(dirpath, name)
 		if write {
-			l, err := fileutil.TryLockFile(p, os.O_RDWR, fileutil.PrivateFileMode)
+			l, err := fs.TryLockFile(p, os.O_RDWR, fileutil.PrivateFileMode)
 			if err != nil {
 				closeAll(lg, rcs...)
 				return nil, nil, nil, err
@@ -407,7 +519,7 @@ func openWALFiles(lg *zap.Logger, dirpath string, names []string, nameIndex int,
 			ls = append(ls, l)
 			rcs = append(rcs, l)
 		} else {
-			rf, err := os.OpenFile(p, os.O_RDONLY, fileutil.PrivateFileMode)
+			rf, err := fs.OpenFile(p, os.O_RDONLY, fileutil.PrivateFileMode)
 			if err != nil {
 				closeAll(lg, rcs...)
 				return nil, nil, nil, err
@@ -415,6 +527,20 @@ func openWALFiles(lg *zap.Logger, dirpath string, names []string, nameIndex int,
 			ls = append(ls, nil)
 			rcs = append(rcs, rf)
 		}
+		var err error
+		if write {
+			// appending would mix the formats in one WAL
+			var old bool
+			if old, err = needsMigration(rcs[len(rcs)-1].(io.ReaderAt)); old {
+				err = ErrMigrationNeeded
+			}
+		} else {
+			_, err = readSegmentVersion(rcs[len(rcs)-1].(io.ReaderAt))
+		}
+		if err != nil {
+			closeAll(lg, rcs...)
+			return nil, nil, nil, errors.Wrapf(err, "open %s", p)
+		}
 		rs = append(rs, rcs[len(rcs)-1])
 	}
 
@@ -434,145 +560,59 @@ func openWALFiles(lg *zap.Logger, dirpath string, names []string, nameIndex int,
 // TODO: maybe loose the checking of match.
 // After ReadAll, the WAL will be ready for appending new records.
 func (w *WAL) ReadAll() (metadata []byte, state HardState, ents []LogEntry, err error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	rec := &walpb.Record{}
-	state = NewEmptyState()
-
-	if w.decoder == nil {
-		return nil, state, nil, ErrDecoderNotFound
-	}
-	decoder := w.decoder
+	return readAll(w.opts.Registry, w.start.GetIndex(), w.Replay)
+}
 
-	var match bool
-	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
+// readAll collects the records streamed by replay as ReadAll returns them.
+// startIndex is the index of the snap the WAL was opened at.
+func readAll(reg *Registry, startIndex uint64, replay func(fn func(rec RecordView) error) error) (metadata []byte, state HardState, ents []LogEntry, err error) {
+	state = reg.NewState()
+	err = replay(func(rec RecordView) error {
 		switch rec.Type {
-		case int64(EntryType):
-			e := NewEmptyEntry()
-			pbutil.MustUnmarshal(e, rec.Data)
+		case EntryType:
 			// 0 <= e.Index-w.start.Index - 1 < len(ents)
-			if e.GetIndex() > w.start.GetIndex() {
-				// prevent "panic: runtime error: slice bounds out of range [:13038096702221461992] with capacity 0"
-				up := e.GetIndex() - w.start.GetIndex() - 1
-				if up > uint64(len(ents)) {
-					// return error before append call causes runtime panic
-					return nil, state, nil, ErrSliceOutOfRange
-				}
-				ents = append(ents[:up], e)
+			// prevent "panic: runtime error: slice bounds out of range [:13038096702221461992] with capacity 0"
+			up := rec.Entry.GetIndex() - startIndex - 1
+			if up > uint64(len(ents)) {
+				// return error before append call causes runtime panic
+				return ErrSliceOutOfRange
 			}
-			w.enti = e.GetIndex()
-
-		case int64(StateType):
-			s := NewEmptyState()
-			pbutil.MustUnmarshal(s, rec.Data)
-			state = s
-
-		case int64(MetadataType):
-			if metadata != nil && !bytes.Equal(metadata, rec.Data) {
-				if state != nil {
-					state.Reset()
-				}
-				return nil, state, nil, ErrMetadataConflict
-			}
-			metadata = rec.Data
-
-		case int64(CrcType):
-			crc := decoder.crc.Sum32()
-			// current crc of decoder must match the crc of the record.
-			// do no need to match 0 crc, since the decoder is a new one at this case.
-			if crc != 0 && rec.Validate(crc) != nil {
-				if state != nil {
-					state.Reset()
-				}
-				return nil, state, nil, ErrCRCMismatch
-			}
-			decoder.updateCRC(rec.Crc)
-
-		case int64(SnapshotType):
-			snap := NewEmptySnapshot()
-			pbutil.MustUnmarshal(snap, rec.Data)
-			if snap.GetIndex() == w.start.GetIndex() {
-				match = true
-			}
-
-		default:
-			w.lg.Panic("ReadAll: invalid record type")
-
-		}
-	}
-
-	switch w.tail() {
-	case nil:
-		// We do not have to read out all entries in read mode.
-		// The last record maybe a partial written one, so
-		// ErrunexpectedEOF might be returned.
-		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			state.Reset()
-			return nil, state, nil, err
-		}
-	default:
-		// We must read all of the entries if WAL is opened in write mode.
-		if err != io.EOF {
-			state.Reset()
-			return nil, state, nil, err
-		}
-		// decodeRecord() will return io.EOF if it detects a zero record,
-		// but this zero record may be followed by non-zero records from
-		// a torn write. Overwriting some of these non-zero records, but
-		// not all, will cause CRC errors on WAL open. Since the records
-		// were never fully synced to disk in the first place, it's safe
-		// to zero them out to avoid any CRC errors from new writes.
-		if _, err = w.tail().Seek(w.decoder.lastOffset(), io.SeekStart); err != nil {
-			return nil, state, nil, err
-		}
-		if err = fileutil.ZeroToEnd(w.tail().File); err != nil {
-			return nil, state, nil, err
-		}
-	}
-
-	err = nil
-	if !match {
-		err = ErrSnapshotNotFound
-	}
-
-	// close decoder, disable reading
-	if w.readClose != nil {
-		w.readClose()
-		w.readClose = nil
-	}
-	w.start = NewEmptySnapshot()
-
-	w.metadata = metadata
-
-	if w.tail() != nil {
-		// create encoder (chain crc with the decoder), enable appending
-		w.encoder, err = newFileEncoder(w.tail().File, w.decoder.lastCRC())
-		if err != nil {
-			return
+			ents = append(ents[:up], rec.Entry)
+		case TruncateType:
+			ents = truncateEntries(ents, startIndex+1, rec.Index)
+		case StateType:
+			state = rec.State
+		case MetadataType:
+			metadata = rec.Metadata
 		}
+		return nil
+	})
+	if err != nil && err != ErrSnapshotNotFound {
+		state.Reset()
+		return nil, state, nil, err
 	}
-	w.decoder = nil
-
 	return metadata, state, ents, err
 }
 
 // ValidSnapshotEntries returns all the valid snapshot entries in the wal logs in the given directory.
 // Snapshot entries are valid if their index is less than or equal to the most recent committed hardstate.
-func ValidSnapshotEntries(lg *zap.Logger, walDir string) ([]Snapshot, error) {
+func ValidSnapshotEntries(lg *zap.Logger, walDir string, opts *Options) ([]Snapshot, error) {
 	var snaps []Snapshot
 	var state HardState
-	var err error
 
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
 	rec := &walpb.Record{}
-	names, err := readWALNames(lg, walDir)
+	names, err := readWALNames(lg, opts.FS, walDir)
 	if err != nil {
 		return nil, err
 	}
 
 	// open wal files in read mode, so that there is no conflict
 	// when the same WAL is opened elsewhere in write mode
-	rs, _, closer, err := openWALFiles(lg, walDir, names, 0, false)
+	rs, _, closer, err := openWALFiles(lg, opts.FS, walDir, names, 0, false)
 	if err != nil {
 		return nil, err
 	}
@@ -583,26 +623,45 @@ func ValidSnapshotEntries(lg *zap.Logger, walDir string) ([]Snapshot, error) {
 	}()
 
 	// create a new decoder from the readers on the WAL files
-	decoder := newDecoder(rs...)
+	decoder := newDecoderOpts(opts, rs...)
 
 	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
 		switch rec.Type {
 		case int64(SnapshotType):
-			loadedSnap := NewEmptySnapshot()
-			pbutil.MustUnmarshal(loadedSnap, rec.Data)
+			loadedSnap := opts.Registry.NewSnapshot()
+			if err = unmarshalRecord(loadedSnap, rec); err != nil {
+				return nil, err
+			}
 			snaps = append(snaps, loadedSnap)
+		case int64(TruncateType):
+			index, derr := decodeTruncate(rec.Data)
+			if derr != nil {
+				return nil, derr
+			}
+			// snaps past the truncation cover discarded entries
+			n := 0
+			for _, s := range snaps {
+				if s.GetIndex() <= index {
+					snaps[n] = s
+					n++
+				}
+			}
+			snaps = snaps[:n]
 		case int64(StateType):
-			s := NewEmptyState()
-			pbutil.MustUnmarshal(s, rec.Data)
+			s := opts.Registry.NewState()
+			if err = unmarshalRecord(s, rec); err != nil {
+				return nil, err
+			}
 			state = s
 		case int64(CrcType):
-			crc := decoder.crc.Sum32()
-			// current crc of decoder must match the crc of the record.
-			// do no need to match 0 crc, since the decoder is a new one at this case.
-			if crc != 0 && rec.Validate(crc) != nil {
-				return nil, ErrCRCMismatch
+			if err = decoder.chainCRC(rec); err != nil {
+				return nil, err
+			}
+		case int64(EntryType), int64(MetadataType):
+		default:
+			if _, _, err = opts.Registry.readUserRecord(rec); err != nil {
+				return nil, err
 			}
-			decoder.updateCRC(rec.Crc)
 		}
 	}
 	// We do not have to read out all the WAL entries
@@ -634,24 +693,27 @@ func ValidSnapshotEntries(lg *zap.Logger, walDir string) ([]Snapshot, error) {
 // If it cannot read out the expected snap, it will return ErrSnapshotNotFound.
 // If the loaded snap doesn't match with the expected one, it will
 // return error ErrSnapshotMismatch.
-func Verify(lg *zap.Logger, walDir string, snap Snapshot) error {
+func Verify(lg *zap.Logger, walDir string, snap Snapshot, opts *Options) error {
 	var metadata []byte
-	var err error
 	var match bool
 
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
 	rec := &walpb.Record{}
 
 	if lg == nil {
 		lg = zap.NewNop()
 	}
-	names, nameIndex, err := selectWALFiles(lg, walDir, snap)
+	names, nameIndex, err := selectWALFiles(lg, opts.FS, walDir, snap)
 	if err != nil {
 		return err
 	}
 
 	// open wal files in read mode, so that there is no conflict
 	// when the same WAL is opened elsewhere in write mode
-	rs, _, closer, err := openWALFiles(lg, walDir, names, nameIndex, false)
+	rs, _, closer, err := openWALFiles(lg, opts.FS, walDir, names, nameIndex, false)
 	if err != nil {
 		return err
 	}
@@ -662,7 +724,7 @@ func Verify(lg *zap.Logger, walDir string, snap Snapshot) error {
 	}()
 
 	// create a new decoder from the readers on the WAL files
-	decoder := newDecoder(rs...)
+	decoder := newDecoderOpts(opts, rs...)
 
 	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
 		switch rec.Type {
@@ -672,25 +734,34 @@ func Verify(lg *zap.Logger, walDir string, snap Snapshot) error {
 			}
 			metadata = rec.Data
 		case int64(CrcType):
-			crc := decoder.crc.Sum32()
-			// Current crc of decoder must match the crc of the record.
-			// We need not match 0 crc, since the decoder is a new one at this point.
-			if crc != 0 && rec.Validate(crc) != nil {
-				return ErrCRCMismatch
+			if err = decoder.chainCRC(rec); err != nil {
+				return err
 			}
-			decoder.updateCRC(rec.Crc)
 		case int64(SnapshotType):
-			loadedSnap := NewEmptySnapshot()
-			pbutil.MustUnmarshal(loadedSnap, rec.Data)
+			loadedSnap := opts.Registry.NewSnapshot()
+			if derr := unmarshalRecord(loadedSnap, rec); derr != nil {
+				return derr
+			}
 			if loadedSnap.GetIndex() == snap.GetIndex() {
 				match = true
 			}
+		case int64(TruncateType):
+			index, derr := decodeTruncate(rec.Data)
+			if derr != nil {
+				return derr
+			}
+			if index < snap.GetIndex() {
+				// the snap was taken past the truncation
+				match = false
+			}
 		// We ignore all entry and state type records as these
 		// are not necessary for validating the WAL contents
 		case int64(EntryType):
 		case int64(StateType):
 		default:
-			return fmt.Errorf("unexpected block type %d", rec.Type)
+			if _, _, err = opts.Registry.readUserRecord(rec); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -711,6 +782,8 @@ func Verify(lg *zap.Logger, walDir string, snap Snapshot) error {
 // cut first creates a temp wal file and writes necessary headers into it.
 // Then cut atomically rename temp wal file to a wal file.
 func (w *WAL) cut() error {
+	cutStart := time.Now()
+
 	// close old wal file; truncate to avoid wasting space if an early cut
 	off, serr := w.tail().Seek(0, io.SeekCurrent)
 	if serr != nil {
@@ -725,6 +798,14 @@ func (w *WAL) cut() error {
 		return err
 	}
 
+	// the old tail is complete; persist its index for ReadRange
+	w.tailIdx.size, _ = w.encoder.position()
+	if err := saveSegmentIndex(w.opts.FS, w.dir, filepath.Base(w.tail().Name()), &w.tailIdx); err != nil {
+		w.lg.Warn("failed to save WAL segment index", zap.String("path", w.tail().Name()), zap.Error(err))
+	}
+	w.tailIdx = segmentIndex{}
+
+	oldPath := filepath.Join(w.dir, filepath.Base(w.tail().Name()))
 	fpath := filepath.Join(w.dir, walName(w.seq()+1, w.enti+1))
 
 	// create a temp wal file with name sequence + 1, or truncate the existing one
@@ -733,10 +814,14 @@ func (w *WAL) cut() error {
 		return err
 	}
 
+	if err = writeSegmentHeader(newTail); err != nil {
+		return err
+	}
+
 	// update writer and save the previous crc
 	w.locks = append(w.locks, newTail)
 	prevCrc := w.encoder.crc.Sum32()
-	w.encoder, err = newFileEncoder(w.tail().File, prevCrc)
+	w.encoder, err = newFileEncoder(w.tail(), prevCrc, w.opts, w.metrics)
 	if err != nil {
 		return err
 	}
@@ -763,19 +848,19 @@ func (w *WAL) cut() error {
 		return err
 	}
 
-	if err = os.Rename(newTail.Name(), fpath); err != nil {
+	if err = w.opts.FS.Rename(newTail.Name(), fpath); err != nil {
 		return err
 	}
 	start := time.Now()
-	if err = fileutil.Fsync(w.dirFile); err != nil {
+	if err = w.opts.FS.Fsync(w.dirFile); err != nil {
 		return err
 	}
-	walFsyncSec.Observe(time.Since(start).Seconds())
+	w.metrics.fsyncSec.Observe(time.Since(start).Seconds())
 
 	// reopen newTail with its new path so calls to Name() match the wal filename format
 	newTail.Close()
 
-	if newTail, err = fileutil.LockFile(fpath, os.O_WRONLY, fileutil.PrivateFileMode); err != nil {
+	if newTail, err = w.opts.FS.LockFile(fpath, os.O_WRONLY, fileutil.PrivateFileMode); err != nil {
 		return err
 	}
 	if _, err = newTail.Seek(off, io.SeekStart); err != nil {
@@ -785,26 +870,34 @@ func (w *WAL) cut() error {
 	w.locks[len(w.locks)-1] = newTail
 
 	prevCrc = w.encoder.crc.Sum32()
-	w.encoder, err = newFileEncoder(w.tail().File, prevCrc)
+	w.encoder, err = newFileEncoder(w.tail(), prevCrc, w.opts, w.metrics)
 	if err != nil {
 		return err
 	}
 
+	w.metrics.cutSec.Observe(time.Since(cutStart).Seconds())
+	w.metrics.segments.Set(float64(len(w.locks)))
+	w.opts.Observer.SegmentCut(SegmentCutEvent{OldPath: oldPath, NewPath: fpath, Index: w.enti + 1})
+
 	w.lg.Info("created a new WAL segment", zap.String("path", fpath))
 	return nil
 }
 
 func (w *WAL) sync() error {
-	if w.unsafeNoSync {
-		return nil
-	}
 	if w.encoder != nil {
 		if err := w.encoder.flush(); err != nil {
 			return err
 		}
 	}
+	if w.unsafeNoSync {
+		return nil
+	}
+	return w.fdatasync(w.tail())
+}
+
+func (w *WAL) fdatasync(f File) error {
 	start := time.Now()
-	err := fileutil.Fdatasync(w.tail().File)
+	err := w.opts.FS.Fdatasync(f)
 
 	took := time.Since(start)
 	if took > warnSyncDuration {
@@ -813,14 +906,23 @@ func (w *WAL) sync() error {
 			zap.Duration("took", took),
 			zap.Duration("expected-duration", warnSyncDuration),
 		)
+		w.opts.Observer.SlowSync(SlowSyncEvent{Path: f.Name(), Took: took, Expected: warnSyncDuration, Err: err})
+	}
+	w.metrics.fsyncSec.Observe(took.Seconds())
+	if err == nil {
+		w.opts.Observer.Synced(SyncEvent{Path: f.Name(), Took: took})
 	}
-	walFsyncSec.Observe(took.Seconds())
 
 	return err
 }
 
+// Sync blocks until every append made so far is on stable storage,
+// whatever the durability policy.
 func (w *WAL) Sync() error {
-	return w.sync()
+	w.mu.Lock()
+	seq := w.appendSeq
+	w.mu.Unlock()
+	return w.syncTo(seq, true)
 }
 
 // ReleaseLockTo releases the locks, which has smaller index than the given index
@@ -828,6 +930,9 @@ func (w *WAL) Sync() error {
 // For example, if WAL is holding lock 1,2,3,4,5,6, ReleaseLockTo(4) will release
 // lock 1,2 but keep 3. ReleaseLockTo(5) will release 1,2,3 but keep 4.
 func (w *WAL) ReleaseLockTo(index uint64) error {
+	// wait for an in-flight fdatasync which may still use a released file
+	w.cq.mu.Lock()
+	defer w.cq.mu.Unlock()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -859,19 +964,34 @@ func (w *WAL) ReleaseLockTo(index uint64) error {
 		return nil
 	}
 
+	var released []string
 	for i := 0; i < smaller; i++ {
 		if w.locks[i] == nil {
 			continue
 		}
+		// the first segment keeps the name it was created with in the
+		// temporary directory
+		released = append(released, filepath.Join(w.dir, filepath.Base(w.locks[i].Name())))
 		w.locks[i].Close()
 	}
 	w.locks = w.locks[smaller:]
+	w.metrics.segments.Set(float64(len(w.locks)))
+	if len(released) != 0 {
+		w.opts.Observer.LocksReleased(LocksReleasedEvent{Index: index, Paths: released})
+	}
 
 	return nil
 }
 
 // Close closes the current WAL file and directory.
 func (w *WAL) Close() error {
+	w.durMu.Lock()
+	w.stopSyncLoop()
+	w.durMu.Unlock()
+	w.stopSyncer()
+
+	w.cq.mu.Lock()
+	defer w.cq.mu.Unlock()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -880,10 +1000,11 @@ func (w *WAL) Close() error {
 		w.fp = nil
 	}
 
-	if w.tail() != nil {
-		if err := w.sync(); err != nil {
-			return err
-		}
+	// a failed sync is not retried, the appends since the last durable
+	// one may already be lost
+	serr := w.cq.failed()
+	if serr == nil && w.tail() != nil {
+		serr = w.sync()
 	}
 	for _, l := range w.locks {
 		if l == nil {
@@ -894,17 +1015,38 @@ func (w *WAL) Close() error {
 		}
 	}
 
-	return w.dirFile.Close()
+	// the final sync covers the parked futures
+	if serr == nil {
+		w.cq.synced = w.appendSeq
+	}
+	for _, r := range w.cq.unpark(serr) {
+		r.f.resolve(serr)
+	}
+
+	if w.held {
+		w.held = false
+		w.metrics.unhold()
+	}
+
+	if w.dirFile == nil {
+		return os.ErrInvalid
+	}
+	if err := w.dirFile.Close(); err != nil && serr == nil {
+		serr = err
+	}
+	return serr
 }
 
 func (w *WAL) saveEntry(e LogEntry) error {
 	// TODO: add MustMarshalTo to reduce one allocation.
 	b := pbutil.MustMarshal(e)
 	rec := &walpb.Record{Type: int64(EntryType), Data: b}
+	off, crc := w.encoder.position()
 	if err := w.encoder.encode(rec); err != nil {
 		return err
 	}
 	w.enti = e.GetIndex()
+	w.tailIdx.add(e.GetIndex(), off, crc)
 	return nil
 }
 
@@ -918,107 +1060,56 @@ func (w *WAL) saveState(s HardState) error {
 	return w.encoder.encode(rec)
 }
 
+// Save saves ents and st, and blocks until they are on stable storage, or
+// only written to the segment as the durability policy allows.
+// Concurrent callers are group committed and share a single fdatasync.
 func (w *WAL) Save(st HardState, ents []LogEntry) error {
 	if len(ents) == 0 && st.GetCommitted() == 0 {
 		return nil
 	}
-
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	// TODO(xiangli): no more reference operator
-	for i := range ents {
-		if err := w.saveEntry(ents[i]); err != nil {
-			return err
-		}
-	}
-
-	if err := w.saveState(st); err != nil {
-		return err
-	}
-
-	curOff, err := w.tail().Seek(0, io.SeekCurrent)
-	if err != nil {
-		return err
-	}
-	if curOff < SegmentSizeBytes {
-		return w.sync()
-	}
-
-	return w.cut()
+	return w.commit(st, ents)
 }
 
+// SaveState saves st, and blocks until it is on stable storage.
 func (w *WAL) SaveState(st HardState) error {
 	if st.GetCommitted() == 0 || st.GetCommitted() == w.state.GetCommitted() {
 		return nil
 	}
-
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	if err := w.saveState(st); err != nil {
-		return err
-	}
-
-	curOff, err := w.tail().Seek(0, io.SeekCurrent)
-	if err != nil {
-		return err
-	}
-	if curOff < SegmentSizeBytes {
-		return w.sync()
-	}
-
-	return w.cut()
+	return w.commit(st, nil)
 }
 
+// SaveEntry saves ents, and blocks until they are on stable storage.
 func (w *WAL) SaveEntry(ents []LogEntry) error {
 	if len(ents) == 0 {
 		return nil
 	}
-
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	// TODO(xiangli): no more reference operator
-	for i := range ents {
-		if err := w.saveEntry(ents[i]); err != nil {
-			return err
-		}
-	}
-
-	curOff, err := w.tail().Seek(0, io.SeekCurrent)
-	if err != nil {
-		return err
-	}
-	if curOff < SegmentSizeBytes {
-		return w.sync()
-	}
-
-	return w.cut()
+	return w.commit(nil, ents)
 }
 
 func (w *WAL) SaveSnapshot(e Snapshot) error {
 	b := pbutil.MustMarshal(e)
 
 	w.mu.Lock()
-	defer w.mu.Unlock()
-
+	off, _ := w.encoder.position()
 	rec := &walpb.Record{Type: int64(SnapshotType), Data: b}
 	if err := w.encoder.encode(rec); err != nil {
+		w.mu.Unlock()
 		return err
 	}
 	// update enti only when snapshot is ahead of last index
 	if w.enti < e.GetIndex() {
 		w.enti = e.GetIndex()
 	}
-	return w.sync()
+	seq := w.appended(off, 1)
+	w.mu.Unlock()
+	return w.syncTo(seq, true)
 }
 
 func (w *WAL) saveCrc(prevCrc uint32) error {
 	return w.encoder.encode(&walpb.Record{Type: int64(CrcType), Crc: prevCrc})
 }
 
-func (w *WAL) tail() *fileutil.LockedFile {
+func (w *WAL) tail() File {
 	if len(w.locks) > 0 {
 		return w.locks[len(w.locks)-1]
 	}
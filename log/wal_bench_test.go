@@ -42,7 +42,7 @@ func benchmarkWriteEntry(b *testing.B, size int, batch int) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(zap.NewExample(), p, []byte("somedata"))
+	w, err := Create(p, []byte("somedata"), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		b.Fatalf("err = %v, want nil", err)
 	}
@@ -40,7 +40,7 @@ func TestNew(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(zap.NewExample(), p, []byte("somedata"))
+	w, err := Create(p, []byte("somedata"), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
 	}
@@ -65,7 +65,10 @@ func TestNew(t *testing.T) {
 	}
 
 	var wb bytes.Buffer
-	e := newEncoder(&wb, 0, 0)
+	if err = writeSegmentHeader(&wb); err != nil {
+		t.Fatal(err)
+	}
+	e := newEncoder(&wb, 0, segmentHeaderBytes)
 	err = e.encode(&walpb.Record{Type: int64(CrcType), Crc: 0})
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
@@ -95,7 +98,7 @@ func TestCreateFailFromPollutedDir(t *testing.T) {
 	defer os.RemoveAll(p)
 	ioutil.WriteFile(filepath.Join(p, "test.wal"), []byte("data"), os.ModeTemporary)
 
-	_, err = Create(zap.NewExample(), p, []byte("data"))
+	_, err = Create(p, []byte("data"), &Options{Logger: zap.NewExample()})
 	if err != os.ErrExist {
 		t.Fatalf("expected %v, got %v", os.ErrExist, err)
 	}
@@ -113,7 +116,7 @@ func TestWalCleanup(t *testing.T) {
 	defer os.RemoveAll(testRoot)
 
 	logger := zap.NewExample()
-	w, err := Create(logger, p, []byte(""))
+	w, err := Create(p, []byte(""), &Options{Logger: logger})
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
 	}
@@ -139,13 +142,7 @@ func TestCreateFailFromNoSpaceLeft(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	oldSegmentSizeBytes := SegmentSizeBytes
-	defer func() {
-		SegmentSizeBytes = oldSegmentSizeBytes
-	}()
-	SegmentSizeBytes = math.MaxInt64
-
-	_, err = Create(zap.NewExample(), p, []byte("data"))
+	_, err = Create(p, []byte("data"), &Options{Logger: zap.NewExample(), SegmentSizeBytes: math.MaxInt64})
 	if err == nil { // no space left on device
 		t.Fatalf("expected error 'no space left on device', got nil")
 	}
@@ -159,7 +156,7 @@ func TestNewForInitedDir(t *testing.T) {
 	defer os.RemoveAll(p)
 
 	os.Create(filepath.Join(p, walName(0, 0)))
-	if _, err = Create(zap.NewExample(), p, nil); err == nil || err != os.ErrExist {
+	if _, err = Create(p, nil, &Options{Logger: zap.NewExample()}); err == nil || err != os.ErrExist {
 		t.Errorf("err = %v, want %v", err, os.ErrExist)
 	}
 }
@@ -177,7 +174,7 @@ func TestOpenAtIndex(t *testing.T) {
 	}
 	f.Close()
 
-	w, err := Open(zap.NewExample(), dir, NewEmptySnapshot())
+	w, err := Open(dir, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
 	}
@@ -196,7 +193,7 @@ func TestOpenAtIndex(t *testing.T) {
 	}
 	f.Close()
 
-	w, err = Open(zap.NewExample(), dir, &walpb.Snapshot{Index: 5})
+	w, err = Open(dir, &walpb.Snapshot{Index: 5}, &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
 	}
@@ -213,7 +210,7 @@ func TestOpenAtIndex(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(emptydir)
-	if _, err = Open(zap.NewExample(), emptydir, NewEmptySnapshot()); err != ErrFileNotFound {
+	if _, err = Open(emptydir, NewEmptySnapshot(), &Options{Logger: zap.NewExample()}); err != ErrFileNotFound {
 		t.Errorf("err = %v, want %v", err, ErrFileNotFound)
 	}
 }
@@ -229,7 +226,7 @@ func TestVerify(t *testing.T) {
 	defer os.RemoveAll(walDir)
 
 	// create WAL
-	w, err := Create(zap.NewExample(), walDir, nil)
+	w, err := Create(walDir, nil, &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -247,23 +244,23 @@ func TestVerify(t *testing.T) {
 	}
 
 	// to verify the WAL is not corrupted at this point
-	err = Verify(zap.NewExample(), walDir, NewEmptySnapshot())
+	err = Verify(zap.NewExample(), walDir, NewEmptySnapshot(), nil)
 	if err != nil {
 		t.Errorf("expected a nil error, got %v", err)
 	}
 
-	walFiles, err := ioutil.ReadDir(walDir)
+	walFiles, err := readWALNames(zap.NewExample(), OSFS, walDir)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// corrupt the WAL by truncating one of the WAL files completely
-	err = os.Truncate(path.Join(walDir, walFiles[2].Name()), 0)
+	err = os.Truncate(path.Join(walDir, walFiles[2]), 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = Verify(zap.NewExample(), walDir, NewEmptySnapshot())
+	err = Verify(zap.NewExample(), walDir, NewEmptySnapshot(), nil)
 	if err == nil {
 		t.Error("expected a non-nil error, got nil")
 	}
@@ -277,7 +274,7 @@ func TestCut(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(zap.NewExample(), p, nil)
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -320,6 +317,7 @@ func TestCut(t *testing.T) {
 	}
 	defer f.Close()
 	nw := &WAL{
+		opts:    &Options{Registry: DefaultRegistry()},
 		decoder: newDecoder(f),
 		start:   &snap,
 	}
@@ -340,7 +338,7 @@ func TestSaveWithCut(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(zap.NewExample(), p, []byte("metadata"))
+	w, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -353,10 +351,9 @@ func TestSaveWithCut(t *testing.T) {
 	strdata := "Hello World!!"
 	copy(bigData, strdata)
 	// set a lower value for SegmentSizeBytes, else the test takes too long to complete
-	restoreLater := SegmentSizeBytes
 	const EntrySize int = 500
-	SegmentSizeBytes = 2 * 1024
-	defer func() { SegmentSizeBytes = restoreLater }()
+	const SegmentSizeBytes int64 = 2 * 1024
+	w.opts.SegmentSizeBytes = SegmentSizeBytes
 	index := uint64(0)
 	for totalSize := 0; totalSize < int(SegmentSizeBytes); totalSize += EntrySize {
 		ents := []LogEntry{&walpb.Entry{Index: index, Data: bigData}}
@@ -368,7 +365,7 @@ func TestSaveWithCut(t *testing.T) {
 
 	w.Close()
 
-	neww, err := Open(zap.NewExample(), p, NewEmptySnapshot())
+	neww, err := Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatalf("err = %v, want nil", err)
 	}
@@ -403,7 +400,7 @@ func TestRecover(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(zap.NewExample(), p, []byte("metadata"))
+	w, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -422,7 +419,7 @@ func TestRecover(t *testing.T) {
 	}
 	w.Close()
 
-	if w, err = Open(zap.NewExample(), p, NewEmptySnapshot()); err != nil {
+	if w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()}); err != nil {
 		t.Fatal(err)
 	}
 	metadata, state, entries, err := w.ReadAll()
@@ -518,7 +515,7 @@ func TestRecoverAfterCut(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	md, err := Create(zap.NewExample(), p, []byte("metadata"))
+	md, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -541,7 +538,7 @@ func TestRecoverAfterCut(t *testing.T) {
 	}
 
 	for i := 0; i < 10; i++ {
-		w, err := Open(zap.NewExample(), p, &walpb.Snapshot{Index: uint64(i)})
+		w, err := Open(p, &walpb.Snapshot{Index: uint64(i)}, &Options{Logger: zap.NewExample()})
 		if err != nil {
 			if i <= 4 {
 				if err != ErrFileNotFound {
@@ -576,7 +573,7 @@ func TestOpenAtUncommittedIndex(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	w, err := Create(zap.NewExample(), p, nil)
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -588,7 +585,7 @@ func TestOpenAtUncommittedIndex(t *testing.T) {
 	}
 	w.Close()
 
-	w, err = Open(zap.NewExample(), p, NewEmptySnapshot())
+	w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -610,7 +607,7 @@ func TestOpenForRead(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 	// create WAL
-	w, err := Create(zap.NewExample(), p, nil)
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -630,7 +627,7 @@ func TestOpenForRead(t *testing.T) {
 	w.ReleaseLockTo(unlockIndex)
 
 	// All are available for read
-	w2, err := OpenForRead(zap.NewExample(), p, NewEmptySnapshot())
+	w2, err := OpenForRead(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -651,7 +648,7 @@ func TestOpenWithMaxIndex(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 	// create WAL
-	w, err := Create(zap.NewExample(), p, nil)
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -663,7 +660,7 @@ func TestOpenWithMaxIndex(t *testing.T) {
 	}
 	w.Close()
 
-	w, err = Open(zap.NewExample(), p, NewEmptySnapshot())
+	w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -694,7 +691,7 @@ func TestReleaseLockTo(t *testing.T) {
 	}
 	//defer os.RemoveAll(p)
 	// create WAL
-	w, err := Create(zap.NewExample(), p, nil)
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample()})
 	defer func() {
 		if err = w.Close(); err != nil {
 			t.Fatal(err)
@@ -767,7 +764,7 @@ func TestTailWriteNoSlackSpace(t *testing.T) {
 	defer os.RemoveAll(p)
 
 	// create initial WAL
-	w, err := Create(zap.NewExample(), p, []byte("metadata"))
+	w, err := Create(p, []byte("metadata"), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -789,7 +786,7 @@ func TestTailWriteNoSlackSpace(t *testing.T) {
 	w.Close()
 
 	// open, write more
-	w, err = Open(zap.NewExample(), p, NewEmptySnapshot())
+	w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -810,7 +807,7 @@ func TestTailWriteNoSlackSpace(t *testing.T) {
 	w.Close()
 
 	// confirm all writes
-	w, err = Open(zap.NewExample(), p, NewEmptySnapshot())
+	w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -841,7 +838,7 @@ func TestRestartCreateWal(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	w, werr := Create(zap.NewExample(), p, []byte("abc"))
+	w, werr := Create(p, []byte("abc"), &Options{Logger: zap.NewExample()})
 	if werr != nil {
 		t.Fatal(werr)
 	}
@@ -850,7 +847,7 @@ func TestRestartCreateWal(t *testing.T) {
 		t.Fatalf("got %q exists, expected it to not exist", tmpdir)
 	}
 
-	if w, err = OpenForRead(zap.NewExample(), p, NewEmptySnapshot()); err != nil {
+	if w, err = OpenForRead(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()}); err != nil {
 		t.Fatal(err)
 	}
 	defer w.Close()
@@ -871,7 +868,7 @@ func TestOpenOnTornWrite(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(p)
-	w, err := Create(zap.NewExample(), p, nil)
+	w, err := Create(p, nil, &Options{Logger: zap.NewExample()})
 	defer func() {
 		if err = w.Close(); err != nil && err != os.ErrInvalid {
 			t.Fatal(err)
@@ -913,7 +910,7 @@ func TestOpenOnTornWrite(t *testing.T) {
 	}
 	f.Close()
 
-	w, err = Open(zap.NewExample(), p, NewEmptySnapshot())
+	w, err = Open(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -934,7 +931,7 @@ func TestOpenOnTornWrite(t *testing.T) {
 	w.Close()
 
 	// read back the entries, confirm number of entries matches expectation
-	w, err = OpenForRead(zap.NewExample(), p, NewEmptySnapshot())
+	w, err = OpenForRead(p, NewEmptySnapshot(), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -957,12 +954,6 @@ func TestRenameFail(t *testing.T) {
 	}
 	defer os.RemoveAll(p)
 
-	oldSegmentSizeBytes := SegmentSizeBytes
-	defer func() {
-		SegmentSizeBytes = oldSegmentSizeBytes
-	}()
-	SegmentSizeBytes = math.MaxInt64
-
 	tp, terr := ioutil.TempDir(os.TempDir(), "waltest")
 	if terr != nil {
 		t.Fatal(terr)
@@ -970,8 +961,9 @@ func TestRenameFail(t *testing.T) {
 	os.RemoveAll(tp)
 
 	w := &WAL{
-		lg:  zap.NewExample(),
-		dir: p,
+		lg:   zap.NewExample(),
+		opts: &Options{SegmentSizeBytes: math.MaxInt64, FS: OSFS},
+		dir:  p,
 	}
 	w2, werr := w.renameWAL(tp)
 	if w2 != nil || werr == nil { // os.Rename should fail from 'no such file or directory'
@@ -988,7 +980,7 @@ func TestReadAllFail(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	// create initial WAL
-	f, err := Create(zap.NewExample(), dir, []byte("metadata"))
+	f, err := Create(dir, []byte("metadata"), &Options{Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1016,7 +1008,7 @@ func TestValidSnapshotEntries(t *testing.T) {
 	state2 := &walpb.HardState{Committed: 3}
 	snap4 := &walpb.Snapshot{Index: 4} // will be orphaned since the last committed entry will be snap3
 	func() {
-		w, err := Create(zap.NewExample(), p, nil)
+		w, err := Create(p, nil, &Options{Logger: zap.NewExample()})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1042,7 +1034,7 @@ func TestValidSnapshotEntries(t *testing.T) {
 			t.Fatal(err)
 		}
 	}()
-	walSnaps, err := ValidSnapshotEntries(zap.NewExample(), p)
+	walSnaps, err := ValidSnapshotEntries(zap.NewExample(), p, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1055,11 +1047,6 @@ func TestValidSnapshotEntries(t *testing.T) {
 // TestValidSnapshotEntriesAfterPurgeWal ensure that there are many wal files, and after cleaning the first wal file,
 // it can work well.
 func TestValidSnapshotEntriesAfterPurgeWal(t *testing.T) {
-	oldSegmentSizeBytes := SegmentSizeBytes
-	SegmentSizeBytes = 64
-	defer func() {
-		SegmentSizeBytes = oldSegmentSizeBytes
-	}()
 	p, err := ioutil.TempDir(os.TempDir(), "waltest")
 	if err != nil {
 		t.Fatal(err)
@@ -1072,7 +1059,7 @@ func TestValidSnapshotEntriesAfterPurgeWal(t *testing.T) {
 	snap3 := &walpb.Snapshot{Index: 3}
 	state2 := &walpb.HardState{Committed: 3}
 	func() {
-		w, err := Create(zap.NewExample(), p, nil)
+		w, err := Create(p, nil, &Options{Logger: zap.NewExample(), SegmentSizeBytes: 64})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1098,12 +1085,12 @@ func TestValidSnapshotEntriesAfterPurgeWal(t *testing.T) {
 		}
 
 	}()
-	files, _, err := selectWALFiles(nil, p, snap0)
+	files, _, err := selectWALFiles(nil, OSFS, p, snap0)
 	if err != nil {
 		t.Fatal(err)
 	}
 	os.Remove(p + "/" + files[0])
-	_, err = ValidSnapshotEntries(zap.NewExample(), p)
+	_, err = ValidSnapshotEntries(zap.NewExample(), p, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -8,10 +8,12 @@ package walpb
 
 import "errors"
 
+var ErrCRCMismatch = errors.New("walpb: crc mismatch")
+
 func (m *Record) Validate(crc uint32) error {
 	if m.Crc == crc {
 		return nil
 	}
 	m.Reset()
-	return errors.New("record crc mismatch")
+	return ErrCRCMismatch
 }
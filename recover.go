@@ -0,0 +1,123 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wal
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/BeDreamCoder/wal/log"
+	"github.com/BeDreamCoder/wal/snap"
+	"go.uber.org/zap"
+)
+
+// RecoveryOp is the step of a recovery that failed.
+type RecoveryOp string
+
+const (
+	RecoveryOpen   RecoveryOp = "open"
+	RecoveryRead   RecoveryOp = "read"
+	RecoveryRepair RecoveryOp = "repair"
+)
+
+// RecoveryError is returned by Recover and OpenStorage. Err is the failure
+// of Op, such as log.ErrCRCMismatch or log.ErrSnapshotNotFound, and is seen
+// through by errors.Is and errors.Cause. A read failure is only repaired
+// when it is a torn write, io.ErrUnexpectedEOF, and only once.
+type RecoveryError struct {
+	Op     RecoveryOp
+	Err    error
+	Report RecoveryReport // the recovery up to the failure
+}
+
+func (e *RecoveryError) Error() string {
+	return fmt.Sprintf("wal: failed to %s WAL: %v", e.Op, e.Err)
+}
+
+func (e *RecoveryError) Unwrap() error { return e.Err }
+
+func (e *RecoveryError) Cause() error { return e.Err }
+
+// RecoveryReport describes what a recovery read and repaired.
+type RecoveryReport struct {
+	SegmentsRead     int   // segments read from the one holding the snapshot
+	EntriesRecovered int   // entries after the snapshot
+	Repaired         bool  // whether a torn write was repaired
+	TruncatedBytes   int64 // bytes the repair cut from the last segment
+}
+
+// Recovered is the WAL and its records read back by Recover.
+type Recovered struct {
+	WAL      *log.WAL
+	Metadata []byte
+	State    log.HardState
+	Entries  []log.LogEntry
+	Report   RecoveryReport
+}
+
+// Recover opens the WAL at the given snap and reads out its latest HardState
+// and all entries that appear after the position of the snap. A torn write
+// at the end of the log is repaired once. Any failure is returned as a
+// *RecoveryError, leaving the WAL closed.
+func Recover(waldir string, snap log.Snapshot, opts *log.Options) (*Recovered, error) {
+	lg := zap.NewNop()
+	if opts != nil && opts.Logger != nil {
+		lg = opts.Logger
+	}
+
+	var report RecoveryReport
+	for {
+		w, err := log.Open(waldir, snap, opts)
+		if err != nil {
+			return nil, &RecoveryError{Op: RecoveryOpen, Err: err, Report: report}
+		}
+		report.SegmentsRead = w.SegmentsRead()
+
+		metadata, st, ents, err := w.ReadAll()
+		if err != nil {
+			w.Close()
+			// we can only repair ErrUnexpectedEOF and we never repair twice.
+			if report.Repaired || err != io.ErrUnexpectedEOF {
+				return nil, &RecoveryError{Op: RecoveryRead, Err: err, Report: report}
+			}
+			n, rerr := log.RepairTail(lg, waldir, opts)
+			if rerr != nil {
+				return nil, &RecoveryError{Op: RecoveryRepair, Err: rerr, Report: report}
+			}
+			lg.Info("repaired WAL", zap.Error(err), zap.Int64("truncated-bytes", n))
+			report.Repaired, report.TruncatedBytes = true, n
+			continue
+		}
+
+		report.EntriesRecovered = len(ents)
+		return &Recovered{WAL: w, Metadata: metadata, State: st, Entries: ents, Report: report}, nil
+	}
+}
+
+// OpenStorage recovers the WAL in waldir at the given snap, and returns it
+// together with the Snapshotter of snapdir as a Storage. Failures are
+// returned as in Recover.
+func OpenStorage(waldir, snapdir string, snapshot log.Snapshot, opts *log.Options) (Storage, *Recovered, error) {
+	rec, err := Recover(waldir, snapshot, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	lg, sopts := zap.NewNop(), &snap.Options{}
+	if opts != nil {
+		if opts.Logger != nil {
+			lg = opts.Logger
+		}
+		// the snapshotter shares the filesystem and the metric labels of the WAL
+		sopts = &snap.Options{FS: opts.FS, Registerer: opts.Registerer, ConstLabels: opts.ConstLabels}
+	}
+	ss, err := snap.NewWithOptions(lg, snapdir, sopts)
+	if err != nil {
+		rec.WAL.Close()
+		return nil, nil, err
+	}
+	return NewStorage(rec.WAL, ss), rec, nil
+}
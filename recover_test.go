@@ -0,0 +1,81 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wal
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/log"
+	"github.com/BeDreamCoder/wal/log/walpb"
+	"github.com/stretchr/testify/assert"
+)
+
+type badEntry struct{ CustomEntry }
+
+func (m *badEntry) Unmarshal(data []byte) error {
+	return errors.New("bad entry")
+}
+
+func TestRecover(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := log.Create(p, []byte("metadata"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, w.SaveEntry([]log.LogEntry{&CustomEntry{1, "a"}, &CustomEntry{2, "b"}, &CustomEntry{3, "c"}}))
+	assert.NoError(t, w.Close())
+
+	// tear the last entry
+	name := filepath.Join(p, "0000000000000000-0000000000000000.wal")
+	b, err := ioutil.ReadFile(name)
+	assert.NoError(t, err)
+	end := len(b)
+	for end > 0 && b[end-1] == 0 {
+		end--
+	}
+	assert.NoError(t, os.Truncate(name, int64(end-2)))
+
+	rec, err := Recover(p, &walpb.Snapshot{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("metadata"), rec.Metadata)
+	assert.Equal(t, 2, len(rec.Entries))
+	assert.Equal(t, 1, rec.Report.SegmentsRead)
+	assert.Equal(t, 2, rec.Report.EntriesRecovered)
+	assert.True(t, rec.Report.Repaired)
+	assert.True(t, rec.Report.TruncatedBytes > 0)
+	assert.NoError(t, rec.WAL.Close())
+
+	// undecodable entries are returned instead of panicking
+	reg := log.NewRegistry()
+	reg.RegisterEntryFactory(func() log.LogEntry { return &badEntry{} })
+	_, err = Recover(p, &walpb.Snapshot{}, &log.Options{Registry: reg})
+	var rerr *RecoveryError
+	assert.True(t, errors.As(err, &rerr))
+	assert.Equal(t, RecoveryRead, rerr.Op)
+	assert.True(t, errors.Is(err, log.ErrInvalidRecord))
+
+	_, err = Recover(p, &walpb.Snapshot{Index: 10}, nil)
+	assert.True(t, errors.Is(err, log.ErrSnapshotNotFound))
+	assert.False(t, errors.Is(err, io.ErrUnexpectedEOF))
+}
+
+func TestOpenStorageMissing(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(p)
+
+	_, _, err = OpenStorage(filepath.Join(p, "wal"), filepath.Join(p, "snap"), &walpb.Snapshot{}, nil)
+	var rerr *RecoveryError
+	assert.True(t, errors.As(err, &rerr))
+	assert.Equal(t, RecoveryOpen, rerr.Op)
+}
@@ -18,13 +18,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/BeDreamCoder/wal/log"
 	"github.com/dustin/go-humanize"
-	"go.etcd.io/etcd/pkg/fileutil"
 	"go.uber.org/zap"
 )
 
@@ -35,7 +36,7 @@ var ErrNoDBSnapshot = errors.New("snap: snapshot file doesn't exist")
 func (s *Snapshotter) SaveDBFrom(r io.Reader, id uint64) (int64, error) {
 	start := time.Now()
 
-	f, err := ioutil.TempFile(s.dir, "tmp")
+	f, err := s.tempFile()
 	if err != nil {
 		return 0, err
 	}
@@ -43,22 +44,25 @@ func (s *Snapshotter) SaveDBFrom(r io.Reader, id uint64) (int64, error) {
 	n, err = io.Copy(f, r)
 	if err == nil {
 		fsyncStart := time.Now()
-		err = fileutil.Fsync(f)
-		snapDBFsyncSec.Observe(time.Since(fsyncStart).Seconds())
+		err = s.fs.Fsync(f)
+		s.metrics.dbFsyncSec.Observe(time.Since(fsyncStart).Seconds())
 	}
 	f.Close()
 	if err != nil {
-		os.Remove(f.Name())
+		s.fs.Remove(f.Name())
 		return n, err
 	}
 	fn := s.dbFilePath(id)
-	if fileutil.Exist(fn) {
-		os.Remove(f.Name())
+	if s.exist(fn) {
+		s.fs.Remove(f.Name())
 		return n, nil
 	}
-	err = os.Rename(f.Name(), fn)
+	err = s.fs.Rename(f.Name(), fn)
 	if err != nil {
-		os.Remove(f.Name())
+		s.fs.Remove(f.Name())
+		return n, err
+	}
+	if err = s.syncDir(); err != nil {
 		return n, err
 	}
 
@@ -69,18 +73,19 @@ func (s *Snapshotter) SaveDBFrom(r io.Reader, id uint64) (int64, error) {
 		zap.String("size", humanize.Bytes(uint64(n))),
 	)
 
-	snapDBSaveSec.Observe(time.Since(start).Seconds())
+	s.metrics.dbSaveSec.Observe(time.Since(start).Seconds())
+	s.metrics.dbSizeBytes.Observe(float64(n))
 	return n, nil
 }
 
 // DBFilePath returns the file path for the snapshot of the database with
 // given id. If the snapshot does not exist, it returns error.
 func (s *Snapshotter) DBFilePath(id uint64) (string, error) {
-	if _, err := fileutil.ReadDir(s.dir); err != nil {
+	if _, err := s.fs.ReadDir(s.dir); err != nil {
 		return "", err
 	}
 	fn := s.dbFilePath(id)
-	if fileutil.Exist(fn) {
+	if s.exist(fn) {
 		return fn, nil
 	}
 	if s.lg != nil {
@@ -97,3 +102,22 @@ func (s *Snapshotter) DBFilePath(id uint64) (string, error) {
 func (s *Snapshotter) dbFilePath(id uint64) string {
 	return filepath.Join(s.dir, fmt.Sprintf("%016x.snap.db", id))
 }
+
+func (s *Snapshotter) exist(name string) bool {
+	_, err := s.fs.Stat(name)
+	return err == nil
+}
+
+// tempFile creates a new file in the snapshot directory with a random name
+// prefixed with "tmp", like ioutil.TempFile.
+func (s *Snapshotter) tempFile() (log.File, error) {
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(s.dir, "tmp"+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := s.fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("failed to create a temporary file in %s", s.dir)
+}
@@ -14,69 +14,166 @@
 
 package snap
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the Prometheus collectors of a Snapshotter. Snapshotters
+// registering their metrics with the same Registerer and constant labels
+// share them.
+type metrics struct {
+	marshallingSec prometheus.Histogram
+	saveSec        prometheus.Histogram
+	fsyncSec       prometheus.Histogram
+	sizeBytes      prometheus.Histogram
+	dbSaveSec      prometheus.Histogram
+	dbFsyncSec     prometheus.Histogram
+	dbSizeBytes    prometheus.Histogram
+}
 
 var (
-	snapMarshallingSec = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Namespace: "wal_debugging",
-		Subsystem: "snap",
-		Name:      "save_marshalling_duration_seconds",
-		Help:      "The marshalling cost distributions of save called by snapshot.",
-
-		// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
-		// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
-		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	defaultMetricsOnce sync.Once
+	defaultMetrics     *metrics
+)
+
+// packageMetrics returns the metrics registered with the default
+// Prometheus registerer on first use, shared by the Snapshotters configured
+// with neither a Registerer nor ConstLabels.
+func packageMetrics() *metrics {
+	defaultMetricsOnce.Do(func() {
+		m, err := newMetrics(prometheus.DefaultRegisterer, nil)
+		if err != nil {
+			m, _ = newMetrics(nil, nil)
+		}
+		defaultMetrics = m
 	})
+	return defaultMetrics
+}
 
-	snapSaveSec = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Namespace: "wal_debugging",
-		Subsystem: "snap",
-		Name:      "save_total_duration_seconds",
-		Help:      "The total latency distributions of save called by snapshot.",
+// metrics returns the metrics of the Snapshotter configured by opts.
+func (opts *Options) metrics() (*metrics, error) {
+	if opts == nil || (opts.Registerer == nil && len(opts.ConstLabels) == 0) {
+		return packageMetrics(), nil
+	}
+	reg := opts.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return newMetrics(reg, opts.ConstLabels)
+}
 
-		// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
-		// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
-		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
-	})
+// newMetrics returns the metrics labeled with labels, registered with reg
+// unless it is nil. Metrics registered with reg before under the same
+// labels are returned in place of new ones.
+func newMetrics(reg prometheus.Registerer, labels prometheus.Labels) (*metrics, error) {
+	r := &registerer{reg: reg, labels: labels}
+	m := &metrics{
+		marshallingSec: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal_debugging",
+			Subsystem: "snap",
+			Name:      "save_marshalling_duration_seconds",
+			Help:      "The marshalling cost distributions of save called by snapshot.",
 
-	snapFsyncSec = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Namespace: "wal",
-		Subsystem: "snap",
-		Name:      "fsync_duration_seconds",
-		Help:      "The latency distributions of fsync called by snap.",
+			// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
+			// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
 
-		// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
-		// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
-		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
-	})
+		saveSec: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal_debugging",
+			Subsystem: "snap",
+			Name:      "save_total_duration_seconds",
+			Help:      "The total latency distributions of save called by snapshot.",
 
-	snapDBSaveSec = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Namespace: "wal",
-		Subsystem: "snap_db",
-		Name:      "save_total_duration_seconds",
-		Help:      "The total latency distributions of v3 snapshot save",
+			// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
+			// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
 
-		// lowest bucket start of upper bound 0.1 sec (100 ms) with factor 2
-		// highest bucket start of 0.1 sec * 2^9 == 51.2 sec
-		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
-	})
+		fsyncSec: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal",
+			Subsystem: "snap",
+			Name:      "fsync_duration_seconds",
+			Help:      "The latency distributions of fsync called by snap.",
 
-	snapDBFsyncSec = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Namespace: "wal",
-		Subsystem: "snap_db",
-		Name:      "fsync_duration_seconds",
-		Help:      "The latency distributions of fsyncing .snap.db file",
+			// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
+			// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
 
-		// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
-		// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
-		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
-	})
-)
+		sizeBytes: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal",
+			Subsystem: "snap",
+			Name:      "size_bytes",
+			Help:      "The size distributions of the snapshot files saved.",
+
+			// lowest bucket start of upper bound 1 KiB with factor 4
+			// highest bucket start of 1 KiB * 4^11 == 4 GiB
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		}),
+
+		dbSaveSec: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal",
+			Subsystem: "snap_db",
+			Name:      "save_total_duration_seconds",
+			Help:      "The total latency distributions of v3 snapshot save",
+
+			// lowest bucket start of upper bound 0.1 sec (100 ms) with factor 2
+			// highest bucket start of 0.1 sec * 2^9 == 51.2 sec
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+		}),
+
+		dbFsyncSec: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal",
+			Subsystem: "snap_db",
+			Name:      "fsync_duration_seconds",
+			Help:      "The latency distributions of fsyncing .snap.db file",
+
+			// lowest bucket start of upper bound 0.001 sec (1 ms) with factor 2
+			// highest bucket start of 0.001 sec * 2^13 == 8.192 sec
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+
+		dbSizeBytes: r.histogram(prometheus.HistogramOpts{
+			Namespace: "wal",
+			Subsystem: "snap_db",
+			Name:      "size_bytes",
+			Help:      "The size distributions of the .snap.db files saved.",
+
+			// lowest bucket start of upper bound 1 KiB with factor 4
+			// highest bucket start of 1 KiB * 4^11 == 4 GiB
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		}),
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("snap: failed to register metrics: %w", r.err)
+	}
+	return m, nil
+}
+
+// registerer creates collectors with constant labels and registers them,
+// keeping the first registration error.
+type registerer struct {
+	reg    prometheus.Registerer
+	labels prometheus.Labels
+	err    error
+}
 
-func init() {
-	prometheus.MustRegister(snapMarshallingSec)
-	prometheus.MustRegister(snapSaveSec)
-	prometheus.MustRegister(snapFsyncSec)
-	prometheus.MustRegister(snapDBSaveSec)
-	prometheus.MustRegister(snapDBFsyncSec)
+func (r *registerer) histogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	opts.ConstLabels = r.labels
+	h := prometheus.NewHistogram(opts)
+	if r.reg == nil || r.err != nil {
+		return h
+	}
+	err := r.reg.Register(h)
+	if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		if c, ok := are.ExistingCollector.(prometheus.Histogram); ok {
+			return c
+		}
+	}
+	r.err = err
+	return h
 }
@@ -0,0 +1,67 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package snap
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestMetricsRegisterer(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snaptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	labels := prometheus.Labels{"member": "1"}
+	ss, err := NewWithOptions(zap.NewExample(), dir, &Options{Registerer: reg, ConstLabels: labels})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ss.SaveSnapData(testSnap); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.SaveDBFrom(strings.NewReader("db"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]uint64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if l := m.GetLabel(); len(l) != 1 || l[0].GetName() != "member" || l[0].GetValue() != "1" {
+				t.Errorf("%s: labels = %v, want member=1", mf.GetName(), l)
+			}
+			if strings.HasSuffix(mf.GetName(), "size_bytes") {
+				sizes[mf.GetName()] = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	for _, name := range []string{"wal_snap_size_bytes", "wal_snap_db_size_bytes"} {
+		if sizes[name] != 1 {
+			t.Errorf("%s: samples = %d, want 1", name, sizes[name])
+		}
+	}
+
+	// the labels of a second Snapshotter must not clash
+	if _, err = NewWithOptions(nil, dir, &Options{Registerer: reg, ConstLabels: prometheus.Labels{"member": "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewWithOptions(nil, dir, &Options{Registerer: reg, ConstLabels: prometheus.Labels{"other": "1"}}); err == nil {
+		t.Error("expected an error registering metrics of inconsistent labels")
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package snap
+
+import "time"
+
+// Observer is notified of the lifecycle events of a Snapshotter, for
+// alerting, auditing or test assertions. Its methods are called
+// synchronously by the goroutine causing the event, so they must return
+// quickly and must not call back into the Snapshotter. Embed NopObserver to
+// handle only some of the events.
+type Observer interface {
+	// SnapshotSaved is called once a snapshot file is synced.
+	SnapshotSaved(e SnapshotSavedEvent)
+	// SnapshotLoaded is called with the snapshot returned by Load or
+	// LoadNewestAvailable.
+	SnapshotLoaded(e SnapshotLoadedEvent)
+	// SnapshotBroken is called when a snapshot file failing to load is
+	// renamed out of the way.
+	SnapshotBroken(e SnapshotBrokenEvent)
+	// DBReleased is called for every .snap.db file ReleaseSnapDBs removes.
+	DBReleased(e DBReleasedEvent)
+}
+
+// SnapshotSavedEvent reports a saved snapshot.
+type SnapshotSavedEvent struct {
+	Path  string
+	Index uint64
+	Size  int64 // the size of the snapshot file
+	Took  time.Duration
+}
+
+// SnapshotLoadedEvent reports a loaded snapshot.
+type SnapshotLoadedEvent struct {
+	Path  string
+	Index uint64
+}
+
+// SnapshotBrokenEvent reports a snapshot file renamed to BrokenPath
+// because reading it failed with Err.
+type SnapshotBrokenEvent struct {
+	Path       string
+	BrokenPath string
+	Err        error
+}
+
+// DBReleasedEvent reports a removed .snap.db file.
+type DBReleasedEvent struct {
+	Path  string
+	Index uint64
+}
+
+// NopObserver is an Observer ignoring every event.
+type NopObserver struct{}
+
+func (NopObserver) SnapshotSaved(SnapshotSavedEvent) {}
+
+func (NopObserver) SnapshotLoaded(SnapshotLoadedEvent) {}
+
+func (NopObserver) SnapshotBroken(SnapshotBrokenEvent) {}
+
+func (NopObserver) DBReleased(DBReleasedEvent) {}
@@ -0,0 +1,86 @@
+/*
+Copyright Zhigui.com. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package snap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BeDreamCoder/wal/snap/snappb"
+	"go.uber.org/zap"
+)
+
+// recordingObserver records the events of a Snapshotter.
+type recordingObserver struct {
+	NopObserver
+
+	saved    []SnapshotSavedEvent
+	loaded   []SnapshotLoadedEvent
+	broken   []SnapshotBrokenEvent
+	released []DBReleasedEvent
+}
+
+func (o *recordingObserver) SnapshotSaved(e SnapshotSavedEvent) { o.saved = append(o.saved, e) }
+
+func (o *recordingObserver) SnapshotLoaded(e SnapshotLoadedEvent) { o.loaded = append(o.loaded, e) }
+
+func (o *recordingObserver) SnapshotBroken(e SnapshotBrokenEvent) { o.broken = append(o.broken, e) }
+
+func (o *recordingObserver) DBReleased(e DBReleasedEvent) { o.released = append(o.released, e) }
+
+func TestObserver(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snaptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &recordingObserver{}
+	ss, err := NewWithOptions(zap.NewExample(), dir, &Options{Observer: o})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ss.SaveSnapData(testSnap); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "0000000000000001.snap")
+	if len(o.saved) != 1 || o.saved[0].Path != path || o.saved[0].Index != 1 || o.saved[0].Size == 0 {
+		t.Errorf("saved = %+v, want snapshot 1 at %s", o.saved, path)
+	}
+
+	// a corrupt newer snapshot is renamed broken on load
+	broken := filepath.Join(dir, "0000000000000002.snap")
+	if err = ioutil.WriteFile(broken, []byte("somedata"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.broken) != 1 || o.broken[0].Path != broken || o.broken[0].BrokenPath != broken+".broken" || o.broken[0].Err == nil {
+		t.Errorf("broken = %+v, want %s", o.broken, broken)
+	}
+	if wloaded := []SnapshotLoadedEvent{{Path: path, Index: 1}}; !reflect.DeepEqual(o.loaded, wloaded) {
+		t.Errorf("loaded = %+v, want %+v", o.loaded, wloaded)
+	}
+
+	for _, id := range []uint64{1, 2} {
+		if _, err = ss.SaveDBFrom(strings.NewReader("db"), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ss.ReleaseSnapDBs(snappb.ShotData{Index: 2}); err != nil {
+		t.Fatal(err)
+	}
+	wreleased := []DBReleasedEvent{{Path: ss.dbFilePath(1), Index: 1}}
+	if !reflect.DeepEqual(o.released, wreleased) {
+		t.Errorf("released = %+v, want %+v", o.released, wreleased)
+	}
+}
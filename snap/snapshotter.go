@@ -18,7 +18,6 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -28,7 +27,7 @@ import (
 
 	"github.com/BeDreamCoder/wal/log"
 	"github.com/BeDreamCoder/wal/snap/snappb"
-	pioutil "go.etcd.io/etcd/pkg/ioutil"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.etcd.io/etcd/pkg/pbutil"
 	"go.uber.org/zap"
 )
@@ -60,18 +59,69 @@ type SnapshotAPI interface {
 var _ SnapshotAPI = &Snapshotter{}
 
 type Snapshotter struct {
-	lg  *zap.Logger
-	dir string
+	lg       *zap.Logger
+	dir      string
+	fs       log.FS
+	metrics  *metrics
+	observer Observer
 }
 
+// Options configures a Snapshotter. A nil *Options selects the defaults.
+type Options struct {
+	// FS is the filesystem the snapshots are kept on. Defaults to log.OSFS.
+	FS log.FS
+
+	// Registerer registers the Prometheus metrics of the Snapshotter.
+	// Defaults to prometheus.DefaultRegisterer. Snapshotters registering
+	// with the same Registerer and ConstLabels share their metrics.
+	Registerer prometheus.Registerer
+
+	// ConstLabels are set on every metric of the Snapshotter, to tell the
+	// Snapshotters of a process apart.
+	ConstLabels prometheus.Labels
+
+	// Observer is notified of the lifecycle events of the Snapshotter.
+	// Defaults to NopObserver.
+	Observer Observer
+}
+
+// New returns the Snapshotter of dir with the default options. It panics
+// if its metrics fail to register.
 func New(lg *zap.Logger, dir string) *Snapshotter {
 	if lg == nil {
 		lg = zap.NewNop()
 	}
-	return &Snapshotter{
-		lg:  lg,
-		dir: dir,
+	s, err := NewWithOptions(lg, dir, nil)
+	if err != nil {
+		lg.Panic("failed to create a snapshotter", zap.String("path", dir), zap.Error(err))
 	}
+	return s
+}
+
+// NewWithOptions returns the Snapshotter of dir configured by opts, or the
+// error registering its metrics.
+func NewWithOptions(lg *zap.Logger, dir string, opts *Options) (*Snapshotter, error) {
+	if lg == nil {
+		lg = zap.NewNop()
+	}
+	m, err := opts.metrics()
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshotter{
+		lg:       lg,
+		dir:      dir,
+		fs:       log.OSFS,
+		metrics:  m,
+		observer: NopObserver{},
+	}
+	if opts != nil && opts.FS != nil {
+		s.fs = opts.FS
+	}
+	if opts != nil && opts.Observer != nil {
+		s.observer = opts.Observer
+	}
+	return s, nil
 }
 
 func (s *Snapshotter) SaveSnapData(snapshot snappb.ShotData) error {
@@ -92,24 +142,30 @@ func (s *Snapshotter) save(snapshot *snappb.ShotData) error {
 	if err != nil {
 		return err
 	}
-	snapMarshallingSec.Observe(time.Since(start).Seconds())
+	s.metrics.marshallingSec.Observe(time.Since(start).Seconds())
 
 	spath := filepath.Join(s.dir, fname)
 
 	fsyncStart := time.Now()
-	err = pioutil.WriteAndSyncFile(spath, d, 0666)
-	snapFsyncSec.Observe(time.Since(fsyncStart).Seconds())
+	err = log.WriteFile(s.fs, spath, d, 0666, true)
+	if err == nil {
+		err = s.syncDir()
+	}
+	s.metrics.fsyncSec.Observe(time.Since(fsyncStart).Seconds())
 
 	if err != nil {
 		s.lg.Warn("failed to write a snap file", zap.String("path", spath), zap.Error(err))
-		rerr := os.Remove(spath)
+		rerr := s.fs.Remove(spath)
 		if rerr != nil {
 			s.lg.Warn("failed to remove a broken snap file", zap.String("path", spath), zap.Error(err))
 		}
 		return err
 	}
 
-	snapSaveSec.Observe(time.Since(start).Seconds())
+	took := time.Since(start)
+	s.metrics.saveSec.Observe(took.Seconds())
+	s.metrics.sizeBytes.Observe(float64(len(d)))
+	s.observer.SnapshotSaved(SnapshotSavedEvent{Path: spath, Index: snapshot.Index, Size: int64(len(d)), Took: took})
 	return nil
 }
 
@@ -138,37 +194,57 @@ func (s *Snapshotter) loadMatching(matchFn func(*snappb.ShotData) bool) (*snappb
 	}
 	var snap *snappb.ShotData
 	for _, name := range names {
-		if snap, err = loadSnap(s.lg, s.dir, name); err == nil && matchFn(snap) {
+		if snap, err = s.loadSnap(name); err == nil && matchFn(snap) {
+			s.observer.SnapshotLoaded(SnapshotLoadedEvent{Path: filepath.Join(s.dir, name), Index: snap.Index})
 			return snap, nil
 		}
 	}
 	return nil, ErrNoSnapshot
 }
 
-func loadSnap(lg *zap.Logger, dir, name string) (*snappb.ShotData, error) {
-	fpath := filepath.Join(dir, name)
-	snap, err := Read(lg, fpath)
+func (s *Snapshotter) loadSnap(name string) (*snappb.ShotData, error) {
+	fpath := filepath.Join(s.dir, name)
+	snap, err := read(s.lg, s.fs, fpath)
 	if err != nil {
 		brokenPath := fpath + ".broken"
-		if lg != nil {
-			lg.Warn("failed to read a snap file", zap.String("path", fpath), zap.Error(err))
-		}
-		if rerr := os.Rename(fpath, brokenPath); rerr != nil {
-			if lg != nil {
-				lg.Warn("failed to rename a broken snap file", zap.String("path", fpath), zap.String("broken-path", brokenPath), zap.Error(rerr))
-			}
+		s.lg.Warn("failed to read a snap file", zap.String("path", fpath), zap.Error(err))
+		if rerr := s.fs.Rename(fpath, brokenPath); rerr != nil {
+			s.lg.Warn("failed to rename a broken snap file", zap.String("path", fpath), zap.String("broken-path", brokenPath), zap.Error(rerr))
 		} else {
-			if lg != nil {
-				lg.Warn("renamed to a broken snap file", zap.String("path", fpath), zap.String("broken-path", brokenPath))
-			}
+			s.lg.Warn("renamed to a broken snap file", zap.String("path", fpath), zap.String("broken-path", brokenPath))
+			s.observer.SnapshotBroken(SnapshotBrokenEvent{Path: fpath, BrokenPath: brokenPath, Err: err})
 		}
 	}
 	return snap, err
 }
 
+// syncDir syncs the snapshot directory to persist the snap and db files
+// created in it.
+func (s *Snapshotter) syncDir() error {
+	d, err := s.fs.OpenDir(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return s.fs.Fsync(d)
+}
+
 // Read reads the snapshot named by snapname and returns the snapshot.
 func Read(lg *zap.Logger, snapname string) (*snappb.ShotData, error) {
-	b, err := ioutil.ReadFile(snapname)
+	return read(lg, log.OSFS, snapname)
+}
+
+// ReadWithOptions is Read on the FS of opts.
+func ReadWithOptions(lg *zap.Logger, snapname string, opts *Options) (*snappb.ShotData, error) {
+	fs := log.OSFS
+	if opts != nil && opts.FS != nil {
+		fs = opts.FS
+	}
+	return read(lg, fs, snapname)
+}
+
+func read(lg *zap.Logger, fs log.FS, snapname string) (*snappb.ShotData, error) {
+	b, err := log.ReadFile(fs, snapname)
 	if err != nil {
 		if lg != nil {
 			lg.Warn("failed to read a snap file", zap.String("path", snapname), zap.Error(err))
@@ -223,12 +299,7 @@ func Read(lg *zap.Logger, snapname string) (*snappb.ShotData, error) {
 // SnapNames returns the filename of the snapshots in logical time order (from newest to oldest).
 // If there is no available snapshots, an ErrNoSnapshot will be returned.
 func (s *Snapshotter) SnapNames() ([]string, error) {
-	dir, err := os.Open(s.dir)
-	if err != nil {
-		return nil, err
-	}
-	defer dir.Close()
-	names, err := dir.Readdirnames(-1)
+	names, err := s.fs.ReadDir(s.dir)
 	if err != nil {
 		return nil, err
 	}
@@ -269,7 +340,7 @@ func (s *Snapshotter) cleanupSnapdir(filenames []string) (names []string, err er
 	for _, filename := range filenames {
 		if strings.HasPrefix(filename, "db.tmp") {
 			s.lg.Info("found orphaned defragmentation file; deleting", zap.String("path", filename))
-			if rmErr := os.Remove(filepath.Join(s.dir, filename)); rmErr != nil && !os.IsNotExist(rmErr) {
+			if rmErr := s.fs.Remove(filepath.Join(s.dir, filename)); rmErr != nil && !os.IsNotExist(rmErr) {
 				return names, fmt.Errorf("failed to remove orphaned .snap.db file %s: %v", filename, rmErr)
 			}
 		} else {
@@ -280,12 +351,7 @@ func (s *Snapshotter) cleanupSnapdir(filenames []string) (names []string, err er
 }
 
 func (s *Snapshotter) ReleaseSnapDBs(snap snappb.ShotData) error {
-	dir, err := os.Open(s.dir)
-	if err != nil {
-		return err
-	}
-	defer dir.Close()
-	filenames, err := dir.Readdirnames(-1)
+	filenames, err := s.fs.ReadDir(s.dir)
 	if err != nil {
 		return err
 	}
@@ -299,8 +365,11 @@ func (s *Snapshotter) ReleaseSnapDBs(snap snappb.ShotData) error {
 			}
 			if index < snap.Index {
 				s.lg.Info("found orphaned .snap.db file; deleting", zap.String("path", filename))
-				if rmErr := os.Remove(filepath.Join(s.dir, filename)); rmErr != nil && !os.IsNotExist(rmErr) {
+				fpath := filepath.Join(s.dir, filename)
+				if rmErr := s.fs.Remove(fpath); rmErr != nil && !os.IsNotExist(rmErr) {
 					s.lg.Error("failed to remove orphaned .snap.db file", zap.String("path", filename), zap.String("error", rmErr.Error()))
+				} else if rmErr == nil {
+					s.observer.DBReleased(DBReleasedEvent{Path: fpath, Index: index})
 				}
 			}
 		}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/BeDreamCoder/wal/log"
@@ -301,3 +302,50 @@ func TestReleaseSnapDBs(t *testing.T) {
 		}
 	}
 }
+
+// renameFS is an FS recording the renames of its files.
+type renameFS struct {
+	log.FS
+	renamed []string
+}
+
+func (fs *renameFS) Rename(oldpath, newpath string) error {
+	fs.renamed = append(fs.renamed, filepath.Base(newpath))
+	return fs.FS.Rename(oldpath, newpath)
+}
+
+func TestSnapshotterFS(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "snaptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := &renameFS{FS: log.OSFS}
+	ss, err := NewWithOptions(zap.NewExample(), dir, &Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.SaveDBFrom(strings.NewReader("db"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = ss.SaveSnapData(testSnap); err != nil {
+		t.Fatal(err)
+	}
+	// a broken snapshot is renamed when loading
+	if err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%016x.snap", 2)), []byte("broken"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	g, err := ss.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, &testSnap) {
+		t.Errorf("snap = %#v, want %#v", g, &testSnap)
+	}
+
+	want := []string{"0000000000000001.snap.db", "0000000000000002.snap.broken"}
+	if !reflect.DeepEqual(fs.renamed, want) {
+		t.Errorf("renamed = %v, want %v", fs.renamed, want)
+	}
+}
@@ -1,8 +1,6 @@
 package wal
 
 import (
-	"io"
-
 	"github.com/BeDreamCoder/wal/log"
 	"github.com/BeDreamCoder/wal/snap"
 	"github.com/BeDreamCoder/wal/snap/snappb"
@@ -18,11 +16,13 @@ type Storage interface {
 }
 
 type storage struct {
-	*log.WAL
+	log.WALAPI
 	*snap.Snapshotter
 }
 
-func NewStorage(w *log.WAL, s *snap.Snapshotter) Storage {
+// NewStorage returns the Storage of w and s. w is a *log.WAL, or a
+// *log.MemoryWAL for tests and ephemeral deployments.
+func NewStorage(w log.WALAPI, s *snap.Snapshotter) Storage {
 	return &storage{w, s}
 }
 
@@ -51,35 +51,17 @@ func (st *storage) Release(snap snappb.ShotData, s log.Snapshot) error {
 
 // ReadWAL reads the WAL at the given snap and returns the wal, its latest HardState and all entries that appear
 // after the position of the given snap in the WAL.
-// The snap must have been previously saved to the WAL, or this call will panic.
-func ReadWAL(lg *zap.Logger, waldir string, snap log.Snapshot, unsafeNoFsync bool) (w *log.WAL,
+// It exits the process through the logger of opts on any failure; Recover returns the failure instead.
+func ReadWAL(waldir string, snap log.Snapshot, opts *log.Options) (w *log.WAL,
 	wmetadata []byte, st log.HardState, ents []log.LogEntry) {
-	var err error
+	lg := zap.NewNop()
+	if opts != nil && opts.Logger != nil {
+		lg = opts.Logger
+	}
 
-	st = log.NewEmptyState()
-	repaired := false
-	for {
-		if w, err = log.Open(lg, waldir, snap); err != nil {
-			lg.Fatal("failed to open WAL", zap.Error(err))
-		}
-		if unsafeNoFsync {
-			w.SetUnsafeNoFsync()
-		}
-		if wmetadata, st, ents, err = w.ReadAll(); err != nil {
-			w.Close()
-			// we can only repair ErrUnexpectedEOF and we never repair twice.
-			if repaired || err != io.ErrUnexpectedEOF {
-				lg.Fatal("failed to read WAL, cannot be repaired", zap.Error(err))
-			}
-			if !log.Repair(lg, waldir) {
-				lg.Fatal("failed to repair WAL", zap.Error(err))
-			} else {
-				lg.Info("repaired WAL", zap.Error(err))
-				repaired = true
-			}
-			continue
-		}
-		break
+	rec, err := Recover(waldir, snap, opts)
+	if err != nil {
+		lg.Fatal("failed to recover WAL", zap.Error(err))
 	}
-	return w, wmetadata, st, ents
+	return rec.WAL, rec.Metadata, rec.State, rec.Entries
 }
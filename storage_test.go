@@ -73,7 +73,7 @@ func TestWAL_SaveEntry(t *testing.T) {
 	}()
 
 	lz := zap.NewExample()
-	w, err := log.Create(lz, p, []byte("metadata"))
+	w, err := log.Create(p, []byte("metadata"), &log.Options{Logger: lz})
 	assert.NoError(t, err)
 
 	storage := NewStorage(w, snap.New(lz, s))
@@ -90,7 +90,7 @@ func TestWAL_SaveEntry(t *testing.T) {
 
 	storage.Close()
 
-	w, err = log.Open(zap.NewExample(), p, &walpb.Snapshot{})
+	w, err = log.Open(p, &walpb.Snapshot{}, &log.Options{Logger: zap.NewExample()})
 	assert.NoError(t, err)
 
 	storage2 := NewStorage(w, snap.New(lz, s))
@@ -108,3 +108,28 @@ func TestWAL_SaveEntry(t *testing.T) {
 	err = storage2.Release(snappb.ShotData{Index: 3}, &walpb.Snapshot{Index: 3})
 	assert.NoError(t, err)
 }
+
+func TestMemoryStorage(t *testing.T) {
+	s, err := ioutil.TempDir(os.TempDir(), "snaptest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(s)
+
+	store := log.NewMemoryStore()
+	w, err := log.CreateMemory(store, []byte("metadata"), nil)
+	assert.NoError(t, err)
+	storage := NewStorage(w, snap.New(zap.NewExample(), s))
+
+	ents := []log.LogEntry{&CustomEntry{1, "a"}, &CustomEntry{2, "b"}, &CustomEntry{3, "c"}}
+	assert.NoError(t, storage.Save(&walpb.HardState{Committed: 2}, ents))
+	assert.NoError(t, storage.SaveSnap(snappb.ShotData{Index: 2, Data: []byte("data")}, &walpb.Snapshot{Index: 2}))
+	assert.NoError(t, storage.Close())
+
+	w, err = log.OpenMemory(store, &walpb.Snapshot{Index: 2}, nil)
+	assert.NoError(t, err)
+	defer w.Close()
+	metadata, st, ents, err := w.ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("metadata"), metadata)
+	assert.Equal(t, uint64(2), st.GetCommitted())
+	assert.Len(t, ents, 1)
+}